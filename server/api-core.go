@@ -3,12 +3,17 @@ package main
 import (
 	"fmt"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 // TODO: デプロイごとにエントリを持つようにしたい
@@ -17,124 +22,288 @@ const (
 	WaitPodTimeout = 30 * time.Second
 )
 
+// ClientFactory returns the Kubernetes client of the cluster.
+// It returns an APIError with ErrCodeBadRequest if the cluster is unknown.
+type ClientFactory func(cluster string) (kubernetes.Interface, *rest.Config, error)
+
+// resKey identifies a deployment; the same name can be deployed on each cluster and namespace.
+type resKey struct {
+	cluster   string
+	namespace string
+	name      string
+}
+
 type APICore struct {
-	HostConf    *HostConf
-	HostAddr    string
-	GatewayAddr string
-	resmap      *sync.Map
+	HostConf      *HostConf
+	HostAddr      string
+	GatewayAddr   string
+	Registry      *Registry
+	ClientFactory ClientFactory
+	// PeerTLS authenticates the connections of the migrations between the cloudlets; nil for plain TCP
+	PeerTLS    *PeerTLS
+	resmap     *sync.Map
+	migrations *MigrationJobs
+	// migrationPorts are shared by the migrations to and from this host. migrationSlots limit the
+	// migrations to this host, and dumpSlots those from this host, so that a migration between the
+	// clusters of this host takes a slot of each
+	migrationPorts *PortAllocator
+	migrationSlots *MigrationSlots
+	dumpSlots      *MigrationSlots
 }
 
+// DeployResource is the state of a deployment. mux serializes the requests to the deployment, and
+// muxInfo guards the fields, which are also updated by the pod watcher without mux. muxWatcher
+// serializes the changes of the forwarding services by the pod watcher.
 type DeployResource struct {
-	mux    sync.Mutex
-	fwdsvc *ForwarderService
+	mux        sync.Mutex
+	muxInfo    sync.RWMutex
+	muxWatcher sync.Mutex
+	deployType string
+	namespace  string
+	fwdsvcs    []ForwardingService
+	// podError is the failure of the pod detected by the pod watcher
+	podError           string
+	suspendedByWatcher bool
+	job                *MigrationJob
+}
+
+func (p *DeployResource) setDeployInfo(deployType string, namespace string) {
+	p.muxInfo.Lock()
+	p.deployType = deployType
+	p.namespace = namespace
+	p.muxInfo.Unlock()
+}
+
+func (p *DeployResource) setFwdsvcs(fwdsvcs []ForwardingService) {
+	p.muxInfo.Lock()
+	p.fwdsvcs = fwdsvcs
+	p.muxInfo.Unlock()
+}
+
+// takeFwdsvcs clears the forwarding services and returns them to close.
+func (p *DeployResource) takeFwdsvcs() []ForwardingService {
+	p.muxInfo.Lock()
+	defer p.muxInfo.Unlock()
+	fwdsvcs := p.fwdsvcs
+	p.fwdsvcs = nil
+	return fwdsvcs
+}
+
+// takeFwdsvcsIf clears the forwarding services and returns true if they are still fwdsvcs, so that
+// the forwarding services started after fwdsvcs are not closed.
+func (p *DeployResource) takeFwdsvcsIf(fwdsvcs []ForwardingService) bool {
+	p.muxInfo.Lock()
+	defer p.muxInfo.Unlock()
+	if len(p.fwdsvcs) != len(fwdsvcs) {
+		return false
+	}
+	for i := range fwdsvcs {
+		if p.fwdsvcs[i] != fwdsvcs[i] {
+			return false
+		}
+	}
+	p.fwdsvcs = nil
+	return true
+}
+
+func (p *DeployResource) info() (string, string, []ForwardingService) {
+	p.muxInfo.RLock()
+	defer p.muxInfo.RUnlock()
+	return p.deployType, p.namespace, p.fwdsvcs
+}
+
+// setPodError records the failure of the pod and returns the previous one.
+func (p *DeployResource) setPodError(podError string) string {
+	p.muxInfo.Lock()
+	defer p.muxInfo.Unlock()
+	prev := p.podError
+	p.podError = podError
+	return prev
+}
+
+func (p *DeployResource) getPodError() string {
+	p.muxInfo.RLock()
+	defer p.muxInfo.RUnlock()
+	return p.podError
+}
+
+func (p *DeployResource) setSuspendedByWatcher(suspended bool) bool {
+	p.muxInfo.Lock()
+	defer p.muxInfo.Unlock()
+	prev := p.suspendedByWatcher
+	p.suspendedByWatcher = suspended
+	return prev
+}
+
+func (p *DeployResource) setJob(job *MigrationJob) {
+	p.muxInfo.Lock()
+	p.job = job
+	p.muxInfo.Unlock()
+}
+
+func (p *DeployResource) isMigrating() bool {
+	p.muxInfo.RLock()
+	defer p.muxInfo.RUnlock()
+	return p.job != nil && !p.job.Finished()
 }
 
 func NewAPICore(
 	hostConf *HostConf,
 	hostAddr string,
 	gatewayAddr string,
+	registry *Registry,
+	clientFactory ClientFactory,
+	peerTLS *PeerTLS,
 ) *APICore {
+	portMin, portMax := hostConf.GetMigrationPorts()
 	return &APICore{
-		HostConf:    hostConf,
-		HostAddr:    hostAddr,
-		GatewayAddr: gatewayAddr,
-		resmap:      &sync.Map{},
+		HostConf:       hostConf,
+		HostAddr:       hostAddr,
+		GatewayAddr:    gatewayAddr,
+		Registry:       registry,
+		ClientFactory:  clientFactory,
+		PeerTLS:        peerTLS,
+		resmap:         &sync.Map{},
+		migrations:     NewMigrationJobs(),
+		migrationPorts: NewPortAllocator(portMin, portMax),
+		migrationSlots: NewMigrationSlots(hostConf.GetMaxMigrations()),
+		dumpSlots:      NewMigrationSlots(hostConf.GetMaxMigrations()),
 	}
 }
 
-func (p *APICore) Deploy(req *Request) {
+func (p *APICore) Deploy(req *Request) (*Response, error) {
+	cluster, err := p.getCluster(req.Deploy.Cluster)
+	if err != nil {
+		return nil, err
+	}
+	req.Deploy.Cluster = cluster
+	req.Deploy.Namespace = p.getNamespace(req.Deploy.Namespace)
+	var resp *Response
 	switch req.Deploy.Type {
 	case DeployTypeNew:
-		p.DeployNew(req)
+		resp, err = p.DeployNew(req)
 	case DeployTypeFwd:
-		p.DeployFwd(req)
+		resp, err = p.DeployFwd(req)
 	case DeployTypeLM:
-		p.DeployLM(req)
+		resp, err = p.DeployLM(req)
 	case DeployTypeFwdLM:
-		p.DeployFwdLM(req)
+		resp, err = p.DeployFwdLM(req)
 	default:
-		Logger.Error("Unsupported deploy type: " + req.Deploy.Type)
+		return nil, NewAPIError(ErrCodeUnsupported,
+			errors.New("Unsupported deploy type: "+req.Deploy.Type))
+	}
+	if err != nil {
+		return nil, err
 	}
+	return resp, nil
 }
 
-func (p *APICore) DeployNew(req *Request) {
+func (p *APICore) DeployNew(req *Request) (*Response, error) {
+	cluster := req.Deploy.Cluster
+	namespace := p.getNamespace(req.Deploy.Namespace)
 	name := req.Deploy.Name
 	image := req.Deploy.NewApp.Image
-	portIn := int32(req.Deploy.NewApp.Port.In)
-	portExt := int32(req.Deploy.NewApp.Port.Ext)
+	ports := req.Deploy.GetPorts()
 	env := req.Deploy.NewApp.Env
+	podOpts := &req.Deploy.NewApp.PodOptions
+	controller := req.Deploy.GetController()
+	replicas := req.Deploy.GetReplicas()
 	podName := ToPodName(name)
 	containerName := ToContainerName(name)
 	serviceName := ToServiceName(name)
 	clusterIPName := ToClusterIPName(name)
-	val, _ := p.resmap.LoadOrStore(name, &DeployResource{})
-	res := val.(*DeployResource)
+	res := p.loadResource(cluster, namespace, name)
 	defer res.mux.Unlock()
 	res.mux.Lock()
-	clientset, _, err := NewClient()
+	if err := checkNotMigrating(res, name); err != nil {
+		return nil, err
+	}
+	clientset, _, err := p.ClientFactory(cluster)
 	if err != nil {
-		Logger.ErrorE(err)
-		return
+		return nil, err
 	}
-	newPod := p.createNewPod(clientset, name, podName, containerName, image, portIn, env, nil, nil)
-	clusterIP := p.createOrGetClusterIP(clientset, name, serviceName, clusterIPName, portIn)
-	if res.fwdsvc != nil {
-		Logger.Info("Use existing forwarding service")
-	} else if clusterIP != "" {
-		clientAddr, appAddr, err := p.getForwardAddrs(portExt, clusterIP, portIn)
-		if err != nil {
-			Logger.ErrorE(err)
-		} else {
-			if fsv, err := StartForwarderService("tcp", clientAddr, appAddr, false); err != nil {
-				Logger.ErrorE(err)
-			} else {
-				res.fwdsvc = fsv
-			}
-		}
+	resp := &Response{
+		Ok:      true,
+		Service: serviceName,
+		Ports:   ports,
+	}
+	var newPod bool
+	if controller == ControllerPod {
+		newPod, err = p.createNewPod(clientset, namespace, name, podName, containerName, image, ports,
+			env, nil, nil, podOpts)
+		resp.Pod = podName
 	} else {
-		Logger.Error("Forwarding service cannot not started because ClusterIP is unknown")
+		resp.Controller = ToControllerName(name, controller)
+		newPod, err = p.createController(clientset, namespace, name, controller, resp.Controller,
+			int32(replicas), containerName, image, ports, env, podOpts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	clusterIP, _, err := p.createOrGetClusterIP(clientset, namespace, name, serviceName, clusterIPName, ports)
+	if err != nil {
+		return nil, err
+	}
+	resp.ClusterIP = clusterIP
+	if err := p.startForwardingServices(res, clusterIP, ports, false, false, 0); err != nil {
+		return nil, err
 	}
 	if newPod {
-		if err := WaitForPodReady(clientset, podName, WaitPodTimeout); err != nil {
-			Logger.ErrorE(err)
+		if controller == ControllerPod {
+			err = WaitForPodReady(clientset, namespace, podName, WaitPodTimeout)
+		} else {
+			err = WaitForPodsReady(clientset, namespace, name, replicas, WaitPodTimeout)
+		}
+		if err != nil {
+			return nil, podWaitError(err)
 		}
 	}
+	p.setDeployed(res, &req.Deploy, namespace)
+	return resp, nil
 }
 
-func (p *APICore) DeployFwd(req *Request) {
+func (p *APICore) DeployFwd(req *Request) (*Response, error) {
+	cluster := req.Deploy.Cluster
+	namespace := req.Deploy.Namespace
 	name := req.Deploy.Name
 	srcAddr := req.Deploy.Fwd.SrcAddr
-	portIn := int32(req.Deploy.Fwd.Port.In)
-	portExt := int32(req.Deploy.Fwd.Port.Ext)
-	val, _ := p.resmap.LoadOrStore(name, &DeployResource{})
-	res := val.(*DeployResource)
+	ports := req.Deploy.GetPorts()
+	res := p.loadResource(cluster, namespace, name)
 	defer res.mux.Unlock()
 	res.mux.Lock()
-	if res.fwdsvc != nil {
-		Logger.Info("Use existing forwarding service")
-	} else {
-		clientAddr, remoteAddr, err := p.getForwardAddrs(portExt, srcAddr, portIn)
-		if err != nil {
-			Logger.ErrorE(err)
-		} else {
-			if fsv, err := StartForwarderService("tcp", clientAddr, remoteAddr, true); err != nil {
-				Logger.ErrorE(err)
-			} else {
-				res.fwdsvc = fsv
-			}
-		}
+	if err := checkNotMigrating(res, name); err != nil {
+		return nil, err
+	}
+	if err := p.startForwardingServices(res, srcAddr, ports, false, true, 0); err != nil {
+		return nil, err
 	}
+	p.setDeployed(res, &req.Deploy, "")
+	return &Response{
+		Ok:    true,
+		Ports: ports,
+	}, nil
 }
 
-func (p *APICore) DeployLM(req *Request) {
-	namespace := "default"
+func (p *APICore) DeployLM(req *Request) (*Response, error) {
+	cluster := req.Deploy.Cluster
+	namespace := p.getNamespace(req.Deploy.Namespace)
 	name := req.Deploy.Name
 	image := req.Deploy.LM.Image
-	portIn := int32(req.Deploy.LM.Port.In)
-	portExt := int32(req.Deploy.LM.Port.Ext)
+	ports := req.Deploy.GetPorts()
 	env := req.Deploy.LM.Env
+	podOpts := &req.Deploy.LM.PodOptions
 	srcAddr := req.Deploy.LM.SrcAddr
 	srcName := req.Deploy.LM.SrcName
+	srcNamespace := req.Deploy.LM.SrcNamespace
+	srcCluster := req.Deploy.LM.SrcCluster
+	transfer := req.Deploy.LM.Transfer
+	compression := req.Deploy.LM.Compression
+	compressionLevel := req.Deploy.LM.CompressionLevel
+	dedup := req.Deploy.LM.Dedup
+	adaptivePreDump := req.Deploy.LM.AdaptivePreDump
+	mode := req.Deploy.LM.Mode
+	resumeTimeout := time.Duration(req.Deploy.LM.ResumeTimeoutSec) * time.Second
+	srcPod := req.Deploy.LM.SrcPod
 	interDstAddr := req.Deploy.LM.DstAddr
 	bwLimit := req.Deploy.LM.BwLimit
 	iteration := req.Deploy.LM.Iteration
@@ -142,79 +311,113 @@ func (p *APICore) DeployLM(req *Request) {
 	containerName := ToContainerName(name)
 	serviceName := ToServiceName(name)
 	clusterIPName := ToClusterIPName(name)
-	val, _ := p.resmap.LoadOrStore(name, &DeployResource{})
-	res := val.(*DeployResource)
+	res := p.loadResource(cluster, namespace, name)
 	defer res.mux.Unlock()
 	res.mux.Lock()
-	clientset, config, err := NewClient()
+	if err := checkNotMigrating(res, name); err != nil {
+		return nil, err
+	}
+	clientset, config, err := p.ClientFactory(cluster)
 	if err != nil {
-		Logger.ErrorE(err)
-		return
+		return nil, err
+	}
+	if err := p.applySrcPodOptions(podOpts, srcAddr, srcCluster, srcNamespace, srcName); err != nil {
+		return nil, err
 	}
 	command, args := GetRestorePodCommand()
-	newPod := p.createNewPod(clientset, name, podName, containerName, image, portIn, env,
-		command, args)
-	clusterIP := p.createOrGetClusterIP(clientset, name, serviceName, clusterIPName, portIn)
-	if res.fwdsvc != nil {
-		Logger.Info("Use existing forwarding service")
-	} else if clusterIP != "" {
-		clientAddr, appAddr, err := p.getForwardAddrs(portExt, clusterIP, portIn)
-		if err != nil {
-			Logger.ErrorE(err)
-		} else {
-			if fsv, err := StartForwarderService("tcp", clientAddr, appAddr, false); err != nil {
-				Logger.ErrorE(err)
-			} else {
-				res.fwdsvc = fsv
-			}
-		}
-	} else {
-		Logger.Error("Forwarding service cannot not started because ClusterIP is unknown")
+	newPod, err := p.createNewPod(clientset, namespace, name, podName, containerName, image, ports,
+		env, command, args, podOpts)
+	if err != nil {
+		return nil, err
 	}
-	if newPod {
-		if err := WaitForPodReady(clientset, podName, WaitPodTimeout); err != nil {
-			Logger.ErrorE(err)
-		} else {
-			var thisAddr string
-			if interDstAddr != "" {
-				thisAddr = interDstAddr
-			} else {
-				thisAddr = p.HostAddr
-			}
-			srcAPIServerAddr := fmt.Sprintf("%s:%d", srcAddr, APIServerPort)
-			restore := &LM_Restore{
-				HostConf:         p.HostConf,
-				Clientset:        clientset,
-				RestConfig:       config,
-				ThisAddr:         thisAddr,
-				DstNamespace:     namespace,
-				DstPodName:       podName,
-				DstContainerName: containerName,
-				SrcAddr:          srcAddr,
-				SrcAPIServerAddr: srcAPIServerAddr,
-				SrcName:          srcName,
-				BwLimit:          bwLimit,
-				Iteration:        iteration,
-			}
-			if err := restore.ExecLM(); err != nil {
-				Logger.ErrorE(err)
-			}
-		}
-	} else {
-		Logger.Warn("Live migration was not performed because creating pod failed")
+	if !newPod {
+		return nil, NewAPIError(ErrCodeAlreadyExists, errors.New(
+			"Live migration was not performed because pod already exists: "+podName))
 	}
+	clusterIP, newService, err := p.createOrGetClusterIP(clientset, namespace, name, serviceName,
+		clusterIPName, ports)
+	if err != nil {
+		p.rollbackDeploy(res, clientset, cluster, namespace, name, true, false, false)
+		return nil, err
+	}
+	if err := p.startForwardingServices(res, clusterIP, ports, false, false, 0); err != nil {
+		p.rollbackDeploy(res, clientset, cluster, namespace, name, true, newService, false)
+		return nil, err
+	}
+	p.setDeployed(res, &req.Deploy, namespace)
+	job := p.migrations.New(name, DeployTypeLM)
+	res.setJob(job)
+	rollback := func() {
+		p.rollbackDeploy(res, clientset, cluster, namespace, name, true, newService, false)
+	}
+	go p.runMigration(job, res, rollback, func() error {
+		if err := WaitForPodRunning(clientset, namespace, podName, WaitPodTimeout); err != nil {
+			return podWaitError(err)
+		}
+		restore := &LM_Restore{
+			HostConf:         p.HostConf,
+			Clientset:        clientset,
+			RestConfig:       config,
+			ThisAddr:         p.getThisAddr(interDstAddr),
+			DstNamespace:     namespace,
+			DstPodName:       podName,
+			DstContainerName: containerName,
+			SrcAddr:          srcAddr,
+			SrcAPIServerAddr: fmt.Sprintf("%s:%d", srcAddr, APIServerPort),
+			SrcName:          srcName,
+			SrcNamespace:     srcNamespace,
+			SrcPod:           srcPod,
+			SrcCluster:       srcCluster,
+			Transfer:         transfer,
+			Compression:      compression,
+			CompressionLevel: compressionLevel,
+			Dedup:            dedup,
+			AdaptivePreDump:  adaptivePreDump,
+			Mode:             mode,
+			ResumeTimeout:    resumeTimeout,
+			WaitForReady:     podOpts.ReadinessProbe != nil,
+			BwLimit:          bwLimit,
+			Iteration:        iteration,
+			Ports:            p.migrationPorts,
+			PeerTLS:          p.PeerTLS,
+			Job:              job,
+		}
+		if err := restore.ExecLM(); err != nil {
+			return err
+		}
+		return p.Registry.SetMigrated(cluster, namespace, name)
+	})
+	return &Response{
+		Ok:          true,
+		Msg:         "Live migration started",
+		Pod:         podName,
+		Service:     serviceName,
+		ClusterIP:   clusterIP,
+		Ports:       ports,
+		MigrationID: job.ID(),
+	}, nil
 }
 
-func (p *APICore) DeployFwdLM(req *Request) {
-	namespace := "default"
+func (p *APICore) DeployFwdLM(req *Request) (*Response, error) {
+	cluster := req.Deploy.Cluster
+	namespace := p.getNamespace(req.Deploy.Namespace)
 	name := req.Deploy.Name
 	image := req.Deploy.FwdLM.Image
-	portIn := int32(req.Deploy.FwdLM.Port.In)
-	portExt := int32(req.Deploy.FwdLM.Port.Ext)
+	ports := req.Deploy.GetPorts()
 	env := req.Deploy.FwdLM.Env
+	podOpts := &req.Deploy.FwdLM.PodOptions
 	srcAddr := req.Deploy.FwdLM.SrcAddr
-	srcPort := int32(req.Deploy.FwdLM.SrcPort)
 	srcName := req.Deploy.FwdLM.SrcName
+	srcNamespace := req.Deploy.FwdLM.SrcNamespace
+	srcCluster := req.Deploy.FwdLM.SrcCluster
+	transfer := req.Deploy.FwdLM.Transfer
+	compression := req.Deploy.FwdLM.Compression
+	compressionLevel := req.Deploy.FwdLM.CompressionLevel
+	dedup := req.Deploy.FwdLM.Dedup
+	adaptivePreDump := req.Deploy.FwdLM.AdaptivePreDump
+	mode := req.Deploy.FwdLM.Mode
+	resumeTimeout := time.Duration(req.Deploy.FwdLM.ResumeTimeoutSec) * time.Second
+	srcPod := req.Deploy.FwdLM.SrcPod
 	interDstAddr := req.Deploy.FwdLM.DstAddr
 	bwLimit := req.Deploy.FwdLM.BwLimit
 	iteration := req.Deploy.FwdLM.Iteration
@@ -223,242 +426,997 @@ func (p *APICore) DeployFwdLM(req *Request) {
 	containerName := ToContainerName(name)
 	serviceName := ToServiceName(name)
 	clusterIPName := ToClusterIPName(name)
-	val, _ := p.resmap.LoadOrStore(name, &DeployResource{})
-	res := val.(*DeployResource)
+	res := p.loadResource(cluster, namespace, name)
 	defer res.mux.Unlock()
 	res.mux.Lock()
-	if res.fwdsvc != nil {
-		Logger.Info("Use existing forwarding service")
-	} else {
-		clientAddr, remoteAddr, err := p.getForwardAddrs(portExt, srcAddr, srcPort)
-		if err != nil {
-			Logger.ErrorE(err)
-		} else {
-			if fsv, err := StartForwarderServiceDR("tcp", clientAddr, remoteAddr, true, dataRate); err != nil {
-				Logger.ErrorE(err)
-			} else {
-				res.fwdsvc = fsv
-			}
-		}
+	if err := checkNotMigrating(res, name); err != nil {
+		return nil, err
+	}
+	if err := p.applySrcPodOptions(podOpts, srcAddr, srcCluster, srcNamespace, srcName); err != nil {
+		return nil, err
+	}
+	if err := p.startForwardingServices(res, srcAddr, ports, true, true, dataRate); err != nil {
+		return nil, err
 	}
-	go func() {
-		clientset, config, err := NewClient()
+	p.setDeployed(res, &req.Deploy, namespace)
+	_, _, fwdsvcs := res.info()
+	job := p.migrations.New(name, DeployTypeFwdLM)
+	res.setJob(job)
+	// The pod and the service are created by the migration, and torn down only if created by it
+	var clientset kubernetes.Interface
+	newPod, newService := false, false
+	rollback := func() {
+		p.rollbackDeploy(res, clientset, cluster, namespace, name, newPod, newService, true)
+	}
+	go p.runMigration(job, res, rollback, func() error {
+		var config *rest.Config
+		var err error
+		clientset, config, err = p.ClientFactory(cluster)
 		if err != nil {
-			Logger.ErrorE(err)
-			return
+			return err
 		}
 		command, args := GetRestorePodCommand()
-		newPod := p.createNewPod(clientset, name, podName, containerName, image, portIn, env,
-			command, args)
-		clusterIP := p.createOrGetClusterIP(clientset, name, serviceName, clusterIPName, portIn)
+		newPod, err = p.createNewPod(clientset, namespace, name, podName, containerName, image, ports,
+			env, command, args, podOpts)
+		if err != nil {
+			return err
+		}
 		if !newPod {
-			Logger.Warn("Live migration was not performed because creating pod failed")
-			return
+			return NewAPIError(ErrCodeAlreadyExists, errors.New(
+				"Live migration was not performed because pod already exists: "+podName))
 		}
-		if err := WaitForPodReady(clientset, podName, WaitPodTimeout); err != nil {
-			Logger.ErrorE(err)
-			return
+		var clusterIP string
+		clusterIP, newService, err = p.createOrGetClusterIP(clientset, namespace, name, serviceName,
+			clusterIPName, ports)
+		if err != nil {
+			return err
 		}
-		var thisAddr string
-		if interDstAddr != "" {
-			thisAddr = interDstAddr
-		} else {
-			thisAddr = p.HostAddr
+		if err := WaitForPodRunning(clientset, namespace, podName, WaitPodTimeout); err != nil {
+			return podWaitError(err)
 		}
-		srcAPIServerAddr := fmt.Sprintf("%s:%d", srcAddr, APIServerPort)
-		dstPodAddr := fmt.Sprintf("%s:%d", clusterIP, portIn)
-		dstPodTCPAddr, err := net.ResolveTCPAddr("tcp", dstPodAddr)
-		if err != nil {
-			Logger.ErrorE(errors.WithStack(err))
-			return
+		var fwdTargets []*LM_FwdTarget
+		for i, fwdsvc := range fwdsvcs {
+			fwdTargets = append(fwdTargets, &LM_FwdTarget{
+				Fwdsvc:  fwdsvc,
+				DstAddr: net.JoinHostPort(clusterIP, strconv.Itoa(ports[i].In)),
+			})
 		}
 		restore := &LM_Restore{
 			HostConf:         p.HostConf,
 			Clientset:        clientset,
 			RestConfig:       config,
-			ThisAddr:         thisAddr,
+			ThisAddr:         p.getThisAddr(interDstAddr),
 			DstNamespace:     namespace,
 			DstPodName:       podName,
 			DstContainerName: containerName,
 			SrcAddr:          srcAddr,
-			SrcAPIServerAddr: srcAPIServerAddr,
+			SrcAPIServerAddr: fmt.Sprintf("%s:%d", srcAddr, APIServerPort),
 			SrcName:          srcName,
-			Fwdsvc:           res.fwdsvc,
-			DstPodAddr:       dstPodTCPAddr,
+			SrcNamespace:     srcNamespace,
+			SrcPod:           srcPod,
+			SrcCluster:       srcCluster,
+			Transfer:         transfer,
+			Compression:      compression,
+			CompressionLevel: compressionLevel,
+			Dedup:            dedup,
+			AdaptivePreDump:  adaptivePreDump,
+			Mode:             mode,
+			ResumeTimeout:    resumeTimeout,
+			WaitForReady:     podOpts.ReadinessProbe != nil,
+			FwdTargets:       fwdTargets,
 			BwLimit:          bwLimit,
 			Iteration:        iteration,
+			Ports:            p.migrationPorts,
+			PeerTLS:          p.PeerTLS,
+			Job:              job,
 		}
 		if err := restore.ExecFwdLM(); err != nil {
+			return err
+		}
+		return p.Registry.SetMigrated(cluster, namespace, name)
+	})
+	return &Response{
+		Ok:          true,
+		Msg:         "Live migration started",
+		Pod:         podName,
+		Service:     serviceName,
+		Ports:       ports,
+		MigrationID: job.ID(),
+	}, nil
+}
+
+func (p *APICore) MigrationStatus(req *Request) (*Response, error) {
+	id := req.MigrationStatus.ID
+	job, ok := p.migrations.Get(id)
+	if !ok {
+		return nil, NewAPIError(ErrCodeNotFound, errors.New("No such migration: "+id))
+	}
+	return &Response{
+		Ok:          true,
+		MigrationID: id,
+		Migration:   job.Status(),
+	}, nil
+}
+
+func (p *APICore) MigrationCancel(req *Request) (*Response, error) {
+	id := req.MigrationCancel.ID
+	job, ok := p.migrations.Get(id)
+	if !ok {
+		return nil, NewAPIError(ErrCodeNotFound, errors.New("No such migration: "+id))
+	}
+	if !job.Cancel() {
+		return nil, NewAPIError(ErrCodeInvalidState, errors.New("Migration already finished: "+id))
+	}
+	Logger.Info("Cancel migration: " + id)
+	return &Response{
+		Ok:          true,
+		Msg:         "Migration cancel requested",
+		MigrationID: id,
+		Migration:   job.Status(),
+	}, nil
+}
+
+// runMigration runs f after a slot of migrationSlots is available. If f fails or the migration is
+// cancelled while queued, rollback is called with res.mux held before the job finishes.
+func (p *APICore) runMigration(job *MigrationJob, res *DeployResource, rollback func(), f func() error) {
+	fail := func(err error) {
+		job.SetState(MigrationStateRollingBack)
+		res.mux.Lock()
+		rollback()
+		res.mux.Unlock()
+		job.Fail(err)
+	}
+	if !p.migrationSlots.TryAcquire() {
+		Logger.Info("Wait for other migrations: " + job.ID())
+		job.SetState(MigrationStateQueued)
+		if !p.migrationSlots.Acquire(job.Cancelled()) {
+			fail(errors.New("Migration cancelled"))
+			return
+		}
+		job.SetState(MigrationStatePreparing)
+	}
+	defer p.migrationSlots.Release()
+	if err := f(); err != nil {
+		Logger.ErrorE(err)
+		fail(err)
+		return
+	}
+	job.SetState(MigrationStateResumed)
+}
+
+// rollbackDeploy tears down what DeployLM or DeployFwdLM has created for the migration which failed:
+// the restored pod and the service if created by the deploy. The forwarding services of lm, the
+// deploy info and the registry entry are removed too, but the forwarding services of fwdlm are
+// resumed to keep forwarding to the source if keepFwd. It must be called with res.mux held.
+func (p *APICore) rollbackDeploy(
+	res *DeployResource,
+	clientset kubernetes.Interface,
+	cluster string,
+	namespace string,
+	name string,
+	deletePod bool,
+	deleteService bool,
+	keepFwd bool,
+) {
+	Logger.Info("Roll back deployment: " + name)
+	if keepFwd {
+		_, _, fwdsvcs := res.info()
+		for _, fwdsvc := range fwdsvcs {
+			fwdsvc.Resume()
+		}
+	} else {
+		for _, fwdsvc := range res.takeFwdsvcs() {
+			if err := fwdsvc.Close(); err != nil {
+				Logger.Warn(err.Error())
+			}
+		}
+		res.setDeployInfo("", "")
+		if err := p.Registry.Delete(cluster, namespace, name); err != nil {
 			Logger.ErrorE(err)
 		}
-	}()
+	}
+	res.setPodError("")
+	res.setSuspendedByWatcher(false)
+	if deleteService {
+		serviceName := ToServiceName(name)
+		Logger.Info("Delete service: " + serviceName)
+		if err, errStack := DeleteService(clientset, namespace, serviceName); err != nil &&
+			!k8serrors.IsNotFound(err) {
+			Logger.ErrorE(errStack)
+		}
+	}
+	if deletePod {
+		podName := ToPodName(name)
+		Logger.Info("Delete restored pod: " + podName)
+		if err, errStack := DeletePod(clientset, namespace, podName); err != nil && !k8serrors.IsNotFound(err) {
+			Logger.ErrorE(errStack)
+		}
+	}
 }
 
-func (p *APICore) DumpStart(req *Request) *Response {
-	namespace := "default"
+func (p *APICore) DumpStart(req *Request) (*Response, error) {
+	cluster, err := p.getCluster(req.DumpStart.Cluster)
+	if err != nil {
+		return nil, err
+	}
+	namespace := p.getNamespace(req.DumpStart.Namespace)
 	name := req.DumpStart.Name
 	srcHostAddr := p.HostAddr
 	dstHostAddr := req.DumpStart.DstAddr
 	bwLimit := req.DumpStart.BwLimit
 	podName := ToPodName(name)
+	if req.DumpStart.Pod != "" {
+		podName = req.DumpStart.Pod
+	}
 	containerName := ToContainerName(name)
-	val, _ := p.resmap.LoadOrStore(name, &DeployResource{})
-	res := val.(*DeployResource)
+	checkpoint := CheckpointCRIU
+	if entry := p.Registry.Get(cluster, namespace, name); entry != nil {
+		checkpoint = entry.Deploy.GetCheckpoint()
+	}
+	if req.DumpStart.Mode == MigrationModePostCopy && checkpoint == CheckpointKubelet {
+		return nil, NewAPIError(ErrCodeBadRequest,
+			errors.New("The kubelet checkpoint does not support the "+MigrationModePostCopy+" mode"))
+	}
+	res := p.loadResource(cluster, namespace, name)
 	defer res.mux.Unlock()
 	res.mux.Lock()
-	clientset, config, err := NewClient()
+	clientset, config, err := p.ClientFactory(cluster)
 	if err != nil {
-		Logger.ErrorE(err)
-		return &Response{Ok: false, Msg: err.Error()}
+		return nil, err
+	}
+	if err := checkPodToDump(clientset, namespace, podName, containerName, checkpoint); err != nil {
+		return nil, err
+	}
+	if !p.dumpSlots.TryAcquire() {
+		return nil, NewAPIError(ErrCodeTooManyMigrations,
+			errors.New(fmt.Sprintf("%d migrations are running", p.HostConf.GetMaxMigrations())))
+	}
+	ports := []int{}
+	releasePorts := func() {
+		p.migrationPorts.Release(ports...)
+		p.dumpSlots.Release()
+	}
+	allocatePort := func() (int, error) {
+		port, err := p.migrationPorts.Allocate()
+		if err != nil {
+			return 0, NewAPIError(ErrCodeTooManyMigrations, err)
+		}
+		ports = append(ports, port)
+		return port, nil
+	}
+	msgPort, err := allocatePort()
+	if err != nil {
+		releasePorts()
+		return nil, err
+	}
+	tunnelPort := 0
+	transfer := req.DumpStart.Transfer
+	if dstHostAddr != srcHostAddr && (transfer == "" || transfer == TransferRsync) {
+		if tunnelPort, err = allocatePort(); err != nil {
+			releasePorts()
+			return nil, err
+		}
+	}
+	pageServerPort := 0
+	if req.DumpStart.Mode == MigrationModePostCopy {
+		if pageServerPort, err = allocatePort(); err != nil {
+			releasePorts()
+			return nil, err
+		}
+	}
+	dstDataPort := req.DumpStart.DstDataPort
+	if dstDataPort == 0 {
+		dstDataPort = LM_HostDataPort
 	}
 	dump := &LM_DumpService{
-		Clientset:     clientset,
-		RestConfig:    config,
-		ThisAddr:      srcHostAddr,
-		Namespace:     namespace,
-		PodName:       podName,
-		ContainerName: containerName,
-		DstAddr:       dstHostAddr,
-		BwLimit:       bwLimit,
+		Clientset:        clientset,
+		RestConfig:       config,
+		ThisAddr:         srcHostAddr,
+		Namespace:        namespace,
+		PodName:          podName,
+		ContainerName:    containerName,
+		DstAddr:          dstHostAddr,
+		IsLocal:          dstHostAddr == srcHostAddr,
+		BwLimit:          bwLimit,
+		Checkpoint:       checkpoint,
+		Transfer:         req.DumpStart.Transfer,
+		TransferToken:    req.DumpStart.TransferToken,
+		Compression:      req.DumpStart.Compression,
+		CompressionLevel: req.DumpStart.CompressionLevel,
+		Dedup:            req.DumpStart.Dedup,
+		MsgPort:          msgPort,
+		DstDataPort:      dstDataPort,
+		TunnelPort:       tunnelPort,
+		PageServerPort:   pageServerPort,
+		PeerTLS:          p.PeerTLS,
+		OnFinish:         releasePorts,
 	}
 	if err := dump.Start(); err != nil {
-		Logger.ErrorE(err)
-		return &Response{Ok: false, Msg: err.Error()}
+		return nil, NewAPIError(ErrCodeMigrationError, err)
 	}
-	return &Response{Ok: true, Msg: ""}
+	return &Response{
+		Ok:             true,
+		Msg:            "",
+		Checkpoint:     checkpoint,
+		MsgPort:        msgPort,
+		PageServerPort: pageServerPort,
+	}, nil
 }
 
-func (p *APICore) Remove(req *Request) {
+func (p *APICore) Remove(req *Request) (*Response, error) {
+	cluster, err := p.getCluster(req.Remove.Cluster)
+	if err != nil {
+		return nil, err
+	}
 	name := req.Remove.Name
-	podName := name + "-pod"
-	serviceName := name + "-svc"
-	val, _ := p.resmap.LoadOrStore(name, &DeployResource{})
-	res := val.(*DeployResource)
+	namespace, err := p.findNamespace(cluster, name, req.Remove.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	podName := ToPodName(name)
+	serviceName := ToServiceName(name)
+	res := p.loadResource(cluster, namespace, name)
 	defer res.mux.Unlock()
 	res.mux.Lock()
-	clientset, _, err := NewClient()
+	if err := checkNotMigrating(res, name); err != nil {
+		return nil, err
+	}
+	clientset, _, err := p.ClientFactory(cluster)
 	if err != nil {
-		Logger.ErrorE(err)
-		return
+		return nil, err
 	}
-	if res.fwdsvc != nil {
-		if err := res.fwdsvc.Close(); err != nil {
+	for _, fwdsvc := range res.takeFwdsvcs() {
+		if err := fwdsvc.Close(); err != nil {
 			Logger.Warn(err.Error())
 		}
-		res.fwdsvc = nil
 	}
-	if err, errStack := DeleteService(clientset, serviceName); err != nil {
+	res.setDeployInfo("", "")
+	res.setPodError("")
+	res.setSuspendedByWatcher(false)
+	if err := p.Registry.Delete(cluster, namespace, name); err != nil {
+		Logger.ErrorE(err)
+	}
+	resp := &Response{Ok: true}
+	if err, errStack := DeleteService(clientset, namespace, serviceName); err != nil {
 		if k8serrors.IsNotFound(err) {
 			Logger.Info("No services to delete")
 		} else {
-			Logger.ErrorE(errStack)
+			return nil, NewAPIError(ErrCodeKubeError, errStack)
 		}
 	} else {
 		Logger.Info("Deleting service: " + serviceName)
+		resp.Service = serviceName
 	}
 	delPod := false
-	if err, errStack := DeletePod(clientset, podName); err != nil {
+	if err, errStack := DeletePod(clientset, namespace, podName); err != nil {
 		if k8serrors.IsNotFound(err) {
 			Logger.Info("No pods to delete")
 		} else {
-			Logger.ErrorE(errStack)
+			return nil, NewAPIError(ErrCodeKubeError, errStack)
 		}
 	} else {
 		Logger.Info("Deleting pod: " + podName)
+		resp.Pod = podName
 		delPod = true
 	}
+	deploymentName := ToControllerName(name, ControllerDeployment)
+	if err, errStack := DeleteDeployment(clientset, namespace, deploymentName); err != nil {
+		if !k8serrors.IsNotFound(err) {
+			return nil, NewAPIError(ErrCodeKubeError, errStack)
+		}
+	} else {
+		Logger.Info("Deleting deployment: " + deploymentName)
+		resp.Controller = deploymentName
+		delPod = true
+	}
+	statefulSetName := ToControllerName(name, ControllerStatefulSet)
+	if err, errStack := DeleteStatefulSet(clientset, namespace, statefulSetName); err != nil {
+		if !k8serrors.IsNotFound(err) {
+			return nil, NewAPIError(ErrCodeKubeError, errStack)
+		}
+	} else {
+		Logger.Info("Deleting statefulset: " + statefulSetName)
+		resp.Controller = statefulSetName
+		delPod = true
+	}
+	headlessName := ToHeadlessServiceName(name)
+	if err, errStack := DeleteService(clientset, namespace, headlessName); err != nil {
+		if !k8serrors.IsNotFound(err) {
+			return nil, NewAPIError(ErrCodeKubeError, errStack)
+		}
+	} else {
+		Logger.Info("Deleting headless service: " + headlessName)
+	}
 	if delPod {
-		if err := WaitForPodDeleted(clientset, podName, WaitPodTimeout); err != nil {
+		// The pods of the controllers are deleted by the garbage collector
+		if err := WaitForPodsDeleted(clientset, namespace, name, WaitPodTimeout); err != nil {
+			return nil, NewAPIError(ErrCodeKubeError, errors.WithStack(err))
+		}
+	}
+	return resp, nil
+}
+
+// Reconcile restores the forwarding services of the deployments recorded in the registry.
+// Pod-backed deployments whose pod or service no longer exists, and live migrations which did not
+// complete, are dropped from the registry.
+func (p *APICore) Reconcile() error {
+	for _, entry := range p.Registry.Entries() {
+		if err := p.reattach(entry); err != nil {
 			Logger.ErrorE(err)
 		}
 	}
+	return nil
+}
+
+func (p *APICore) reattach(entry *RegistryEntry) error {
+	deploy := &entry.Deploy
+	name := deploy.Name
+	if entry.Migrating {
+		Logger.Warn("Drop registry entry of migration not completed: " + name)
+		return p.Registry.Delete(deploy.Cluster, deploy.Namespace, name)
+	}
+	ports := deploy.GetPorts()
+	if ports == nil {
+		Logger.Warn("Drop registry entry with unsupported deploy type: " + deploy.Type)
+		return p.Registry.Delete(deploy.Cluster, deploy.Namespace, name)
+	}
+	cluster, err := p.getCluster(deploy.Cluster)
+	if err != nil {
+		Logger.Warn("Drop registry entry of unknown cluster: " + deploy.Cluster)
+		return p.Registry.Delete(deploy.Cluster, deploy.Namespace, name)
+	}
+	namespace := p.getNamespace(deploy.Namespace)
+	if cluster != deploy.Cluster || namespace != deploy.Namespace {
+		// Entries recorded without cluster or namespace belong to the default ones
+		if err := p.Registry.Delete(deploy.Cluster, deploy.Namespace, name); err != nil {
+			return err
+		}
+		deploy.Cluster = cluster
+		deploy.Namespace = namespace
+		if err := p.Registry.Put(deploy); err != nil {
+			return err
+		}
+	}
+	res := p.loadResource(cluster, namespace, name)
+	defer res.mux.Unlock()
+	res.mux.Lock()
+	if deploy.Type == DeployTypeFwd {
+		Logger.Info("Reattach forwarding: " + name)
+		if err := p.startForwardingServices(res, deploy.Fwd.SrcAddr, ports, false, true, 0); err != nil {
+			return err
+		}
+		res.setDeployInfo(deploy.Type, "")
+		return nil
+	}
+	clientset, _, err := p.ClientFactory(cluster)
+	if err != nil {
+		return err
+	}
+	podName := ToPodName(name)
+	serviceName := ToServiceName(name)
+	controller := deploy.GetController()
+	var errStack error
+	switch controller {
+	case ControllerDeployment:
+		_, err, errStack = GetDeployment(clientset, namespace, ToControllerName(name, controller))
+	case ControllerStatefulSet:
+		_, err, errStack = GetStatefulSet(clientset, namespace, ToControllerName(name, controller))
+	default:
+		_, err, errStack = GetPod(clientset, namespace, podName)
+	}
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			Logger.Warn("Drop registry entry because " + controller + " no longer exists: " + name)
+			return p.Registry.Delete(cluster, namespace, name)
+		}
+		return errStack
+	}
+	svc, err, errStack := GetService(clientset, namespace, serviceName)
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			Logger.Warn("Drop registry entry because service no longer exists: " + serviceName)
+			return p.Registry.Delete(cluster, namespace, name)
+		}
+		return errStack
+	}
+	Logger.Info("Reattach pod: " + podName)
+	if err := p.startForwardingServices(res, svc.Spec.ClusterIP, ports, false, false, 0); err != nil {
+		return err
+	}
+	res.setDeployInfo(deploy.Type, namespace)
+	return nil
+}
+
+func (p *APICore) List(req *Request) (*Response, error) {
+	var keys []resKey
+	p.resmap.Range(func(key, val interface{}) bool {
+		if deployType, _, _ := val.(*DeployResource).info(); deployType != "" {
+			keys = append(keys, key.(resKey))
+		}
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].cluster != keys[j].cluster {
+			return keys[i].cluster < keys[j].cluster
+		}
+		if keys[i].namespace != keys[j].namespace {
+			return keys[i].namespace < keys[j].namespace
+		}
+		return keys[i].name < keys[j].name
+	})
+	resp := &Response{Ok: true}
+	for _, key := range keys {
+		val, ok := p.resmap.Load(key)
+		if !ok {
+			continue
+		}
+		clientset, _, err := p.ClientFactory(key.cluster)
+		if err != nil {
+			return nil, err
+		}
+		status, err := p.getDeploymentStatus(clientset, key.cluster, key.name, val.(*DeployResource))
+		if err != nil {
+			return nil, err
+		}
+		if status != nil {
+			resp.Deployments = append(resp.Deployments, status)
+		}
+	}
+	return resp, nil
+}
+
+func (p *APICore) Status(req *Request) (*Response, error) {
+	name := req.Status.Name
+	cluster, err := p.getCluster(req.Status.Cluster)
+	if err != nil {
+		return nil, err
+	}
+	namespace, err := p.findNamespace(cluster, name, req.Status.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	notFound := NewAPIError(ErrCodeNotFound, errors.New("No such deployment: "+name))
+	val, ok := p.resmap.Load(resKey{cluster: cluster, namespace: namespace, name: name})
+	if !ok {
+		return nil, notFound
+	}
+	clientset, _, err := p.ClientFactory(cluster)
+	if err != nil {
+		return nil, err
+	}
+	status, err := p.getDeploymentStatus(clientset, cluster, name, val.(*DeployResource))
+	if err != nil {
+		return nil, err
+	}
+	if status == nil {
+		return nil, notFound
+	}
+	return &Response{
+		Ok:          true,
+		Deployments: []*DeploymentStatus{status},
+	}, nil
+}
+
+func (p *APICore) getDeploymentStatus(
+	clientset kubernetes.Interface,
+	cluster string,
+	name string,
+	res *DeployResource,
+) (*DeploymentStatus, error) {
+	deployType, namespace, fwdsvcs := res.info()
+	if deployType == "" {
+		return nil, nil
+	}
+	status := &DeploymentStatus{
+		Cluster:   cluster,
+		Name:      name,
+		Namespace: namespace,
+		Type:      deployType,
+	}
+	if entry := p.Registry.Get(cluster, namespace, name); entry != nil {
+		if opts := entry.Deploy.GetPodOptions(); opts != nil && !opts.IsZero() {
+			status.PodOptions = opts
+		}
+	}
+	if deployType != DeployTypeFwd {
+		pod, err, errStack := GetPod(clientset, namespace, ToPodName(name))
+		if err != nil {
+			if !k8serrors.IsNotFound(err) {
+				return nil, NewAPIError(ErrCodeKubeError, errStack)
+			}
+			// The app may be run by a controller
+			pods, err := ListPods(clientset, namespace, name)
+			if err != nil {
+				return nil, NewAPIError(ErrCodeKubeError, err)
+			}
+			for i := range pods {
+				status.Replicas++
+				if ready, _ := podReadyCond(&pods[i]); ready {
+					status.ReadyReplicas++
+				}
+			}
+			status.PodReady = status.ReadyReplicas > 0
+		} else {
+			status.PodPhase = string(pod.Status.Phase)
+			status.PodReady = isPodRunning(pod) && isPodConditionReady(pod)
+			if err := checkPodFailed(pod); err != nil {
+				status.PodError = err.Error()
+			}
+		}
+		if status.PodError == "" {
+			status.PodError = res.getPodError()
+		}
+		svc, err, errStack := GetService(clientset, namespace, ToServiceName(name))
+		if err != nil {
+			if !k8serrors.IsNotFound(err) {
+				return nil, NewAPIError(ErrCodeKubeError, errStack)
+			}
+		} else {
+			status.ClusterIP = svc.Spec.ClusterIP
+		}
+	}
+	for _, fwdsvc := range fwdsvcs {
+		status.Forwarding = append(status.Forwarding, &ForwardingStatus{
+			Protocol:         strings.ToUpper(fwdsvc.Network()),
+			ListenAddr:       fwdsvc.ClientAddr().String(),
+			TargetAddr:       fwdsvc.ServerAddr().String(),
+			Suspended:        fwdsvc.IsSuspended(),
+			ActiveForwarders: fwdsvc.NumForwarders(),
+			DataRate:         fwdsvc.DataRate(),
+		})
+	}
+	return status, nil
+}
+
+// applySrcPodOptions sets opts to the pod options of the source deployment of a live migration
+// unless the request gives them. The source deployment is looked up in the registry of this host if
+// srcCluster is given, otherwise by a status request to the source host. opts is left empty if the
+// source is not a deployment of the source host, e.g. a pod given by srcPod.
+func (p *APICore) applySrcPodOptions(
+	opts *PodOptions,
+	srcAddr string,
+	srcCluster string,
+	srcNamespace string,
+	srcName string,
+) error {
+	if !opts.IsZero() {
+		return nil
+	}
+	var srcOpts *PodOptions
+	if srcCluster != "" {
+		if entry := p.Registry.Get(srcCluster, p.getNamespace(srcNamespace), srcName); entry != nil {
+			srcOpts = entry.Deploy.GetPodOptions()
+		}
+	} else {
+		req := &Request{
+			Method: "status",
+			Status: RequestStatus{
+				Name:      srcName,
+				Namespace: srcNamespace,
+			},
+		}
+		resp, err := SendAPIRequest(p.PeerTLS, fmt.Sprintf("%s:%d", srcAddr, APIServerPort), req,
+			PeerTLSHandshakeTimeout)
+		if err != nil {
+			return NewAPIError(ErrCodeMigrationError, err)
+		}
+		if !resp.Ok && resp.Code != ErrCodeNotFound {
+			return NewAPIError(ErrCodeMigrationError, errors.New("Status response error: "+resp.Msg))
+		}
+		if len(resp.Deployments) > 0 {
+			srcOpts = resp.Deployments[0].PodOptions
+		}
+	}
+	if srcOpts == nil {
+		Logger.Info("No pod options of source deployment: " + srcName)
+		return nil
+	}
+	*opts = *srcOpts
+	return nil
 }
 
 func (p *APICore) createNewPod(
 	clientset kubernetes.Interface,
+	namespace string,
 	label string,
 	podName string,
 	containerName string,
 	image string,
-	containerPort int32,
+	ports []PortSpec,
 	env map[string]string,
 	command []string,
 	args []string,
-) bool {
-	newPod := false
-	pod, err, errStack := CreatePod(clientset, podName, label, containerName, image,
-		containerPort, env, command, args)
+	opts *PodOptions,
+) (bool, error) {
+	pod, err, errStack := CreatePod(clientset, namespace, podName, label, containerName, image,
+		ports, env, command, args, opts)
 	if err != nil {
 		if k8serrors.IsAlreadyExists(err) {
 			Logger.Info("Use existing pod: " + podName)
+			return false, nil
+		}
+		return false, NewAPIError(ErrCodeKubeError, errStack)
+	}
+	Logger.Info("Creating pod: " + pod.GetName())
+	return true, nil
+}
+
+// createController creates a Deployment or StatefulSet of the app. It returns false if it already exists.
+func (p *APICore) createController(
+	clientset kubernetes.Interface,
+	namespace string,
+	label string,
+	controller string,
+	controllerName string,
+	replicas int32,
+	containerName string,
+	image string,
+	ports []PortSpec,
+	env map[string]string,
+	opts *PodOptions,
+) (bool, error) {
+	template := NewPodTemplate(label, containerName, image, ports, env, nil, nil, opts)
+	var err, errStack error
+	if controller == ControllerStatefulSet {
+		headlessName := ToHeadlessServiceName(label)
+		if _, err, errStack := CreateHeadlessService(clientset, namespace, headlessName, label, ports); err != nil {
+			if !k8serrors.IsAlreadyExists(err) {
+				return false, NewAPIError(ErrCodeKubeError, errStack)
+			}
 		} else {
-			Logger.ErrorE(errStack)
+			Logger.Info("Creating headless service: " + headlessName)
 		}
+		_, err, errStack = CreateStatefulSet(clientset, namespace, controllerName, headlessName, label,
+			replicas, template)
 	} else {
-		newPod = true
-		Logger.Info("Creating pod: " + pod.GetName())
+		_, err, errStack = CreateDeployment(clientset, namespace, controllerName, label, replicas, template)
 	}
-	return newPod
+	if err != nil {
+		if k8serrors.IsAlreadyExists(err) {
+			Logger.Info("Use existing " + controller + ": " + controllerName)
+			return false, nil
+		}
+		return false, NewAPIError(ErrCodeKubeError, errStack)
+	}
+	Logger.Info("Creating " + controller + ": " + controllerName)
+	return true, nil
 }
 
 func (p *APICore) createOrGetClusterIP(
 	clientset kubernetes.Interface,
+	namespace string,
 	label string,
 	serviceName string,
 	clusterIPName string,
-	containerPort int32,
-) string {
+	ports []PortSpec,
+) (string, bool, error) {
 	clusterIP := ""
-	svc, err, errStack := GetService(clientset, serviceName)
+	created := false
+	svc, err, errStack := GetService(clientset, namespace, serviceName)
 	if err != nil {
-		if k8serrors.IsNotFound(err) {
-			svc, _, errStack := CreateService(clientset, serviceName, label, clusterIPName,
-				containerPort)
-			if errStack != nil {
-				Logger.ErrorE(errStack)
-			} else {
-				Logger.Info("Creating service: " + svc.GetName())
-				clusterIP = svc.Spec.ClusterIP
-			}
-		} else {
-			Logger.ErrorE(errStack)
+		if !k8serrors.IsNotFound(err) {
+			return "", false, NewAPIError(ErrCodeKubeError, errStack)
 		}
+		svc, _, errStack := CreateService(clientset, namespace, serviceName, label, clusterIPName,
+			ports)
+		if errStack != nil {
+			return "", false, NewAPIError(ErrCodeKubeError, errStack)
+		}
+		Logger.Info("Creating service: " + svc.GetName())
+		clusterIP = svc.Spec.ClusterIP
+		created = true
 	} else {
 		Logger.Info("Use existing service: " + svc.GetName())
 		clusterIP = svc.Spec.ClusterIP
 	}
 	Logger.DebugF("ClusterIP: %v\n", clusterIP)
-	return clusterIP
+	return clusterIP, created, nil
+}
+
+// startForwardingServices starts a forwarding service for each port mapping.
+// The remote port is the source port of the mapping if toSrcPort is true, otherwise the internal port.
+// The services already started are closed if any of them fails to start.
+func (p *APICore) startForwardingServices(
+	res *DeployResource,
+	remoteAddr string,
+	ports []PortSpec,
+	toSrcPort bool,
+	isExtHost bool,
+	dataRate int,
+) error {
+	if _, _, fwdsvcs := res.info(); len(fwdsvcs) > 0 {
+		Logger.Info("Use existing forwarding services")
+		return nil
+	}
+	if remoteAddr == "" {
+		return NewAPIError(ErrCodeForwardError,
+			errors.New("Forwarding service cannot be started because remote addr is unknown"))
+	}
+	var fwdsvcs []ForwardingService
+	for _, port := range ports {
+		remotePort := port.In
+		if toSrcPort {
+			remotePort = port.Src
+		}
+		fwdsvc, err := p.startForwardingService(port.Network(), port.Ext, remoteAddr, remotePort,
+			isExtHost, dataRate)
+		if err != nil {
+			for _, started := range fwdsvcs {
+				started.Close()
+			}
+			return err
+		}
+		fwdsvcs = append(fwdsvcs, fwdsvc)
+	}
+	res.setFwdsvcs(fwdsvcs)
+	return nil
 }
 
-func (p *APICore) getForwardAddrs(
-	clientPort int32,
+func (p *APICore) startForwardingService(
+	network string,
+	clientPort int,
 	remoteAddr string,
-	remotePort int32,
-) (*net.TCPAddr, *net.TCPAddr, error) {
+	remotePort int,
+	isExtHost bool,
+	dataRate int,
+) (ForwardingService, error) {
 	caddr := fmt.Sprintf(":%d", clientPort)
-	ctcpaddr, err := net.ResolveTCPAddr("tcp", caddr)
+	raddr := net.JoinHostPort(remoteAddr, strconv.Itoa(remotePort))
+	if network == "udp" {
+		cudpaddr, err := net.ResolveUDPAddr(network, caddr)
+		if err != nil {
+			return nil, NewAPIError(ErrCodeForwardError, errors.WithStack(err))
+		}
+		rudpaddr, err := net.ResolveUDPAddr(network, raddr)
+		if err != nil {
+			return nil, NewAPIError(ErrCodeForwardError, errors.WithStack(err))
+		}
+		fsv, err := StartUDPForwarderService(network, cudpaddr, rudpaddr, isExtHost, dataRate)
+		if err != nil {
+			return nil, NewAPIError(ErrCodeForwardError, errors.WithStack(err))
+		}
+		return fsv, nil
+	}
+	ctcpaddr, err := net.ResolveTCPAddr(network, caddr)
 	if err != nil {
-		return nil, nil, errors.WithStack(err)
+		return nil, NewAPIError(ErrCodeForwardError, errors.WithStack(err))
 	}
-	raddr := fmt.Sprintf("%s:%d", remoteAddr, remotePort)
-	rtcpaddr, err := net.ResolveTCPAddr("tcp", raddr)
+	rtcpaddr, err := net.ResolveTCPAddr(network, raddr)
 	if err != nil {
-		return nil, nil, errors.WithStack(err)
+		return nil, NewAPIError(ErrCodeForwardError, errors.WithStack(err))
 	}
-	return ctcpaddr, rtcpaddr, nil
+	fsv, err := StartForwarderServiceDR(network, ctcpaddr, rtcpaddr, isExtHost, dataRate)
+	if err != nil {
+		return nil, NewAPIError(ErrCodeForwardError, errors.WithStack(err))
+	}
+	return fsv, nil
 }
 
-type PortMap struct {
-	In  int32
-	Ext int32
+// checkNotMigrating rejects a request to the deployment being migrated. It must be called with res.mux
+// held, since the migration is started with res.mux held.
+func checkNotMigrating(res *DeployResource, name string) error {
+	if res.isMigrating() {
+		return NewAPIError(ErrCodeInvalidState, errors.New("Migration in progress: "+name))
+	}
+	return nil
 }
 
-func NewPortMap(in, ext int) *PortMap {
-	return &PortMap{
-		In:  int32(in),
-		Ext: int32(ext),
+// setDeployed records the deployment which has succeeded. It must be called with res.mux held,
+// so that the registry is not updated after a concurrent Remove.
+func (p *APICore) setDeployed(res *DeployResource, deploy *RequestDeploy, namespace string) {
+	res.setDeployInfo(deploy.Type, namespace)
+	put := p.Registry.Put
+	if deploy.Type == DeployTypeLM || deploy.Type == DeployTypeFwdLM {
+		put = p.Registry.PutMigrating
 	}
+	if err := put(deploy); err != nil {
+		Logger.ErrorE(err)
+	}
+}
+
+// checkPodToDump checks that the pod to dump runs the container of the app, since the pod given by
+// _dumpStart.pod may belong to another app. The kubelet checkpoint deletes the pod after the
+// migration, so the pod must not be owned by a controller which would recreate it.
+func checkPodToDump(
+	clientset kubernetes.Interface,
+	namespace string,
+	podName string,
+	containerName string,
+	checkpoint string,
+) error {
+	pod, err, errStack := GetPod(clientset, namespace, podName)
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return NewAPIError(ErrCodeNotFound, errors.New("No such pod: "+podName))
+		}
+		return NewAPIError(ErrCodeKubeError, errStack)
+	}
+	if owner := metav1.GetControllerOf(pod); owner != nil && checkpoint == CheckpointKubelet {
+		return NewAPIError(ErrCodeBadRequest, errors.New(fmt.Sprintf(
+			"The kubelet checkpoint cannot migrate pod %s, which %s %s would recreate after the migration",
+			podName, owner.Kind, owner.Name)))
+	}
+	for _, c := range pod.Spec.Containers {
+		if c.Name == containerName {
+			return nil
+		}
+	}
+	return NewAPIError(ErrCodeBadRequest, errors.New(fmt.Sprintf("Pod %s has no container %s", podName,
+		containerName)))
+}
+
+// podWaitError distinguishes a pod which has failed from one which is not ready yet.
+func podWaitError(err error) error {
+	var podErr *PodFailedError
+	if errors.As(err, &podErr) {
+		if podErr.ImagePull {
+			return NewAPIError(ErrCodeImagePull, err)
+		}
+		return NewAPIError(ErrCodePodFailed, err)
+	}
+	return NewAPIError(ErrCodePodNotReady, errors.WithStack(err))
+}
+
+func (p *APICore) loadResource(cluster string, namespace string, name string) *DeployResource {
+	val, _ := p.resmap.LoadOrStore(resKey{cluster: cluster, namespace: namespace, name: name}, &DeployResource{})
+	return val.(*DeployResource)
+}
+
+// findNamespace returns namespace if given. Otherwise it returns the namespace where name is
+// deployed on cluster, or the default namespace if not deployed. It returns an APIError with
+// ErrCodeBadRequest if name is deployed in several namespaces.
+func (p *APICore) findNamespace(cluster string, name string, namespace string) (string, error) {
+	if namespace != "" {
+		return namespace, nil
+	}
+	var namespaces []string
+	p.resmap.Range(func(key, val interface{}) bool {
+		k := key.(resKey)
+		if k.cluster != cluster || k.name != name {
+			return true
+		}
+		if deployType, _, _ := val.(*DeployResource).info(); deployType != "" {
+			namespaces = append(namespaces, k.namespace)
+		}
+		return true
+	})
+	switch len(namespaces) {
+	case 0:
+		return p.getNamespace(""), nil
+	case 1:
+		return namespaces[0], nil
+	}
+	sort.Strings(namespaces)
+	return "", NewAPIError(ErrCodeBadRequest, errors.New(fmt.Sprintf(
+		"%s is deployed in several namespaces, namespace is required: %s", name, strings.Join(namespaces, ", "))))
+}
+
+// getCluster returns the name of the cluster, or the default cluster if empty.
+func (p *APICore) getCluster(cluster string) (string, error) {
+	if cluster == "" {
+		cluster = p.HostConf.GetDefaultCluster()
+	}
+	if _, _, err := p.ClientFactory(cluster); err != nil {
+		return "", err
+	}
+	return cluster, nil
+}
+
+func (p *APICore) getNamespace(namespace string) string {
+	if namespace != "" {
+		return namespace
+	}
+	if p.HostConf.DefaultNamespace != "" {
+		return p.HostConf.DefaultNamespace
+	}
+	return DefaultNamespace
+}
+
+func (p *APICore) getThisAddr(interDstAddr string) string {
+	if interDstAddr != "" {
+		return interDstAddr
+	}
+	return p.HostAddr
 }
 
 func ToPodName(name string) string {
@@ -471,11 +1429,22 @@ func ToContainerName(name string) string {
 	return containerName
 }
 
+func ToControllerName(name string, controller string) string {
+	if controller == ControllerStatefulSet {
+		return name + "-sts"
+	}
+	return name + "-deploy"
+}
+
 func ToServiceName(name string) string {
 	serviceName := name + "-svc"
 	return serviceName
 }
 
+func ToHeadlessServiceName(name string) string {
+	return name + "-hl"
+}
+
 func ToClusterIPName(name string) string {
 	clusterIPName := name + "-cip"
 	return clusterIPName
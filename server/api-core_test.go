@@ -0,0 +1,596 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const (
+	testClusterIP = "127.0.0.1"
+)
+
+// newTestAPICore returns APICore backed by the fake clientset of the default cluster.
+func newTestAPICore(t *testing.T, objects ...runtime.Object) (*APICore, *fake.Clientset) {
+	dir, err := ioutil.TempDir("", "cloudlet-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	registry, err := LoadRegistryFrom(filepath.Join(dir, "registry.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientset := newTestClientset(objects...)
+	core := NewAPICore(&HostConf{}, "127.0.0.1", "", registry,
+		NewSharedClientFactory(clientset, &rest.Config{}), nil)
+	TheAPICore = core
+	return core, clientset
+}
+
+// newTestClientset returns the fake clientset whose pods become ready immediately
+// and whose services get testClusterIP unless headless.
+func newTestClientset(objects ...runtime.Object) *fake.Clientset {
+	clientset := fake.NewSimpleClientset(objects...)
+	clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pod := action.(k8stesting.CreateAction).GetObject().(*apiv1.Pod)
+		setPodReady(pod)
+		return false, nil, nil
+	})
+	clientset.PrependReactor("create", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		svc := action.(k8stesting.CreateAction).GetObject().(*apiv1.Service)
+		if svc.Spec.ClusterIP == "" {
+			svc.Spec.ClusterIP = testClusterIP
+		}
+		return false, nil, nil
+	})
+	return clientset
+}
+
+func setPodReady(pod *apiv1.Pod) {
+	pod.Status.Phase = apiv1.PodRunning
+	pod.Status.Conditions = []apiv1.PodCondition{
+		{Type: apiv1.PodReady, Status: apiv1.ConditionTrue},
+	}
+	pod.Status.ContainerStatuses = nil
+	for _, c := range pod.Spec.Containers {
+		pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses, apiv1.ContainerStatus{
+			Name:  c.Name,
+			Ready: true,
+			State: apiv1.ContainerState{Running: &apiv1.ContainerStateRunning{}},
+		})
+	}
+}
+
+func newTestDeployRequest(name string, ports ...PortSpec) *Request {
+	req := &Request{Method: "deploy"}
+	req.Deploy.Name = name
+	req.Deploy.Type = DeployTypeNew
+	req.Deploy.NewApp.Image = "app-sample:latest"
+	req.Deploy.NewApp.Ports = ports
+	return req
+}
+
+func newTestRemoveRequest(name string) *Request {
+	req := &Request{Method: "remove"}
+	req.Remove.Name = name
+	return req
+}
+
+func countActions(clientset *fake.Clientset, verb string, resource string) int {
+	n := 0
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() == verb && action.GetResource().Resource == resource {
+			n++
+		}
+	}
+	return n
+}
+
+func TestDeployNewCreatesPodAndService(t *testing.T) {
+	core, clientset := newTestAPICore(t)
+	req := newTestDeployRequest("app",
+		PortSpec{In: 8888, Ext: 0},
+		PortSpec{In: 5000, Ext: 0, Protocol: ProtocolUDP})
+	resp, err := core.Deploy(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer core.Remove(newTestRemoveRequest("app"))
+	if resp.Pod != "app-pod" || resp.Service != "app-svc" || resp.ClusterIP != testClusterIP {
+		t.Errorf("resp = %+v", resp)
+	}
+	if len(resp.Ports) != 2 || resp.Ports[1].GetProtocol() != ProtocolUDP {
+		t.Errorf("resp ports = %v", resp.Ports)
+	}
+	pod, err := clientset.CoreV1().Pods(DefaultNamespace).Get(context.TODO(), "app-pod", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pod.Labels["app"] != "app" || pod.Labels[ManagedByLabel] != ManagedBy {
+		t.Errorf("pod labels = %v", pod.Labels)
+	}
+	if ports := pod.Spec.Containers[0].Ports; len(ports) != 2 || ports[1].Protocol != apiv1.ProtocolUDP {
+		t.Errorf("container ports = %v", ports)
+	}
+	svc, err := clientset.CoreV1().Services(DefaultNamespace).Get(context.TODO(), "app-svc", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svc.Spec.Selector["app"] != "app" {
+		t.Errorf("service selector = %v", svc.Spec.Selector)
+	}
+	wantPorts := []struct {
+		name     string
+		port     int32
+		protocol apiv1.Protocol
+	}{
+		{"app-cip", 8888, apiv1.ProtocolTCP},
+		{"app-cip-1", 5000, apiv1.ProtocolUDP},
+	}
+	if len(svc.Spec.Ports) != len(wantPorts) {
+		t.Fatalf("service ports = %v", svc.Spec.Ports)
+	}
+	for i, want := range wantPorts {
+		got := svc.Spec.Ports[i]
+		if got.Name != want.name || got.Port != want.port || got.Protocol != want.protocol {
+			t.Errorf("service port[%d] = %v, want %v", i, got, want)
+		}
+	}
+	statusResp, err := core.Status(&Request{Status: RequestStatus{Name: "app"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := statusResp.Deployments[0]
+	if !status.PodReady || len(status.Forwarding) != 2 || status.Forwarding[1].Protocol != ProtocolUDP {
+		t.Errorf("status = %+v", status)
+	}
+	if entries := core.Registry.Entries(); len(entries) != 1 || entries[0].Deploy.Name != "app" {
+		t.Errorf("registry entries = %v", entries)
+	}
+}
+
+func TestDeployNewIsIdempotent(t *testing.T) {
+	core, clientset := newTestAPICore(t)
+	req := newTestDeployRequest("app", PortSpec{In: 8888, Ext: 0})
+	resp1, err := core.Deploy(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer core.Remove(newTestRemoveRequest("app"))
+	resp2, err := core.Deploy(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp2.Pod != resp1.Pod || resp2.ClusterIP != resp1.ClusterIP {
+		t.Errorf("resp2 = %+v, want %+v", resp2, resp1)
+	}
+	pods, err := clientset.CoreV1().Pods(DefaultNamespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pods.Items) != 1 {
+		t.Errorf("len(pods) = %d, want 1", len(pods.Items))
+	}
+	if n := countActions(clientset, "create", "services"); n != 1 {
+		t.Errorf("services created %d times, want 1", n)
+	}
+	statusResp, err := core.Status(&Request{Status: RequestStatus{Name: "app"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(statusResp.Deployments[0].Forwarding); n != 1 {
+		t.Errorf("len(forwarding) = %d, want 1", n)
+	}
+}
+
+func TestDeployNewReusesExistingPod(t *testing.T) {
+	existing := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-pod",
+			Namespace: DefaultNamespace,
+			Labels:    map[string]string{"app": "app"},
+		},
+		Spec: apiv1.PodSpec{
+			Containers: []apiv1.Container{{Name: "app-c", Image: "app-sample:old"}},
+		},
+	}
+	core, clientset := newTestAPICore(t, existing)
+	resp, err := core.Deploy(newTestDeployRequest("app", PortSpec{In: 8888, Ext: 0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer core.Remove(newTestRemoveRequest("app"))
+	if resp.Pod != "app-pod" {
+		t.Errorf("resp.Pod = %s", resp.Pod)
+	}
+	pod, err := clientset.CoreV1().Pods(DefaultNamespace).Get(context.TODO(), "app-pod", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image := pod.Spec.Containers[0].Image; image != "app-sample:old" {
+		t.Errorf("image = %s, want the existing pod to be kept", image)
+	}
+	if _, err := clientset.CoreV1().Services(DefaultNamespace).Get(context.TODO(), "app-svc",
+		metav1.GetOptions{}); err != nil {
+		t.Errorf("service is not created: %v", err)
+	}
+}
+
+func TestRemoveIsIdempotent(t *testing.T) {
+	core, clientset := newTestAPICore(t)
+	if _, err := core.Deploy(newTestDeployRequest("app", PortSpec{In: 8888, Ext: 0})); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := core.Remove(newTestRemoveRequest("app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Pod != "app-pod" || resp.Service != "app-svc" {
+		t.Errorf("resp = %+v", resp)
+	}
+	pods, err := clientset.CoreV1().Pods(DefaultNamespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pods.Items) != 0 {
+		t.Errorf("len(pods) = %d, want 0", len(pods.Items))
+	}
+	resp, err = core.Remove(newTestRemoveRequest("app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Ok || resp.Pod != "" || resp.Service != "" {
+		t.Errorf("resp = %+v", resp)
+	}
+	if _, err := core.Status(&Request{Status: RequestStatus{Name: "app"}}); ErrorCodeOf(err) != ErrCodeNotFound {
+		t.Errorf("status after remove: %v", err)
+	}
+	if entries := core.Registry.Entries(); len(entries) != 0 {
+		t.Errorf("registry entries = %v", entries)
+	}
+}
+
+func TestDeployNewPerCluster(t *testing.T) {
+	core, _ := newTestAPICore(t)
+	clientsetA := newTestClientset()
+	clientsetB := newTestClientset()
+	core.HostConf = &HostConf{
+		Clusters:       []ClusterConf{{Name: "a"}, {Name: "b"}},
+		DefaultCluster: "a",
+	}
+	core.ClientFactory = NewClusterClientFactory([]*KubeClient{
+		{Name: "a", Clientset: clientsetA, Config: &rest.Config{}},
+		{Name: "b", Clientset: clientsetB, Config: &rest.Config{}},
+	})
+	if _, err := core.Deploy(newTestDeployRequest("app", PortSpec{In: 8888, Ext: 0})); err != nil {
+		t.Fatal(err)
+	}
+	req := newTestDeployRequest("app", PortSpec{In: 8888, Ext: 0})
+	req.Deploy.Cluster = "b"
+	if _, err := core.Deploy(req); err != nil {
+		t.Fatal(err)
+	}
+	for name, clientset := range map[string]*fake.Clientset{"a": clientsetA, "b": clientsetB} {
+		if _, err := clientset.CoreV1().Pods(DefaultNamespace).Get(context.TODO(), "app-pod",
+			metav1.GetOptions{}); err != nil {
+			t.Errorf("pod is not created in cluster %s: %v", name, err)
+		}
+	}
+	listResp, err := core.List(&Request{Method: "list"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(listResp.Deployments); n != 2 || listResp.Deployments[0].Cluster != "a" ||
+		listResp.Deployments[1].Cluster != "b" {
+		t.Errorf("deployments = %v", listResp.Deployments)
+	}
+	removeReq := newTestRemoveRequest("app")
+	removeReq.Remove.Cluster = "b"
+	if _, err := core.Remove(removeReq); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := core.Status(&Request{Status: RequestStatus{Name: "app", Cluster: "b"}}); ErrorCodeOf(err) != ErrCodeNotFound {
+		t.Errorf("status after remove: %v", err)
+	}
+	if _, err := core.Status(&Request{Status: RequestStatus{Name: "app"}}); err != nil {
+		t.Errorf("status of default cluster: %v", err)
+	}
+	if entries := core.Registry.Entries(); len(entries) != 1 || entries[0].Deploy.Cluster != "a" {
+		t.Errorf("registry entries = %v", entries)
+	}
+	core.Remove(newTestRemoveRequest("app"))
+	req.Deploy.Cluster = "c"
+	if _, err := core.Deploy(req); ErrorCodeOf(err) != ErrCodeBadRequest {
+		t.Errorf("deploy to unknown cluster: %v", err)
+	}
+}
+
+func TestDeployNewPerNamespace(t *testing.T) {
+	core, clientset := newTestAPICore(t)
+	for _, namespace := range []string{"", "other"} {
+		req := newTestDeployRequest("app", PortSpec{In: 8888, Ext: 0})
+		req.Deploy.Namespace = namespace
+		if _, err := core.Deploy(req); err != nil {
+			t.Fatalf("deploy in %q: %v", namespace, err)
+		}
+	}
+	if n := countActions(clientset, "create", "pods"); n != 2 {
+		t.Errorf("pods created = %d, want 2", n)
+	}
+	listResp, err := core.List(&Request{Method: "list"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(listResp.Deployments); n != 2 {
+		t.Errorf("deployments = %v", listResp.Deployments)
+	}
+	if _, err := core.Status(&Request{Status: RequestStatus{Name: "app"}}); ErrorCodeOf(err) != ErrCodeBadRequest {
+		t.Errorf("status without namespace: %v", err)
+	}
+	removeReq := newTestRemoveRequest("app")
+	removeReq.Remove.Namespace = "other"
+	if _, err := core.Remove(removeReq); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clientset.CoreV1().Pods(DefaultNamespace).Get(context.TODO(), "app-pod",
+		metav1.GetOptions{}); err != nil {
+		t.Errorf("pod of default namespace: %v", err)
+	}
+	resp, err := core.Status(&Request{Status: RequestStatus{Name: "app"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns := resp.Deployments[0].Namespace; ns != DefaultNamespace {
+		t.Errorf("namespace = %q, want %q", ns, DefaultNamespace)
+	}
+	if entries := core.Registry.Entries(); len(entries) != 1 || entries[0].Deploy.Namespace != DefaultNamespace {
+		t.Errorf("registry entries = %v", entries)
+	}
+}
+
+func TestReconcileRekeysLegacyEntry(t *testing.T) {
+	core, _ := newTestAPICore(t)
+	b := []byte(`{"app":{"deploy":{"name":"app","type":"fwd","fwd":{"srcAddr":"127.0.0.1","port":{"in":8888,"ext":0}}}}}`)
+	if err := ioutil.WriteFile(core.Registry.path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	registry, err := LoadRegistryFrom(core.Registry.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	core.Registry = registry
+	if err := core.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	defer core.Remove(newTestRemoveRequest("app"))
+	if core.Registry.Get(DefaultClusterName, DefaultNamespace, "app") == nil {
+		t.Errorf("registry entries = %v", core.Registry.Entries())
+	}
+	if _, err := core.Status(&Request{Status: RequestStatus{Name: "app"}}); err != nil {
+		t.Errorf("status of reattached entry: %v", err)
+	}
+}
+
+func newTestLMRequest(name string, ports ...PortSpec) *Request {
+	req := &Request{Method: "deploy"}
+	req.Deploy.Name = name
+	req.Deploy.Type = DeployTypeLM
+	req.Deploy.LM.Image = "app-sample:latest"
+	req.Deploy.LM.SrcAddr = "127.0.0.1"
+	// The source deployment is looked up in the registry instead of the source host
+	req.Deploy.LM.SrcCluster = DefaultClusterName
+	req.Deploy.LM.Ports = ports
+	return req
+}
+
+func TestDeployLMRejectsExistingPod(t *testing.T) {
+	existing := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-pod", Namespace: DefaultNamespace},
+	}
+	core, _ := newTestAPICore(t, existing)
+	_, err := core.Deploy(newTestLMRequest("app", PortSpec{In: 8888, Ext: 0}))
+	if ErrorCodeOf(err) != ErrCodeAlreadyExists {
+		t.Fatalf("deploy lm: %v", err)
+	}
+	if _, _, fwdsvcs := core.loadResource(DefaultClusterName, DefaultNamespace, "app").info(); len(fwdsvcs) != 0 {
+		t.Errorf("forwarding services are started: %v", fwdsvcs)
+	}
+}
+
+func TestFailedDeployIsNotListed(t *testing.T) {
+	core, clientset := newTestAPICore(t)
+	clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("create pod failed")
+	})
+	if _, err := core.Deploy(newTestDeployRequest("app", PortSpec{In: 8888, Ext: 0})); ErrorCodeOf(err) != ErrCodeKubeError {
+		t.Fatalf("deploy: %v", err)
+	}
+	if _, err := core.Status(&Request{Status: RequestStatus{Name: "app"}}); ErrorCodeOf(err) != ErrCodeNotFound {
+		t.Errorf("status of failed deploy: %v", err)
+	}
+	listResp, err := core.List(&Request{Method: "list"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listResp.Deployments) != 0 {
+		t.Errorf("deployments = %v", listResp.Deployments)
+	}
+}
+
+func TestReconcileDropsIncompleteMigration(t *testing.T) {
+	core, _ := newTestAPICore(t)
+	req := newTestLMRequest("app", PortSpec{In: 8888, Ext: 0})
+	req.Deploy.Cluster = DefaultClusterName
+	if err := core.Registry.PutMigrating(&req.Deploy); err != nil {
+		t.Fatal(err)
+	}
+	if err := core.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if entries := core.Registry.Entries(); len(entries) != 0 {
+		t.Errorf("registry entries = %v", entries)
+	}
+	if _, err := core.Status(&Request{Status: RequestStatus{Name: "app"}}); ErrorCodeOf(err) != ErrCodeNotFound {
+		t.Errorf("status of incomplete migration: %v", err)
+	}
+}
+
+func TestDeployAndRemoveRejectedWhileMigrating(t *testing.T) {
+	core, _ := newTestAPICore(t)
+	job := core.migrations.New("app", DeployTypeLM)
+	core.loadResource(DefaultClusterName, DefaultNamespace, "app").setJob(job)
+	if _, err := core.Deploy(newTestDeployRequest("app", PortSpec{In: 8888, Ext: 0})); ErrorCodeOf(err) != ErrCodeInvalidState {
+		t.Errorf("deploy while migrating: %v", err)
+	}
+	if _, err := core.Remove(newTestRemoveRequest("app")); ErrorCodeOf(err) != ErrCodeInvalidState {
+		t.Errorf("remove while migrating: %v", err)
+	}
+	job.Fail(errors.New("failed"))
+	if _, err := core.Remove(newTestRemoveRequest("app")); err != nil {
+		t.Errorf("remove after migration: %v", err)
+	}
+}
+
+// waitForMigrationFinished waits for the migration to finish and returns its status.
+func waitForMigrationFinished(t *testing.T, core *APICore, id string) *MigrationStatus {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		resp, err := core.MigrationStatus(&Request{MigrationStatus: RequestMigrationStatus{ID: id}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Migration.FinishedAt != nil {
+			return resp.Migration
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Migration did not finish: " + id)
+	return nil
+}
+
+func TestDeployLMRollsBackFailedMigration(t *testing.T) {
+	core, clientset := newTestAPICore(t)
+	// The migration is queued by the other migration, and then cancelled
+	core.migrationSlots = NewMigrationSlots(1)
+	core.migrationSlots.TryAcquire()
+	resp, err := core.Deploy(newTestLMRequest("app", PortSpec{In: 8888, Ext: 0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := core.MigrationCancel(&Request{MigrationCancel: RequestMigrationCancel{ID: resp.MigrationID}}); err != nil {
+		t.Fatal(err)
+	}
+	status := waitForMigrationFinished(t, core, resp.MigrationID)
+	if status.State != MigrationStateCancelled {
+		t.Errorf("migration status = %+v", status)
+	}
+	if _, err := clientset.CoreV1().Pods(DefaultNamespace).Get(context.TODO(), "app-pod",
+		metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+		t.Errorf("restored pod is not deleted: %v", err)
+	}
+	if _, err := clientset.CoreV1().Services(DefaultNamespace).Get(context.TODO(), "app-svc",
+		metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+		t.Errorf("service is not deleted: %v", err)
+	}
+	if _, _, fwdsvcs := core.loadResource(DefaultClusterName, DefaultNamespace, "app").info(); len(fwdsvcs) != 0 {
+		t.Errorf("forwarding services are not closed: %v", fwdsvcs)
+	}
+	if _, err := core.Status(&Request{Status: RequestStatus{Name: "app"}}); ErrorCodeOf(err) != ErrCodeNotFound {
+		t.Errorf("status after rollback: %v", err)
+	}
+	if entries := core.Registry.Entries(); len(entries) != 0 {
+		t.Errorf("registry entries = %v", entries)
+	}
+}
+
+func TestDeployFwdLMRollbackKeepsForwarding(t *testing.T) {
+	core, clientset := newTestAPICore(t)
+	core.migrationSlots = NewMigrationSlots(1)
+	core.migrationSlots.TryAcquire()
+	req := &Request{Method: "deploy"}
+	req.Deploy.Name = "app"
+	req.Deploy.Type = DeployTypeFwdLM
+	req.Deploy.FwdLM.Image = "app-sample:latest"
+	req.Deploy.FwdLM.SrcAddr = "127.0.0.1"
+	req.Deploy.FwdLM.SrcCluster = DefaultClusterName
+	req.Deploy.FwdLM.Ports = []PortSpec{{In: 8888, Ext: 0, Src: 30088}}
+	resp, err := core.Deploy(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := core.MigrationCancel(&Request{MigrationCancel: RequestMigrationCancel{ID: resp.MigrationID}}); err != nil {
+		t.Fatal(err)
+	}
+	if status := waitForMigrationFinished(t, core, resp.MigrationID); status.State != MigrationStateCancelled {
+		t.Errorf("migration status = %+v", status)
+	}
+	_, _, fwdsvcs := core.loadResource(DefaultClusterName, DefaultNamespace, "app").info()
+	if len(fwdsvcs) != 1 {
+		t.Fatalf("forwarding services = %v", fwdsvcs)
+	}
+	defer fwdsvcs[0].Close()
+	if fwdsvcs[0].IsSuspended() || fwdsvcs[0].ServerAddr().String() != "127.0.0.1:30088" {
+		t.Errorf("forwarding service is not resumed to the source: %v, suspended %v",
+			fwdsvcs[0].ServerAddr(), fwdsvcs[0].IsSuspended())
+	}
+	if _, err := clientset.CoreV1().Pods(DefaultNamespace).Get(context.TODO(), "app-pod",
+		metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+		t.Errorf("restored pod is created: %v", err)
+	}
+	if _, err := core.Status(&Request{Status: RequestStatus{Name: "app"}}); err != nil {
+		t.Errorf("status after rollback: %v", err)
+	}
+	if entries := core.Registry.Entries(); len(entries) != 1 {
+		t.Errorf("registry entries = %v", entries)
+	}
+}
+
+func TestDeployLMTakesSourcePodOptions(t *testing.T) {
+	core, clientset := newTestAPICore(t)
+	srcReq := newTestDeployRequest("src", PortSpec{In: 8888, Ext: 0})
+	srcReq.Deploy.NewApp.PodOptions = *newTestPodOptions()
+	if _, err := core.Deploy(srcReq); err != nil {
+		t.Fatal(err)
+	}
+	defer core.Remove(newTestRemoveRequest("src"))
+	// The migration is queued by the other migration, and then cancelled
+	core.migrationSlots = NewMigrationSlots(1)
+	core.migrationSlots.TryAcquire()
+	req := newTestLMRequest("app", PortSpec{In: 8888, Ext: 0})
+	req.Deploy.LM.SrcName = "src"
+	resp, err := core.Deploy(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer waitForMigrationFinished(t, core, resp.MigrationID)
+	defer core.MigrationCancel(&Request{MigrationCancel: RequestMigrationCancel{ID: resp.MigrationID}})
+	pod, err := clientset.CoreV1().Pods(DefaultNamespace).Get(context.TODO(), "app-pod", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestPodOptions(t, &pod.Spec)
+	entry := core.Registry.Get(DefaultClusterName, DefaultNamespace, "app")
+	if entry == nil || entry.Deploy.LM.PodOptions.IsZero() {
+		t.Errorf("registry entry = %+v", entry)
+	}
+	statusResp, err := core.Status(&Request{Status: RequestStatus{Name: "src"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts := statusResp.Deployments[0].PodOptions; opts == nil || opts.NodeSelector["disk"] != "ssd" {
+		t.Errorf("status pod options = %+v", opts)
+	}
+}
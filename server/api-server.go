@@ -4,11 +4,13 @@ import (
 	"encoding/json"
 	"net"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
-func StartAPIServer(addr string, chanClose chan interface{}) {
-	var ln net.Listener
-	ln, err := net.Listen("tcp", addr)
+// StartAPIServer serves the API at addr, with mutual TLS unless peerTLS is nil.
+func StartAPIServer(addr string, peerTLS *PeerTLS, chanClose chan interface{}) {
+	ln, err := peerTLS.Listen(addr)
 	if err != nil {
 		panic(err)
 	}
@@ -29,11 +31,11 @@ func StartAPIServer(addr string, chanClose chan interface{}) {
 				continue
 			}
 		}
-		go handleConnection(conn)
+		go handleConnection(conn, peerTLS)
 	}
 }
 
-func handleConnection(conn net.Conn) {
+func handleConnection(conn net.Conn, peerTLS *PeerTLS) {
 	defer func() {
 		Logger.InfoF("Close: %v\n", conn.RemoteAddr())
 		conn.Close()
@@ -46,48 +48,95 @@ func handleConnection(conn net.Conn) {
 		return
 	}
 	Logger.Info("Request: " + string(b))
+	var resp *Response
 	var req Request
 	if err := json.Unmarshal(b, &req); err != nil {
 		Logger.ErrorE(err)
-		return
+		resp = NewErrorResponse(NewAPIError(ErrCodeBadRequest, err))
+	} else if req.Method == "_dumpStart" && !peerTLS.IsAllowedConn(conn) {
+		Logger.Warn("Reject _dumpStart from peer not allowed: " + conn.RemoteAddr().String())
+		resp = NewErrorResponse(NewAPIError(ErrCodeForbidden,
+			errors.New("Peer is not allowed to start dump")))
+	} else {
+		resp = doRequest(&req)
+	}
+	if err := writeResponse(conn, resp); err != nil {
+		Logger.ErrorE(err)
+	}
+}
+
+func doRequest(req *Request) *Response {
+	if err := ValidateRequest(req); err != nil {
+		Logger.Warn(err.Error())
+		return NewErrorResponse(err)
 	}
 	var resp *Response
+	var err error
 	switch req.Method {
 	case "deploy":
-		doDeployReq(&req)
+		resp, err = doDeployReq(req)
 	case "remove":
-		doRemoveReq(&req)
+		resp, err = doRemoveReq(req)
+	case "list":
+		resp, err = doListReq(req)
+	case "status":
+		resp, err = doStatusReq(req)
+	case "migration-status":
+		resp, err = doMigrationStatusReq(req)
+	case "migration-cancel":
+		resp, err = doMigrationCancelReq(req)
 	case "_dumpStart":
-		resp = doDumpStartReq(&req)
+		resp, err = doDumpStartReq(req)
 	default:
-		doUnsupportedReq(&req)
+		resp, err = doUnsupportedReq(req)
 	}
-	if resp != nil {
-		b, err := json.Marshal(resp)
-		if err != nil {
-			Logger.ErrorE(err)
-			return
-		}
-		_, err = conn.Write(b)
-		if err != nil {
-			Logger.ErrorE(err)
-			return
-		}
+	if err != nil {
+		Logger.ErrorE(err)
+		return NewErrorResponse(err)
 	}
+	return resp
+}
+
+func writeResponse(conn net.Conn, resp *Response) error {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	b = append(b, []byte("\n")...)
+	if _, err := conn.Write(b); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func doDeployReq(req *Request) (*Response, error) {
+	return TheAPICore.Deploy(req)
+}
+
+func doRemoveReq(req *Request) (*Response, error) {
+	return TheAPICore.Remove(req)
+}
+
+func doListReq(req *Request) (*Response, error) {
+	return TheAPICore.List(req)
+}
+
+func doStatusReq(req *Request) (*Response, error) {
+	return TheAPICore.Status(req)
 }
 
-func doDeployReq(req *Request) {
-	TheAPICore.Deploy(req)
+func doMigrationStatusReq(req *Request) (*Response, error) {
+	return TheAPICore.MigrationStatus(req)
 }
 
-func doRemoveReq(req *Request) {
-	TheAPICore.Remove(req)
+func doMigrationCancelReq(req *Request) (*Response, error) {
+	return TheAPICore.MigrationCancel(req)
 }
 
-func doDumpStartReq(req *Request) *Response {
+func doDumpStartReq(req *Request) (*Response, error) {
 	return TheAPICore.DumpStart(req)
 }
 
-func doUnsupportedReq(req *Request) {
-	Logger.Error("Unsupported request method: " + req.Method)
+func doUnsupportedReq(req *Request) (*Response, error) {
+	return nil, NewAPIError(ErrCodeUnsupported, errors.New("Unsupported request method: "+req.Method))
 }
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CRIUCheckpointer runs criu in the app container.
+// The container must be privileged, share the process namespace and write the pid of the app to
+// MainPidFilePath (see app/lmsupport.sh).
+type CRIUCheckpointer struct {
+	dump *LM_DumpService
+	pid  int
+	// lazyDumpChan receives the result of criu dump --lazy-pages, which exits after all the pages are sent
+	lazyDumpChan        chan error
+	pageServerCloseChan chan struct{}
+	closeOnce           sync.Once
+}
+
+// LM_LazyDumpPidFilePath is the pid file of criu dump --lazy-pages in the app container
+const LM_LazyDumpPidFilePath = "/tmp/cloudlet-live-migration/lazy-dump.pid"
+
+func NewCRIUCheckpointer(dump *LM_DumpService) (*CRIUCheckpointer, error) {
+	p := &CRIUCheckpointer{
+		dump:                dump,
+		pageServerCloseChan: make(chan struct{}),
+	}
+	Logger.Info("[Dump] Get main pid")
+	pid, err := p.getMainPid()
+	if err != nil {
+		return nil, err
+	}
+	p.pid = pid
+	return p, nil
+}
+
+func (p *CRIUCheckpointer) SupportsPreDump() bool {
+	return true
+}
+
+func (p *CRIUCheckpointer) PreDump(itr int) (int64, error) {
+	argb := strings.Builder{}
+	fmt.Fprintf(&argb, "mkdir -p %s/%d", LM_DumpImagesDir, itr)
+	imagesDir := fmt.Sprintf("%s/%d", LM_DumpImagesDir, itr)
+	prevImagesDirOpt := ""
+	if itr > 1 {
+		prevImagesDirOpt = fmt.Sprintf("--prev-images-dir ../%d", itr-1)
+	}
+	fmt.Fprintf(&argb, " && criu pre-dump --tree %d --images-dir %s %s --tcp-close --shell-job",
+		p.pid, imagesDir, prevImagesDirOpt)
+	Logger.Info("[Dump][svc] Exec mkdir && criu pre-dump")
+	if err := p.exec(argb.String()); err != nil {
+		return 0, err
+	}
+	return p.send(imagesDir)
+}
+
+func (p *CRIUCheckpointer) Dump(itr int) (int64, error) {
+	argb := strings.Builder{}
+	fmt.Fprintf(&argb, "mkdir -p %s/final", LM_DumpImagesDir)
+	imagesDir := fmt.Sprintf("%s/final", LM_DumpImagesDir)
+	prevImagesDirOpt := ""
+	if itr > 1 {
+		prevImagesDirOpt = fmt.Sprintf("--prev-images-dir ../%d", itr-1)
+	}
+	fmt.Fprintf(&argb, " && criu dump --tree %d --images-dir %s %s --tcp-close --shell-job --track-mem",
+		p.pid, imagesDir, prevImagesDirOpt)
+	Logger.Info("[Dump][svc] Exec mkdir && criu dump")
+	if err := p.exec(argb.String()); err != nil {
+		return 0, err
+	}
+	return p.send(imagesDir)
+}
+
+func (p *CRIUCheckpointer) SupportsLazyPages() bool {
+	return true
+}
+
+// LazyDump runs criu dump --lazy-pages, which keeps running as the page server in the container
+// after the images without the pages are written, and waits for it to be ready with --status-fd.
+// The page server is forwarded to the loopback address, and reachable by the destination only
+// through the peer tunnel at PageServerPort.
+func (p *CRIUCheckpointer) LazyDump(itr int) (int64, error) {
+	imagesDir := fmt.Sprintf("%s/final", LM_DumpImagesDir)
+	prevImagesDirOpt := ""
+	if itr > 1 {
+		prevImagesDirOpt = fmt.Sprintf("--prev-images-dir ../%d", itr-1)
+	}
+	Logger.Info("[Dump][svc] Open kube port-forward to page server")
+	localPort, err := OpenKubePortForwardLoopback(p.dump.RestConfig, p.dump.Namespace, p.dump.PodName,
+		LM_PodPageServerPort, os.Stdout, os.Stderr, p.pageServerCloseChan)
+	if err != nil {
+		return 0, err
+	}
+	Logger.Info("[Dump][svc] Open peer tunnel to page server")
+	if err := OpenPeerTunnel(p.dump.PeerTLS, p.dump.PageServerPort, p.dump.TransferToken,
+		fmt.Sprintf("127.0.0.1:%d", localPort), p.pageServerCloseChan); err != nil {
+		return 0, err
+	}
+	// The shell execs criu to write its pid, and the status is written to stdout
+	cmd := fmt.Sprintf("mkdir -p %s && echo $$ > %s && exec criu dump --tree %d --images-dir %s %s"+
+		" --tcp-close --shell-job --track-mem --lazy-pages --address 0.0.0.0 --port %d --status-fd 3 3>&1 1>&2",
+		imagesDir, LM_LazyDumpPidFilePath, p.pid, imagesDir, prevImagesDirOpt, LM_PodPageServerPort)
+	Logger.Info("[Dump][svc] Exec mkdir && criu dump --lazy-pages")
+	pr, pw := io.Pipe()
+	p.lazyDumpChan = make(chan error, 1)
+	go func() {
+		err := p.execOut(cmd, pw)
+		pw.CloseWithError(err)
+		p.lazyDumpChan <- err
+	}()
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(pr, status); err != nil {
+		pr.Close()
+		return 0, errors.Wrap(err, "criu page server is not ready")
+	}
+	go io.Copy(ioutil.Discard, pr)
+	return p.send(imagesDir)
+}
+
+// Rollback restores the app from the final images unless it is still running.
+// After LazyDump, the page server is stopped first, and the app cannot be restored once the
+// restored app has fetched some of the pages.
+func (p *CRIUCheckpointer) Rollback() error {
+	if p.lazyDumpChan != nil {
+		Logger.Info("[Dump][svc] Stop criu page server")
+		if err := p.exec(fmt.Sprintf("kill $(cat %s) 2>/dev/null; true", LM_LazyDumpPidFilePath)); err != nil {
+			Logger.ErrorE(err)
+		}
+	}
+	Logger.Info("[Dump][svc] Exec criu restore to roll back")
+	return p.exec(fmt.Sprintf("if ! kill -0 %d 2>/dev/null; then %s & fi", p.pid, GetCriuRestoreCommand("")))
+}
+
+// Complete does nothing because criu dump has already stopped the app.
+func (p *CRIUCheckpointer) Complete() error {
+	return nil
+}
+
+// Close waits for criu dump --lazy-pages to send all the pages, and closes the port-forward and the
+// peer tunnel to it.
+func (p *CRIUCheckpointer) Close() {
+	p.closeOnce.Do(func() {
+		if p.lazyDumpChan != nil {
+			Logger.Info("[Dump][svc] Wait for page server to send all pages")
+			select {
+			case err := <-p.lazyDumpChan:
+				if err != nil {
+					Logger.ErrorE(err)
+				}
+			case <-time.After(LM_LazyPagesTimeout):
+				Logger.Warn("[Dump][svc] Page server timeout")
+			}
+		}
+		close(p.pageServerCloseChan)
+	})
+}
+
+// send returns the size of imagesDir and sends it.
+func (p *CRIUCheckpointer) send(imagesDir string) (int64, error) {
+	size, err := PodDirSize(p.dump.Clientset, p.dump.RestConfig, p.dump.Namespace, p.dump.PodName,
+		p.dump.ContainerName, os.Stderr, imagesDir)
+	if err != nil {
+		return 0, err
+	}
+	return size, p.dump.sender.SendPodDir(imagesDir)
+}
+
+func (p *CRIUCheckpointer) exec(cmd string) error {
+	return p.execOut(cmd, os.Stdout)
+}
+
+func (p *CRIUCheckpointer) execOut(cmd string, stdout io.Writer) error {
+	return ExecutePod(p.dump.Clientset, p.dump.RestConfig, p.dump.Namespace, p.dump.PodName, p.dump.ContainerName,
+		nil, stdout, os.Stderr, "/bin/sh", "-c", cmd)
+}
+
+func (p *CRIUCheckpointer) getMainPid() (int, error) {
+	v, err := ReadPodFile(p.dump.Clientset, p.dump.RestConfig, p.dump.Namespace, p.dump.PodName,
+		p.dump.ContainerName, os.Stderr, MainPidFilePath)
+	if err != nil {
+		return 0, err
+	}
+	ans, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return ans, nil
+}
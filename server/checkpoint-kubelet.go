@@ -0,0 +1,174 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	// KubeletCheckpointImagesDir is the directory of the criu images in the checkpoint archive
+	KubeletCheckpointImagesDir = "checkpoint"
+)
+
+// KubeletCheckpointer checkpoints the app container with the kubelet checkpoint API
+// (feature gate ContainerCheckpoint), so the app image needs neither criu nor lmsupport.sh.
+// The image of the restored pod still needs criu, which restores the images.
+// The kubelet writes the archive on the node, so this server must run on the node of the app
+// and sends the images from this host.
+// The kubelet does not pre-dump and leaves the container running after the checkpoint,
+// so the pod of the app is deleted by Complete once the restored app has resumed.
+type KubeletCheckpointer struct {
+	dump     *LM_DumpService
+	nodeName string
+}
+
+func NewKubeletCheckpointer(dump *LM_DumpService) (*KubeletCheckpointer, error) {
+	pod, _, errStack := GetPod(dump.Clientset, dump.Namespace, dump.PodName)
+	if errStack != nil {
+		return nil, errStack
+	}
+	if pod.Spec.NodeName == "" {
+		return nil, errors.New("Pod is not scheduled: " + dump.PodName)
+	}
+	return &KubeletCheckpointer{
+		dump:     dump,
+		nodeName: pod.Spec.NodeName,
+	}, nil
+}
+
+func (p *KubeletCheckpointer) SupportsPreDump() bool {
+	return false
+}
+
+func (p *KubeletCheckpointer) PreDump(itr int) (int64, error) {
+	return 0, errors.New("Pre-dump is not supported by the kubelet checkpoint API")
+}
+
+func (p *KubeletCheckpointer) SupportsLazyPages() bool {
+	return false
+}
+
+func (p *KubeletCheckpointer) LazyDump(itr int) (int64, error) {
+	return 0, errors.New("Lazy pages are not supported by the kubelet checkpoint API")
+}
+
+func (p *KubeletCheckpointer) Close() {
+}
+
+func (p *KubeletCheckpointer) Dump(itr int) (int64, error) {
+	Logger.Info("[Dump][svc] Checkpoint container with kubelet on " + p.nodeName)
+	archives, err := CheckpointContainer(p.dump.Clientset, p.nodeName, p.dump.Namespace, p.dump.PodName,
+		p.dump.ContainerName)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		for _, archive := range archives {
+			if err := os.Remove(archive); err != nil {
+				Logger.Warn("[Dump][svc] Remove checkpoint archive: " + err.Error())
+			}
+		}
+	}()
+	stagingDir, err := ioutil.TempDir("", "cloudlet-live-migration")
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer os.RemoveAll(stagingDir)
+	// The staging directory has the same layout as LM_RsyncModuleDirectory of the restored pod
+	relImagesDir := strings.TrimPrefix(LM_DumpImagesDir, LM_RsyncModuleDirectory+"/")
+	imagesDir := filepath.Join(stagingDir, relImagesDir, "final")
+	if _, err := os.Stat(archives[0]); os.IsNotExist(err) {
+		return 0, errors.New(fmt.Sprintf(
+			"Checkpoint archive %s is not on this host; the server must run on node %s", archives[0], p.nodeName))
+	}
+	Logger.Info("[Dump][svc] Extract checkpoint archive: " + archives[0])
+	size, err := extractCheckpointImages(archives[0], imagesDir)
+	if err != nil {
+		return 0, err
+	}
+	return size, p.dump.sender.SendLocalDir(stagingDir)
+}
+
+// Rollback does nothing because the kubelet leaves the container running.
+func (p *KubeletCheckpointer) Rollback() error {
+	return nil
+}
+
+// Complete deletes the pod of the app, which the kubelet has left running.
+// The pod of a controller is replaced by the controller.
+func (p *KubeletCheckpointer) Complete() error {
+	Logger.Info("[Dump][svc] Delete source pod: " + p.dump.PodName)
+	if err, errStack := DeletePod(p.dump.Clientset, p.dump.Namespace, p.dump.PodName); err != nil &&
+		!k8serrors.IsNotFound(err) {
+		return errStack
+	}
+	return nil
+}
+
+// extractCheckpointImages extracts the criu images in the checkpoint archive to imagesDir,
+// and returns the size of the images.
+func extractCheckpointImages(archive string, imagesDir string) (int64, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	found := false
+	size := int64(0)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		name := filepath.Clean(hdr.Name)
+		// The entries out of KubeletCheckpointImagesDir, including those escaping imagesDir, are skipped
+		rel, err := filepath.Rel(KubeletCheckpointImagesDir, name)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		path := filepath.Join(imagesDir, rel)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return 0, errors.WithStack(err)
+			}
+		case tar.TypeReg:
+			if err := writeFileFrom(path, tr, os.FileMode(hdr.Mode)&os.ModePerm); err != nil {
+				return 0, err
+			}
+			found = true
+			size += hdr.Size
+		}
+	}
+	if !found {
+		return 0, errors.New("No criu images in checkpoint archive: " + archive)
+	}
+	return size, nil
+}
+
+func writeFileFrom(path string, r io.Reader, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(f.Close())
+}
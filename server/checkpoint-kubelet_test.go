@@ -0,0 +1,159 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type testTarEntry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+}
+
+func writeTestTar(t *testing.T, path string, entries []testTarEntry) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Mode: 0644, Linkname: e.linkname}
+		if e.typeflag == tar.TypeReg {
+			hdr.Size = int64(len(e.body))
+		} else if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// listTestFiles returns the paths of the files and links under dir relative to dir.
+func listTestFiles(t *testing.T, dir string) []string {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestExtractCheckpointImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlet-checkpoint-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archive := filepath.Join(dir, "checkpoint.tar")
+	writeTestTar(t, archive, []testTarEntry{
+		{name: "config.dump", typeflag: tar.TypeReg, body: "config"},
+		{name: "checkpoint/", typeflag: tar.TypeDir},
+		{name: "checkpoint/core-1.img", typeflag: tar.TypeReg, body: "core"},
+		{name: "checkpoint/sub/pages-1.img", typeflag: tar.TypeReg, body: "pages"},
+		{name: "checkpoint/../../escaped.img", typeflag: tar.TypeReg, body: "escaped"},
+		{name: "checkpoint/../rootfs-diff.tar", typeflag: tar.TypeReg, body: "rootfs"},
+		{name: "../checkpoint/parent.img", typeflag: tar.TypeReg, body: "parent"},
+		{name: "/checkpoint/absolute.img", typeflag: tar.TypeReg, body: "absolute"},
+		{name: "checkpoint/link.img", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"},
+	})
+	imagesDir := filepath.Join(dir, "out", "images")
+	size, err := extractCheckpointImages(archive, imagesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len("core")+len("pages")) {
+		t.Errorf("size = %d", size)
+	}
+	want := []string{"images/core-1.img", "images/sub/pages-1.img"}
+	if files := listTestFiles(t, filepath.Join(dir, "out")); strings.Join(files, ",") != strings.Join(want, ",") {
+		t.Errorf("files = %v, want %v", files, want)
+	}
+	if files := listTestFiles(t, dir); len(files) != 3 {
+		t.Errorf("files out of images dir = %v", files)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(imagesDir, "sub", "pages-1.img"))
+	if err != nil || string(b) != "pages" {
+		t.Errorf("pages = %q, %v", b, err)
+	}
+}
+
+func TestExtractCheckpointImagesNoImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlet-checkpoint-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archive := filepath.Join(dir, "checkpoint.tar")
+	writeTestTar(t, archive, []testTarEntry{
+		{name: "config.dump", typeflag: tar.TypeReg, body: "config"},
+		{name: "checkpoint/../../escaped.img", typeflag: tar.TypeReg, body: "escaped"},
+	})
+	if _, err := extractCheckpointImages(archive, filepath.Join(dir, "images")); err == nil {
+		t.Error("archive without images is extracted")
+	}
+}
+
+func TestKubeletCheckpointerComplete(t *testing.T) {
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-pod", Namespace: DefaultNamespace},
+		Spec:       apiv1.PodSpec{NodeName: "node-1"},
+	}
+	clientset := fake.NewSimpleClientset(pod)
+	checkpointer, err := NewKubeletCheckpointer(&LM_DumpService{
+		Clientset: clientset,
+		Namespace: DefaultNamespace,
+		PodName:   "app-pod",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkpointer.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clientset.CoreV1().Pods(DefaultNamespace).Get(context.TODO(), "app-pod",
+		metav1.GetOptions{}); err != nil {
+		t.Errorf("pod is deleted by rollback: %v", err)
+	}
+	if err := checkpointer.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clientset.CoreV1().Pods(DefaultNamespace).Get(context.TODO(), "app-pod",
+		metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+		t.Errorf("source pod is not deleted: %v", err)
+	}
+	// The pod deleted in the meantime is not an error
+	if err := checkpointer.Complete(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+)
+
+const (
+	// CheckpointCRIU runs criu in the app container, which needs criu, rsync and /MAIN_PID
+	CheckpointCRIU = "criu"
+	// CheckpointKubelet uses the checkpoint API of the kubelet of the node running the app
+	CheckpointKubelet = "kubelet"
+)
+
+// Checkpointer checkpoints the app container on the source host and sends the images to
+// LM_DumpImagesDir of the restored pod: the images of the pre-dump itr to <LM_DumpImagesDir>/<itr>
+// and the final images to <LM_DumpImagesDir>/final.
+// The dumps return the size of the images in bytes.
+type Checkpointer interface {
+	// PreDump sends the images of the pre-dump itr while the app keeps running
+	PreDump(itr int) (int64, error)
+	// Dump sends the final images; the images of the pre-dump itr-1 are used as the parent if any
+	Dump(itr int) (int64, error)
+	// LazyDump sends the final images without the memory pages, and serves the pages through the
+	// peer tunnel at PageServerPort of this host until the restored app fetches all of them
+	LazyDump(itr int) (int64, error)
+	// Rollback runs the app on this host again after Dump or LazyDump
+	Rollback() error
+	// Complete stops the app on this host after the restored app has resumed
+	Complete() error
+	// SupportsPreDump returns false if only the final dump is available
+	SupportsPreDump() bool
+	// SupportsLazyPages returns false if LazyDump is not available
+	SupportsLazyPages() bool
+	// Close waits for the pages of LazyDump to be sent and releases the resources
+	Close()
+}
+
+// NewCheckpointer returns the Checkpointer of dump.Checkpoint.
+func NewCheckpointer(dump *LM_DumpService) (Checkpointer, error) {
+	switch dump.Checkpoint {
+	case "", CheckpointCRIU:
+		return NewCRIUCheckpointer(dump)
+	case CheckpointKubelet:
+		return NewKubeletCheckpointer(dump)
+	default:
+		return nil, errors.New("Unsupported checkpoint backend: " + dump.Checkpoint)
+	}
+}
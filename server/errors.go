@@ -25,3 +25,51 @@ func IsDeadlineExceeded(err error) bool {
 	}
 	return true
 }
+
+const (
+	ErrCodeBadRequest     = "BadRequest"
+	ErrCodeUnsupported    = "Unsupported"
+	ErrCodeAlreadyExists  = "AlreadyExists"
+	ErrCodeNotFound       = "NotFound"
+	ErrCodeInvalidState   = "InvalidState"
+	ErrCodeKubeError      = "KubeError"
+	ErrCodePodNotReady    = "PodNotReady"
+	ErrCodePodFailed      = "PodFailed"
+	ErrCodeImagePull      = "ImagePullFailed"
+	ErrCodeForwardError   = "ForwardError"
+	ErrCodeMigrationError = "MigrationError"
+	// ErrCodeTooManyMigrations is returned when MaxMigrations of HostConf are running
+	ErrCodeTooManyMigrations = "TooManyMigrations"
+	// ErrCodeForbidden is returned when the client is not an allowed peer of TLSConf
+	ErrCodeForbidden = "Forbidden"
+	ErrCodeInternal  = "Internal"
+)
+
+// APIError is an error which carries the code reported in Response.Code.
+type APIError struct {
+	Code string
+	Err  error
+}
+
+func NewAPIError(code string, err error) error {
+	return &APIError{
+		Code: code,
+		Err:  err,
+	}
+}
+
+func (p *APIError) Error() string {
+	return p.Err.Error()
+}
+
+func (p *APIError) Unwrap() error {
+	return p.Err
+}
+
+func ErrorCodeOf(err error) string {
+	var apiErr *APIError
+	if stderrors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	return ErrCodeInternal
+}
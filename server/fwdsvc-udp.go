@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	UDPFwdSvc_BufferSize      = 64 * 1024
+	UDPFwdSvc_FlowIdleTimeout = 60 * time.Second
+)
+
+// UDPForwarderService forwards UDP datagrams to the server.
+// Each client address has its own flow with a dedicated socket to the server so that
+// replies can be sent back to the client. Flows are closed after being idle for a while.
+type UDPForwarderService struct {
+	network    string
+	clientAddr *net.UDPAddr
+	serverAddr *net.UDPAddr
+	isExtHost  bool
+	conn       *net.UDPConn
+	// mux is held for reading while a datagram is forwarded so that Suspend waits for it
+	mux         sync.RWMutex
+	isSuspended bool
+	dataRate    int
+	muxFlows    sync.Mutex
+	flows       map[string]*UDPFlow
+	idleTimeout time.Duration
+	chanClose   chan struct{}
+	closeOnce   sync.Once
+}
+
+type UDPFlow struct {
+	clientAddr *net.UDPAddr
+	serverConn *net.UDPConn
+	muxActive  sync.Mutex
+	lastActive time.Time
+	chanClosed chan struct{}
+}
+
+func StartUDPForwarderService(
+	network string,
+	clientAddr *net.UDPAddr,
+	serverAddr *net.UDPAddr,
+	isExtHost bool,
+	dataRate int,
+) (*UDPForwarderService, error) {
+	return startUDPForwarderService(network, clientAddr, serverAddr, isExtHost, dataRate,
+		UDPFwdSvc_FlowIdleTimeout)
+}
+
+func startUDPForwarderService(
+	network string,
+	clientAddr *net.UDPAddr,
+	serverAddr *net.UDPAddr,
+	isExtHost bool,
+	dataRate int,
+	idleTimeout time.Duration,
+) (*UDPForwarderService, error) {
+	conn, err := net.ListenUDP(network, clientAddr)
+	if err != nil {
+		return nil, err
+	}
+	p := &UDPForwarderService{
+		network:     network,
+		clientAddr:  clientAddr,
+		serverAddr:  serverAddr,
+		isExtHost:   isExtHost,
+		conn:        conn,
+		dataRate:    dataRate,
+		flows:       map[string]*UDPFlow{},
+		idleTimeout: idleTimeout,
+		chanClose:   make(chan struct{}),
+	}
+	go p.listener()
+	return p, nil
+}
+
+func (p *UDPForwarderService) Network() string {
+	return p.network
+}
+
+func (p *UDPForwarderService) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.chanClose)
+		err = p.conn.Close()
+		p.closeAllFlows()
+	})
+	return err
+}
+
+// Suspend stops forwarding. Datagrams received while suspended are dropped.
+func (p *UDPForwarderService) Suspend() {
+	p.mux.Lock()
+	p.isSuspended = true
+	p.mux.Unlock()
+	Logger.Debug("[UDPFwdsvc] Suspended")
+}
+
+func (p *UDPForwarderService) Resume() {
+	p.mux.Lock()
+	p.isSuspended = false
+	p.mux.Unlock()
+}
+
+func (p *UDPForwarderService) CloseAllForwarders() {
+	if !p.IsSuspended() {
+		panic("Must be suspended before CloseAllForwarders")
+	}
+	p.closeAllFlows()
+}
+
+func (p *UDPForwarderService) ChangeServerAddr(serverAddr string) error {
+	if !p.IsSuspended() {
+		panic("Must be suspended before ChangeServerAddr")
+	}
+	addr, err := net.ResolveUDPAddr(p.network, serverAddr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	p.mux.Lock()
+	p.serverAddr = addr
+	p.mux.Unlock()
+	return nil
+}
+
+func (p *UDPForwarderService) ChangeDataRate(dataRate int) {
+	if !p.IsSuspended() {
+		panic("Must be suspended before ChangeDataRate")
+	}
+	p.mux.Lock()
+	p.dataRate = dataRate
+	p.mux.Unlock()
+}
+
+func (p *UDPForwarderService) ClientAddr() net.Addr {
+	return p.clientAddr
+}
+
+func (p *UDPForwarderService) ServerAddr() net.Addr {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	return p.serverAddr
+}
+
+func (p *UDPForwarderService) DataRate() int {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	return p.dataRate
+}
+
+func (p *UDPForwarderService) IsSuspended() bool {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	return p.isSuspended
+}
+
+func (p *UDPForwarderService) NumForwarders() int {
+	p.muxFlows.Lock()
+	defer p.muxFlows.Unlock()
+	return len(p.flows)
+}
+
+func (p *UDPForwarderService) listener() {
+	buf := make([]byte, UDPFwdSvc_BufferSize)
+	for {
+		nr, caddr, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			if IsClosedError(err) {
+				Logger.Debug("[UDPFwdsvc] Read returned with close")
+			} else {
+				Logger.ErrorE(errors.WithStack(err))
+			}
+			return
+		}
+		p.forward(buf[0:nr], caddr)
+	}
+}
+
+func (p *UDPForwarderService) forward(b []byte, caddr *net.UDPAddr) {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	if p.isSuspended {
+		Logger.TraceF("[UDPFwdsvc] Drop datagram while suspended: %v\n", caddr)
+		return
+	}
+	flow, err := p.getFlow(caddr, p.serverAddr)
+	if err != nil {
+		Logger.ErrorE(err)
+		return
+	}
+	flow.touch()
+	timeWriteStart := time.Now()
+	nw, err := flow.serverConn.Write(b)
+	if err != nil {
+		Logger.Warn("[UDPFwdsvc] Upstream: " + err.Error())
+		return
+	}
+	if p.dataRate > 0 {
+		timeWrite := time.Now().Sub(timeWriteStart)
+		rateBps := float64(p.dataRate) * 125000.0
+		timeToSleep := (float64(nw) / rateBps) - timeWrite.Seconds()
+		if timeToSleep > 0 {
+			time.Sleep(time.Duration(timeToSleep*1000000000) * time.Nanosecond)
+		}
+	}
+}
+
+func (p *UDPForwarderService) getFlow(caddr *net.UDPAddr, serverAddr *net.UDPAddr) (*UDPFlow, error) {
+	key := caddr.String()
+	p.muxFlows.Lock()
+	defer p.muxFlows.Unlock()
+	if flow, ok := p.flows[key]; ok {
+		return flow, nil
+	}
+	serverConn, err := p.dialUDP(serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	flow := &UDPFlow{
+		clientAddr: caddr,
+		serverConn: serverConn,
+		lastActive: time.Now(),
+		chanClosed: make(chan struct{}),
+	}
+	p.flows[key] = flow
+	Logger.DebugF("[UDPFwdsvc] Open flow: %s <--> %s\n", caddr.String(), serverAddr.String())
+	go p.downstream(key, flow)
+	return flow, nil
+}
+
+func (p *UDPForwarderService) dialUDP(serverAddr *net.UDPAddr) (*net.UDPConn, error) {
+	var laddr *net.UDPAddr
+	gatewayAddr := TheAPICore.GatewayAddr
+	if gatewayAddr != "" {
+		addrstr := fmt.Sprintf("%s:0", gatewayAddr)
+		if la, err := net.ResolveUDPAddr(p.network, addrstr); err != nil {
+			Logger.Warn("[UDPFwdsvc] ResolveUDPAddr: " + err.Error())
+		} else {
+			laddr = la
+		}
+	}
+	conn, err := net.DialUDP(p.network, laddr, serverAddr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return conn, nil
+}
+
+// downstream sends the replies from the server back to the client until the flow is idle or closed.
+func (p *UDPForwarderService) downstream(key string, flow *UDPFlow) {
+	defer func() {
+		p.muxFlows.Lock()
+		if p.flows[key] == flow {
+			delete(p.flows, key)
+		}
+		p.muxFlows.Unlock()
+		flow.serverConn.Close()
+		close(flow.chanClosed)
+		Logger.DebugF("[UDPFwdsvc] Close flow: %s\n", key)
+	}()
+	buf := make([]byte, UDPFwdSvc_BufferSize)
+	for {
+		if err := flow.serverConn.SetReadDeadline(time.Now().Add(p.idleTimeout)); err != nil {
+			Logger.Warn("[UDPFwdsvc] SetReadDeadline: " + err.Error())
+		}
+		nr, err := flow.serverConn.Read(buf)
+		if err != nil {
+			if IsDeadlineExceeded(err) {
+				if flow.idle() < p.idleTimeout {
+					continue
+				}
+				return
+			}
+			if !IsClosedError(err) {
+				Logger.Warn("[UDPFwdsvc] Downstream: " + err.Error())
+			}
+			return
+		}
+		flow.touch()
+		if _, err := p.conn.WriteToUDP(buf[0:nr], flow.clientAddr); err != nil {
+			if IsClosedError(err) {
+				return
+			}
+			Logger.Warn("[UDPFwdsvc] Downstream: " + err.Error())
+		}
+	}
+}
+
+func (p *UDPForwarderService) closeAllFlows() {
+	p.muxFlows.Lock()
+	var flows []*UDPFlow
+	for _, flow := range p.flows {
+		flows = append(flows, flow)
+	}
+	p.muxFlows.Unlock()
+	for _, flow := range flows {
+		flow.serverConn.Close()
+		<-flow.chanClosed
+	}
+}
+
+func (p *UDPFlow) touch() {
+	p.muxActive.Lock()
+	p.lastActive = time.Now()
+	p.muxActive.Unlock()
+}
+
+func (p *UDPFlow) idle() time.Duration {
+	p.muxActive.Lock()
+	defer p.muxActive.Unlock()
+	return time.Now().Sub(p.lastActive)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// startTestUDPServer starts the UDP server which replies to each datagram with prefix and the datagram.
+func startTestUDPServer(t *testing.T, prefix string) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, UDPFwdSvc_BufferSize)
+		for {
+			nr, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(append([]byte(prefix), buf[:nr]...), addr)
+		}
+	}()
+	return conn
+}
+
+func startTestUDPForwarder(t *testing.T, server *net.UDPConn, idleTimeout time.Duration) *UDPForwarderService {
+	newTestAPICore(t)
+	fwdsvc, err := startUDPForwarderService("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		server.LocalAddr().(*net.UDPAddr), false, 0, idleTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fwdsvc.Close() })
+	return fwdsvc
+}
+
+func dialTestUDPForwarder(t *testing.T, fwdsvc *UDPForwarderService) *net.UDPConn {
+	conn, err := net.DialUDP("udp", nil, fwdsvc.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// exchangeUDP sends msg by conn and returns the reply, or "" if no reply is received within timeout.
+func exchangeUDP(t *testing.T, conn *net.UDPConn, msg string, timeout time.Duration) string {
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, UDPFwdSvc_BufferSize)
+	nr, err := conn.Read(buf)
+	if err != nil {
+		if IsDeadlineExceeded(err) {
+			return ""
+		}
+		t.Fatal(err)
+	}
+	return string(buf[:nr])
+}
+
+// waitForNumForwarders waits until fwdsvc has n flows.
+func waitForNumForwarders(t *testing.T, fwdsvc *UDPForwarderService, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for fwdsvc.NumForwarders() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("forwarders = %d, want %d", fwdsvc.NumForwarders(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUDPForwarderServiceFlows(t *testing.T) {
+	fwdsvc := startTestUDPForwarder(t, startTestUDPServer(t, "a:"), UDPFwdSvc_FlowIdleTimeout)
+	clientA := dialTestUDPForwarder(t, fwdsvc)
+	clientB := dialTestUDPForwarder(t, fwdsvc)
+	for i := 0; i < 2; i++ {
+		if reply := exchangeUDP(t, clientA, "hello", time.Second); reply != "a:hello" {
+			t.Errorf("reply to client A = %q", reply)
+		}
+	}
+	if n := fwdsvc.NumForwarders(); n != 1 {
+		t.Errorf("forwarders = %d, want 1", n)
+	}
+	if reply := exchangeUDP(t, clientB, "world", time.Second); reply != "a:world" {
+		t.Errorf("reply to client B = %q", reply)
+	}
+	if n := fwdsvc.NumForwarders(); n != 2 {
+		t.Errorf("forwarders = %d, want 2", n)
+	}
+	fwdsvc.Close()
+	if n := fwdsvc.NumForwarders(); n != 0 {
+		t.Errorf("forwarders after close = %d", n)
+	}
+}
+
+func TestUDPForwarderServiceIdleFlow(t *testing.T) {
+	fwdsvc := startTestUDPForwarder(t, startTestUDPServer(t, "a:"), 100*time.Millisecond)
+	client := dialTestUDPForwarder(t, fwdsvc)
+	if reply := exchangeUDP(t, client, "hello", time.Second); reply != "a:hello" {
+		t.Fatalf("reply = %q", reply)
+	}
+	waitForNumForwarders(t, fwdsvc, 0)
+	// The expired flow is opened again
+	if reply := exchangeUDP(t, client, "again", time.Second); reply != "a:again" {
+		t.Errorf("reply after idle = %q", reply)
+	}
+	if n := fwdsvc.NumForwarders(); n != 1 {
+		t.Errorf("forwarders = %d, want 1", n)
+	}
+}
+
+func TestUDPForwarderServiceRedirectWhileSuspended(t *testing.T) {
+	fwdsvc := startTestUDPForwarder(t, startTestUDPServer(t, "a:"), UDPFwdSvc_FlowIdleTimeout)
+	serverB := startTestUDPServer(t, "b:")
+	client := dialTestUDPForwarder(t, fwdsvc)
+	if reply := exchangeUDP(t, client, "1", time.Second); reply != "a:1" {
+		t.Fatalf("reply = %q", reply)
+	}
+	fwdsvc.Suspend()
+	if reply := exchangeUDP(t, client, "2", 200*time.Millisecond); reply != "" {
+		t.Errorf("reply while suspended = %q", reply)
+	}
+	fwdsvc.CloseAllForwarders()
+	if n := fwdsvc.NumForwarders(); n != 0 {
+		t.Errorf("forwarders after CloseAllForwarders = %d", n)
+	}
+	if err := fwdsvc.ChangeServerAddr(serverB.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	fwdsvc.Resume()
+	if reply := exchangeUDP(t, client, "3", time.Second); reply != "b:3" {
+		t.Errorf("reply after redirect = %q", reply)
+	}
+	if addr := fwdsvc.ServerAddr().String(); addr != serverB.LocalAddr().String() {
+		t.Errorf("server addr = %s", addr)
+	}
+}
@@ -13,6 +13,23 @@ const (
 	FwdSvc_LnTimeoutDuration = 10 * time.Millisecond
 )
 
+// ForwardingService forwards the traffic on a port of this host to a server.
+// It is implemented by ForwarderService for TCP and UDPForwarderService for UDP.
+type ForwardingService interface {
+	Network() string
+	Close() error
+	Suspend()
+	Resume()
+	CloseAllForwarders()
+	ChangeServerAddr(serverAddr string) error
+	ChangeDataRate(dataRate int)
+	ClientAddr() net.Addr
+	ServerAddr() net.Addr
+	DataRate() int
+	IsSuspended() bool
+	NumForwarders() int
+}
+
 type ForwarderService struct {
 	network     string
 	clientAddr  *net.TCPAddr
@@ -24,6 +41,7 @@ type ForwarderService struct {
 	chanSuspend chan struct{}
 	isSuspended bool
 	chanClose   chan struct{}
+	closeOnce   sync.Once
 	dataRate    int
 }
 
@@ -72,8 +90,14 @@ func StartForwarderServiceDR(
 	return p, err
 }
 
+func (p *ForwarderService) Network() string {
+	return p.network
+}
+
 func (p *ForwarderService) Close() error {
-	close(p.chanClose)
+	p.closeOnce.Do(func() {
+		close(p.chanClose)
+	})
 	return nil
 }
 
@@ -93,7 +117,7 @@ func (p *ForwarderService) Resume() {
 }
 
 func (p *ForwarderService) CloseAllForwarders() {
-	if !p.isSuspended {
+	if !p.IsSuspended() {
 		panic("Must be suspended before CloseAllForwarders")
 	}
 	wg := sync.WaitGroup{}
@@ -110,18 +134,55 @@ func (p *ForwarderService) CloseAllForwarders() {
 	wg.Wait()
 }
 
-func (p *ForwarderService) ChangeServerAddr(serverAddr *net.TCPAddr) {
-	if !p.isSuspended {
+func (p *ForwarderService) ChangeServerAddr(serverAddr string) error {
+	if !p.IsSuspended() {
 		panic("Must be suspended before ChangeServerAddr")
 	}
-	p.serverAddr = serverAddr
+	addr, err := net.ResolveTCPAddr(p.network, serverAddr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	p.condSuspend.L.Lock()
+	p.serverAddr = addr
+	p.condSuspend.L.Unlock()
+	return nil
 }
 
 func (p *ForwarderService) ChangeDataRate(dataRate int) {
-	if !p.isSuspended {
+	if !p.IsSuspended() {
 		panic("Must be suspended before ChangeDataRate")
 	}
+	p.condSuspend.L.Lock()
 	p.dataRate = dataRate
+	p.condSuspend.L.Unlock()
+}
+
+func (p *ForwarderService) ClientAddr() net.Addr {
+	return p.clientAddr
+}
+
+func (p *ForwarderService) ServerAddr() net.Addr {
+	p.condSuspend.L.Lock()
+	defer p.condSuspend.L.Unlock()
+	return p.serverAddr
+}
+
+func (p *ForwarderService) DataRate() int {
+	p.condSuspend.L.Lock()
+	defer p.condSuspend.L.Unlock()
+	return p.dataRate
+}
+
+func (p *ForwarderService) IsSuspended() bool {
+	p.condSuspend.L.Lock()
+	defer p.condSuspend.L.Unlock()
+	return p.isSuspended
+}
+
+func (p *ForwarderService) NumForwarders() int {
+	p.muxFwdrs.Lock()
+	defer p.muxFwdrs.Unlock()
+	return p.fwdrs.Len()
 }
 
 func (p *ForwarderService) listener(ln *net.TCPListener) {
@@ -134,6 +195,8 @@ func (p *ForwarderService) listener(ln *net.TCPListener) {
 				p.condSuspend.Wait()
 			}
 		}
+		serverAddr := p.serverAddr
+		dataRate := p.dataRate
 		p.condSuspend.L.Unlock()
 		if err := ln.SetDeadline(time.Now().Add(FwdSvc_LnTimeoutDuration)); err != nil {
 			Logger.Warn("[Fwdsvc] ln.SetDeadline: " + err.Error())
@@ -152,12 +215,12 @@ func (p *ForwarderService) listener(ln *net.TCPListener) {
 		}
 		Logger.Debug("[Fwdsvc] Accept client conn: " + clientConn.RemoteAddr().String())
 		fwdr := NewForwarder()
-		fwdr.SetDataRate(p.dataRate)
+		fwdr.SetDataRate(dataRate)
 		p.muxFwdrs.Lock()
 		elem := p.fwdrs.PushBack(fwdr)
 		p.muxFwdrs.Unlock()
 		go func() {
-			fwdr.Accept(p.network, p.serverAddr, clientConn)
+			fwdr.Accept(p.network, serverAddr, clientConn)
 			p.muxFwdrs.Lock()
 			p.fwdrs.Remove(elem)
 			p.muxFwdrs.Unlock()
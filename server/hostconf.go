@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 
 	"github.com/pkg/errors"
@@ -16,6 +17,82 @@ type HostConf struct {
 	SSHLocalServerAddr   string `yaml:"sshLocalServerAddr"`
 	SSHUser              string `yaml:"sshUser"`
 	SSHKeyPath           string `yaml:"sshKeyPath"`
+	RegistryPath         string `yaml:"registryPath"`
+	DefaultNamespace     string `yaml:"defaultNamespace"`
+	PodFailurePolicy     string `yaml:"podFailurePolicy"`
+	// Kubeconfig is the path of the kubeconfig; the in-cluster config or ~/.kube/config is used if empty
+	Kubeconfig  string `yaml:"kubeconfig"`
+	KubeContext string `yaml:"kubeContext"`
+	// Clusters lists the clusters managed by this server; Kubeconfig and KubeContext are used if empty
+	Clusters       []ClusterConf `yaml:"clusters"`
+	DefaultCluster string        `yaml:"defaultCluster"`
+	// MigrationPortMin and MigrationPortMax are the range of the host ports allocated to the migrations
+	MigrationPortMin int `yaml:"migrationPortMin"`
+	MigrationPortMax int `yaml:"migrationPortMax"`
+	// MaxMigrations is the max number of the migrations to this host, and of the migrations from this
+	// host, running at once
+	MaxMigrations int `yaml:"maxMigrations"`
+	// TLS enables mutual TLS of the API server and the connections between the cloudlets; plain TCP if nil
+	TLS *TLSConf `yaml:"tls"`
+}
+
+type ClusterConf struct {
+	Name        string `yaml:"name"`
+	Kubeconfig  string `yaml:"kubeconfig"`
+	KubeContext string `yaml:"kubeContext"`
+}
+
+// TLSConf is the certificate of this cloudlet, used as both server and client, and the CA which
+// signs the certificates of the cloudlets and the API clients.
+type TLSConf struct {
+	CertPath string `yaml:"certPath"`
+	KeyPath  string `yaml:"keyPath"`
+	CAPath   string `yaml:"caPath"`
+	// AllowedPeers are the identities (common names or DNS names) of the cloudlets allowed to migrate
+	// apps to and from this cloudlet; any cloudlet signed by the CA is allowed if empty
+	AllowedPeers []string `yaml:"allowedPeers"`
+}
+
+const (
+	DefaultClusterName      = "default"
+	DefaultMigrationPortMin = 19900
+	DefaultMigrationPortMax = 19989
+	DefaultMaxMigrations    = 4
+)
+
+// GetClusters returns the clusters managed by this server.
+func (p *HostConf) GetClusters() []ClusterConf {
+	if len(p.Clusters) == 0 {
+		return []ClusterConf{{
+			Name:        DefaultClusterName,
+			Kubeconfig:  p.Kubeconfig,
+			KubeContext: p.KubeContext,
+		}}
+	}
+	return p.Clusters
+}
+
+// GetDefaultCluster returns the cluster used by the requests without cluster.
+func (p *HostConf) GetDefaultCluster() string {
+	if p.DefaultCluster != "" {
+		return p.DefaultCluster
+	}
+	return p.GetClusters()[0].Name
+}
+
+// GetMigrationPorts returns the range of the host ports allocated to the migrations.
+func (p *HostConf) GetMigrationPorts() (int, int) {
+	if p.MigrationPortMin == 0 && p.MigrationPortMax == 0 {
+		return DefaultMigrationPortMin, DefaultMigrationPortMax
+	}
+	return p.MigrationPortMin, p.MigrationPortMax
+}
+
+func (p *HostConf) GetMaxMigrations() int {
+	if p.MaxMigrations <= 0 {
+		return DefaultMaxMigrations
+	}
+	return p.MaxMigrations
 }
 
 func LoadHostConf() (*HostConf, error) {
@@ -32,5 +109,59 @@ func LoadHostConfFrom(path string) (*HostConf, error) {
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
+	if err := hostConf.validateClusters(); err != nil {
+		return nil, err
+	}
+	if err := hostConf.validateMigrations(); err != nil {
+		return nil, err
+	}
+	if err := hostConf.validateTLS(); err != nil {
+		return nil, err
+	}
 	return hostConf, nil
 }
+
+func (p *HostConf) validateClusters() error {
+	names := map[string]bool{}
+	for _, cluster := range p.Clusters {
+		if cluster.Name == "" {
+			return errors.New("clusters: name is required")
+		}
+		if names[cluster.Name] {
+			return errors.New("clusters: duplicate name: " + cluster.Name)
+		}
+		names[cluster.Name] = true
+	}
+	if p.DefaultCluster != "" && !names[p.DefaultCluster] {
+		if len(p.Clusters) > 0 || p.DefaultCluster != DefaultClusterName {
+			return errors.New("defaultCluster: unknown cluster: " + p.DefaultCluster)
+		}
+	}
+	return nil
+}
+
+func (p *HostConf) validateMigrations() error {
+	min, max := p.GetMigrationPorts()
+	if min < 1 || max > 65535 || min > max {
+		return errors.New(fmt.Sprintf("migrationPortMin, migrationPortMax: invalid port range: %d-%d", min, max))
+	}
+	if p.MaxMigrations < 0 {
+		return errors.New("maxMigrations: must not be negative")
+	}
+	return nil
+}
+
+func (p *HostConf) validateTLS() error {
+	if p.TLS == nil {
+		return nil
+	}
+	if p.TLS.CertPath == "" || p.TLS.KeyPath == "" || p.TLS.CAPath == "" {
+		return errors.New("tls: certPath, keyPath and caPath are required")
+	}
+	for _, peer := range p.TLS.AllowedPeers {
+		if peer == "" {
+			return errors.New("tls: allowedPeers: empty identity")
+		}
+	}
+	return nil
+}
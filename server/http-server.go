@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	HTTPPathDeployments = "/deployments"
+	HTTPPathMigrations  = "/migrations"
+	HTTPMaxBodySize     = 1024 * 1024
+)
+
+// StartHTTPServer serves the HTTP API at addr, with mutual TLS unless peerTLS is nil.
+func StartHTTPServer(addr string, peerTLS *PeerTLS, chanClose chan interface{}) {
+	ln, err := peerTLS.Listen(addr)
+	if err != nil {
+		panic(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(HTTPPathDeployments, handleDeployments)
+	mux.HandleFunc(HTTPPathDeployments+"/", handleDeployment)
+	mux.HandleFunc(HTTPPathMigrations, handleMigrations)
+	mux.HandleFunc(HTTPPathMigrations+"/", handleMigration)
+	srv := &http.Server{
+		Handler:     logHTTPRequest(mux),
+		ReadTimeout: RequestTimeout * time.Second,
+	}
+	go func() {
+		<-chanClose
+		srv.Close()
+	}()
+	if err := srv.Serve(ln); err != nil {
+		if err == http.ErrServerClosed {
+			Logger.Info("HTTP server close")
+		} else {
+			panic(err)
+		}
+	}
+}
+
+func logHTTPRequest(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Logger.InfoF("HTTP request: %s %s (%v)\n", r.Method, r.URL.Path, r.RemoteAddr)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// handleDeployments serves POST and GET on /deployments.
+func handleDeployments(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		req := &Request{Method: "deploy"}
+		if err := decodeHTTPBody(w, r, &req.Deploy); err != nil {
+			writeHTTPResponse(w, NewErrorResponse(err))
+			return
+		}
+		writeHTTPResponse(w, doRequest(req))
+	case http.MethodGet:
+		writeHTTPResponse(w, doRequest(&Request{Method: "list"}))
+	default:
+		writeHTTPMethodNotAllowed(w, http.MethodPost, http.MethodGet)
+	}
+}
+
+// handleDeployment serves GET and DELETE on /deployments/{name}.
+// The cluster is given by the query parameter "cluster"; the default cluster is used if omitted.
+func handleDeployment(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, HTTPPathDeployments+"/")
+	if name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodDelete:
+		req := &Request{Method: "remove"}
+		req.Remove.Name = name
+		req.Remove.Namespace = r.URL.Query().Get("namespace")
+		req.Remove.Cluster = r.URL.Query().Get("cluster")
+		writeHTTPResponse(w, doRequest(req))
+	case http.MethodGet:
+		req := &Request{Method: "status"}
+		req.Status.Name = name
+		req.Status.Namespace = r.URL.Query().Get("namespace")
+		req.Status.Cluster = r.URL.Query().Get("cluster")
+		writeHTTPResponse(w, doRequest(req))
+	default:
+		writeHTTPMethodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	}
+}
+
+// handleMigrations serves POST on /migrations. The body is a deploy request of type lm or fwdlm.
+func handleMigrations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeHTTPMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+	req := &Request{Method: "deploy"}
+	if err := decodeHTTPBody(w, r, &req.Deploy); err != nil {
+		writeHTTPResponse(w, NewErrorResponse(err))
+		return
+	}
+	if req.Deploy.Type != DeployTypeLM && req.Deploy.Type != DeployTypeFwdLM {
+		writeHTTPResponse(w, NewErrorResponse(NewAPIError(ErrCodeBadRequest,
+			errors.New("Migration type must be lm or fwdlm: "+req.Deploy.Type))))
+		return
+	}
+	writeHTTPResponse(w, doRequest(req))
+}
+
+// handleMigration serves GET and DELETE on /migrations/{id}. DELETE cancels the migration.
+func handleMigration(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, HTTPPathMigrations+"/")
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		req := &Request{Method: "migration-status"}
+		req.MigrationStatus.ID = id
+		writeHTTPResponse(w, doRequest(req))
+	case http.MethodDelete:
+		req := &Request{Method: "migration-cancel"}
+		req.MigrationCancel.ID = id
+		writeHTTPResponse(w, doRequest(req))
+	default:
+		writeHTTPMethodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	}
+}
+
+func decodeHTTPBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, HTTPMaxBodySize))
+	if err := dec.Decode(v); err != nil {
+		return NewAPIError(ErrCodeBadRequest, errors.WithStack(err))
+	}
+	return nil
+}
+
+func writeHTTPResponse(w http.ResponseWriter, resp *Response) {
+	writeHTTPResponseStatus(w, httpStatusOf(resp), resp)
+}
+
+func writeHTTPResponseStatus(w http.ResponseWriter, status int, resp *Response) {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		Logger.ErrorE(errors.WithStack(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(append(b, '\n')); err != nil {
+		Logger.ErrorE(errors.WithStack(err))
+	}
+}
+
+func writeHTTPMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeHTTPResponseStatus(w, http.StatusMethodNotAllowed, &Response{
+		Ok:   false,
+		Code: ErrCodeUnsupported,
+		Msg:  "Method not allowed",
+	})
+}
+
+func httpStatusOf(resp *Response) int {
+	if resp.Ok {
+		return http.StatusOK
+	}
+	switch resp.Code {
+	case ErrCodeBadRequest:
+		return http.StatusBadRequest
+	case ErrCodeUnsupported:
+		return http.StatusNotImplemented
+	case ErrCodeNotFound:
+		return http.StatusNotFound
+	case ErrCodeForbidden:
+		return http.StatusForbidden
+	case ErrCodeAlreadyExists, ErrCodeInvalidState:
+		return http.StatusConflict
+	case ErrCodeKubeError, ErrCodePodFailed, ErrCodeImagePull:
+		return http.StatusBadGateway
+	case ErrCodePodNotReady, ErrCodeTooManyMigrations:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
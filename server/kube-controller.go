@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	watchtools "k8s.io/client-go/tools/watch"
+)
+
+const (
+	ControllerPod         = "pod"
+	ControllerDeployment  = "deployment"
+	ControllerStatefulSet = "statefulset"
+)
+
+func CreateDeployment(
+	clientset kubernetes.Interface,
+	namespace string,
+	deploymentName string,
+	label string,
+	replicas int32,
+	template *apiv1.PodTemplateSpec,
+) (*appsv1.Deployment, error, error) {
+	deployment := &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Deployment",
+			APIVersion: "apps/v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      deploymentName,
+			Namespace: namespace,
+			Labels:    map[string]string{"app": label},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": label},
+			},
+			Template: *template,
+		},
+	}
+	result, err := clientset.AppsV1().Deployments(namespace).
+		Create(context.TODO(), deployment, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err, errors.WithStack(err)
+	}
+	return result, nil, nil
+}
+
+func GetDeployment(
+	clientset kubernetes.Interface,
+	namespace string,
+	deploymentName string,
+) (*appsv1.Deployment, error, error) {
+	deployment, err := clientset.AppsV1().Deployments(namespace).
+		Get(context.TODO(), deploymentName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err, errors.WithStack(err)
+	}
+	return deployment, nil, nil
+}
+
+func DeleteDeployment(
+	clientset kubernetes.Interface,
+	namespace string,
+	deploymentName string,
+) (error, error) {
+	propagation := metav1.DeletePropagationBackground
+	err := clientset.AppsV1().Deployments(namespace).Delete(
+		context.TODO(), deploymentName, metav1.DeleteOptions{PropagationPolicy: &propagation})
+	if err != nil {
+		return err, errors.WithStack(err)
+	}
+	return nil, nil
+}
+
+// CreateHeadlessService creates the headless service which governs a StatefulSet.
+// It gives the pods of the StatefulSet their DNS names.
+func CreateHeadlessService(
+	clientset kubernetes.Interface,
+	namespace string,
+	serviceName string,
+	label string,
+	ports []PortSpec,
+) (*apiv1.Service, error, error) {
+	return createService(clientset, namespace, serviceName, label, serviceName, ports, apiv1.ClusterIPNone)
+}
+
+// CreateStatefulSet creates a StatefulSet whose governing service is serviceName, which must be
+// a headless service created by CreateHeadlessService.
+// Its pods are named <statefulSetName>-<ordinal>.
+func CreateStatefulSet(
+	clientset kubernetes.Interface,
+	namespace string,
+	statefulSetName string,
+	serviceName string,
+	label string,
+	replicas int32,
+	template *apiv1.PodTemplateSpec,
+) (*appsv1.StatefulSet, error, error) {
+	statefulSet := &appsv1.StatefulSet{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "StatefulSet",
+			APIVersion: "apps/v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      statefulSetName,
+			Namespace: namespace,
+			Labels:    map[string]string{"app": label},
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:    &replicas,
+			ServiceName: serviceName,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": label},
+			},
+			Template: *template,
+		},
+	}
+	result, err := clientset.AppsV1().StatefulSets(namespace).
+		Create(context.TODO(), statefulSet, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err, errors.WithStack(err)
+	}
+	return result, nil, nil
+}
+
+func GetStatefulSet(
+	clientset kubernetes.Interface,
+	namespace string,
+	statefulSetName string,
+) (*appsv1.StatefulSet, error, error) {
+	statefulSet, err := clientset.AppsV1().StatefulSets(namespace).
+		Get(context.TODO(), statefulSetName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err, errors.WithStack(err)
+	}
+	return statefulSet, nil, nil
+}
+
+func DeleteStatefulSet(
+	clientset kubernetes.Interface,
+	namespace string,
+	statefulSetName string,
+) (error, error) {
+	propagation := metav1.DeletePropagationBackground
+	err := clientset.AppsV1().StatefulSets(namespace).Delete(
+		context.TODO(), statefulSetName, metav1.DeleteOptions{PropagationPolicy: &propagation})
+	if err != nil {
+		return err, errors.WithStack(err)
+	}
+	return nil, nil
+}
+
+// ListPods returns the pods labeled with "app": label, including the pods of the controllers.
+func ListPods(
+	clientset kubernetes.Interface,
+	namespace string,
+	label string,
+) ([]apiv1.Pod, error) {
+	selector := labels.SelectorFromSet(labels.Set{"app": label}).String()
+	pods, err := clientset.CoreV1().Pods(namespace).
+		List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return pods.Items, nil
+}
+
+// WaitForPodsReady waits for the given number of the pods labeled with "app": label to be ready.
+func WaitForPodsReady(
+	clientset kubernetes.Interface,
+	namespace string,
+	label string,
+	replicas int,
+	timeout time.Duration,
+) error {
+	err := waitForPods(clientset, namespace, label, timeout, func(pods map[string]*apiv1.Pod) (bool, error) {
+		numReady := 0
+		for _, pod := range pods {
+			if pod.DeletionTimestamp != nil {
+				continue
+			}
+			ready, err := podReadyCond(pod)
+			if err != nil {
+				return false, err
+			}
+			if ready {
+				numReady++
+			}
+		}
+		return numReady >= replicas, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return errors.Errorf("Timed out waiting for %d pods of %s to be ready", replicas, label)
+	}
+	return err
+}
+
+// WaitForPodsDeleted waits for all the pods labeled with "app": label to be deleted.
+func WaitForPodsDeleted(
+	clientset kubernetes.Interface,
+	namespace string,
+	label string,
+	timeout time.Duration,
+) error {
+	err := waitForPods(clientset, namespace, label, timeout, func(pods map[string]*apiv1.Pod) (bool, error) {
+		return len(pods) == 0, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return errors.Errorf("Timed out waiting for pods of %s to be deleted", label)
+	}
+	return err
+}
+
+// waitForPods watches the pods labeled with "app": label until cond returns true or an error.
+// cond is called with the current pods keyed by name every time any of them changes.
+func waitForPods(
+	clientset kubernetes.Interface,
+	namespace string,
+	label string,
+	timeout time.Duration,
+	cond func(pods map[string]*apiv1.Pod) (bool, error),
+) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	selector := labels.SelectorFromSet(labels.Set{"app": label}).String()
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = selector
+			return clientset.CoreV1().Pods(namespace).List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = selector
+			return clientset.CoreV1().Pods(namespace).Watch(ctx, options)
+		},
+	}
+	pods := map[string]*apiv1.Pod{}
+	precondition := func(store cache.Store) (bool, error) {
+		for _, obj := range store.List() {
+			if pod, ok := obj.(*apiv1.Pod); ok {
+				pods[pod.Name] = pod
+			}
+		}
+		return cond(pods)
+	}
+	_, err := watchtools.UntilWithSync(ctx, lw, &apiv1.Pod{}, precondition, func(event watch.Event) (bool, error) {
+		pod, ok := event.Object.(*apiv1.Pod)
+		if !ok {
+			return false, nil
+		}
+		switch event.Type {
+		case watch.Added, watch.Modified:
+			pods[pod.Name] = pod
+		case watch.Deleted:
+			delete(pods, pod.Name)
+		default:
+			return false, nil
+		}
+		return cond(pods)
+	})
+	return err
+}
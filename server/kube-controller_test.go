@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newTestReplica(name string, ready bool) *apiv1.Pod {
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: DefaultNamespace,
+			Labels:    map[string]string{"app": "app"},
+		},
+		Spec: apiv1.PodSpec{
+			Containers:    []apiv1.Container{{Name: "app"}},
+			RestartPolicy: apiv1.RestartPolicyAlways,
+		},
+		Status: apiv1.PodStatus{Phase: apiv1.PodPending},
+	}
+	if ready {
+		setPodReady(pod)
+	}
+	return pod
+}
+
+// waitTestPods runs wait and keeps applying update to the pods until wait returns,
+// since the events before the watch starts are not sent by the fake clientset.
+func waitTestPods(t *testing.T, wait func() error, update func()) error {
+	chanErr := make(chan error, 1)
+	go func() {
+		chanErr <- wait()
+	}()
+	for {
+		select {
+		case err := <-chanErr:
+			return err
+		case <-time.After(50 * time.Millisecond):
+			if update != nil {
+				update()
+			}
+		}
+	}
+}
+
+func TestWaitForPodsReady(t *testing.T) {
+	clientset := fake.NewSimpleClientset(newTestReplica("app-0", true), newTestReplica("app-1", false))
+	pods := clientset.CoreV1().Pods(DefaultNamespace)
+	err := waitTestPods(t, func() error {
+		return WaitForPodsReady(clientset, DefaultNamespace, "app", 2, 5*time.Second)
+	}, func() {
+		if _, err := pods.UpdateStatus(context.TODO(), newTestReplica("app-1", true), metav1.UpdateOptions{}); err != nil {
+			t.Error(err)
+		}
+	})
+	if err != nil {
+		t.Errorf("wait for ready pods: %v", err)
+	}
+}
+
+func TestWaitForPodsReadyFailed(t *testing.T) {
+	clientset := fake.NewSimpleClientset(newTestReplica("app-0", true), newTestReplica("app-1", false))
+	pods := clientset.CoreV1().Pods(DefaultNamespace)
+	err := waitTestPods(t, func() error {
+		return WaitForPodsReady(clientset, DefaultNamespace, "app", 2, 5*time.Second)
+	}, func() {
+		pod := newTestReplica("app-1", false)
+		pod.Status.ContainerStatuses = []apiv1.ContainerStatus{{Name: "app", State: waitingState("ImagePullBackOff")}}
+		if _, err := pods.UpdateStatus(context.TODO(), pod, metav1.UpdateOptions{}); err != nil {
+			t.Error(err)
+		}
+	})
+	if podErr, ok := err.(*PodFailedError); !ok || !podErr.ImagePull {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestWaitForPodsReadyTimeout(t *testing.T) {
+	clientset := fake.NewSimpleClientset(newTestReplica("app-0", true))
+	err := WaitForPodsReady(clientset, DefaultNamespace, "app", 2, 200*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "Timed out") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+// addTestControllerReactors makes the controllers of clientset create their ready pods,
+// and delete them as the garbage collector does.
+func addTestControllerReactors(t *testing.T, clientset *fake.Clientset) {
+	for _, resource := range []string{"deployments", "statefulsets"} {
+		clientset.PrependReactor("create", resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+			var name string
+			var replicas int32
+			var template apiv1.PodTemplateSpec
+			switch obj := action.(k8stesting.CreateAction).GetObject().(type) {
+			case *appsv1.Deployment:
+				name, replicas, template = obj.Name, *obj.Spec.Replicas, obj.Spec.Template
+			case *appsv1.StatefulSet:
+				name, replicas, template = obj.Name, *obj.Spec.Replicas, obj.Spec.Template
+			}
+			for i := 0; i < int(replicas); i++ {
+				pod := &apiv1.Pod{ObjectMeta: template.ObjectMeta, Spec: template.Spec}
+				pod.Name = fmt.Sprintf("%s-%d", name, i)
+				pod.Namespace = action.GetNamespace()
+				setPodReady(pod)
+				if err := clientset.Tracker().Add(pod); err != nil && !k8serrors.IsAlreadyExists(err) {
+					t.Error(err)
+				}
+			}
+			return false, nil, nil
+		})
+		clientset.PrependReactor("delete", resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+			pods, err := clientset.Tracker().List(apiv1.SchemeGroupVersion.WithResource("pods"),
+				apiv1.SchemeGroupVersion.WithKind("Pod"), action.GetNamespace())
+			if err != nil {
+				return true, nil, err
+			}
+			name := action.(k8stesting.DeleteAction).GetName()
+			for _, pod := range pods.(*apiv1.PodList).Items {
+				if strings.HasPrefix(pod.Name, name+"-") {
+					clientset.Tracker().Delete(apiv1.SchemeGroupVersion.WithResource("pods"), pod.Namespace, pod.Name)
+				}
+			}
+			return false, nil, nil
+		})
+	}
+}
+
+func TestDeployNewStatefulSet(t *testing.T) {
+	core, clientset := newTestAPICore(t)
+	addTestControllerReactors(t, clientset)
+	req := newTestDeployRequest("app", PortSpec{In: 8888, Ext: 0})
+	req.Deploy.NewApp.Controller = ControllerStatefulSet
+	req.Deploy.NewApp.Replicas = 2
+	resp, err := core.Deploy(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Controller != "app-sts" || resp.ClusterIP != testClusterIP {
+		t.Errorf("resp = %+v", resp)
+	}
+	sts, err := clientset.AppsV1().StatefulSets(DefaultNamespace).Get(context.TODO(), "app-sts", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sts.Spec.ServiceName != "app-hl" || *sts.Spec.Replicas != 2 {
+		t.Errorf("statefulset spec = %+v", sts.Spec)
+	}
+	headless, err := clientset.CoreV1().Services(DefaultNamespace).Get(context.TODO(), "app-hl", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headless.Spec.ClusterIP != apiv1.ClusterIPNone || headless.Spec.Selector["app"] != "app" {
+		t.Errorf("headless service spec = %+v", headless.Spec)
+	}
+	statusResp, err := core.Status(&Request{Status: RequestStatus{Name: "app"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := statusResp.Deployments[0]; status.Replicas != 2 || status.ReadyReplicas != 2 {
+		t.Errorf("status = %+v", status)
+	}
+	if _, err := core.Remove(newTestRemoveRequest("app")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"app-svc", "app-hl"} {
+		if _, err := clientset.CoreV1().Services(DefaultNamespace).Get(context.TODO(), name,
+			metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+			t.Errorf("service %s is not deleted: %v", name, err)
+		}
+	}
+	if _, err := clientset.AppsV1().StatefulSets(DefaultNamespace).Get(context.TODO(), "app-sts",
+		metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+		t.Errorf("statefulset is not deleted: %v", err)
+	}
+}
+
+func TestDeployNewDeployment(t *testing.T) {
+	core, clientset := newTestAPICore(t)
+	addTestControllerReactors(t, clientset)
+	req := newTestDeployRequest("app", PortSpec{In: 8888, Ext: 0})
+	req.Deploy.NewApp.Controller = ControllerDeployment
+	req.Deploy.NewApp.Replicas = 3
+	resp, err := core.Deploy(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Controller != "app-deploy" {
+		t.Errorf("resp = %+v", resp)
+	}
+	// Deploying again uses the existing deployment
+	if _, err := core.Deploy(req); err != nil {
+		t.Fatal(err)
+	}
+	if pods, err := ListPods(clientset, DefaultNamespace, "app"); err != nil || len(pods) != 3 {
+		t.Errorf("pods = %v, %v", pods, err)
+	}
+	if n := countActions(clientset, "create", "services"); n != 1 {
+		t.Errorf("services created = %d, want 1", n)
+	}
+	if _, err := core.Remove(newTestRemoveRequest("app")); err != nil {
+		t.Fatal(err)
+	}
+	if pods, err := ListPods(clientset, DefaultNamespace, "app"); err != nil || len(pods) != 0 {
+		t.Errorf("pods after remove = %v, %v", pods, err)
+	}
+}
+
+func TestDumpStartChecksContainer(t *testing.T) {
+	other := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "other-sts-0", Namespace: DefaultNamespace},
+		Spec:       apiv1.PodSpec{Containers: []apiv1.Container{{Name: ToContainerName("other")}}},
+	}
+	core, _ := newTestAPICore(t, other)
+	for _, tc := range []struct {
+		pod  string
+		code string
+	}{
+		{"other-sts-0", ErrCodeBadRequest},
+		{"app-sts-0", ErrCodeNotFound},
+	} {
+		req := &Request{Method: "_dumpStart"}
+		req.DumpStart.Name = "app"
+		req.DumpStart.Pod = tc.pod
+		req.DumpStart.DstAddr = "127.0.0.1"
+		if _, err := core.DumpStart(req); ErrorCodeOf(err) != tc.code {
+			t.Errorf("%s: err = %v", tc.pod, err)
+		}
+	}
+}
+
+func TestDumpStartRejectsKubeletCheckpointOfControllerPod(t *testing.T) {
+	isController := true
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-sts-0",
+			Namespace: DefaultNamespace,
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: "StatefulSet", Name: "app-sts", Controller: &isController},
+			},
+		},
+		Spec: apiv1.PodSpec{Containers: []apiv1.Container{{Name: ToContainerName("app")}}},
+	}
+	core, _ := newTestAPICore(t, pod)
+	deploy := newTestDeployRequest("app", PortSpec{In: 8888, Ext: 0}).Deploy
+	deploy.Cluster = DefaultClusterName
+	deploy.Namespace = DefaultNamespace
+	deploy.NewApp.Checkpoint = CheckpointKubelet
+	if err := core.Registry.Put(&deploy); err != nil {
+		t.Fatal(err)
+	}
+	req := &Request{Method: "_dumpStart"}
+	req.DumpStart.Name = "app"
+	req.DumpStart.Pod = "app-sts-0"
+	req.DumpStart.DstAddr = "127.0.0.1"
+	if _, err := core.DumpStart(req); ErrorCodeOf(err) != ErrCodeBadRequest {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestDumpStartDoesNotTakeMigrationSlot(t *testing.T) {
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-pod", Namespace: DefaultNamespace},
+		Spec:       apiv1.PodSpec{Containers: []apiv1.Container{{Name: ToContainerName("app")}}},
+	}
+	core, _ := newTestAPICore(t, pod)
+	// The restore of a migration between the clusters of this host holds the only migration slot,
+	// and no ports are available, so that the dump fails after taking its slot
+	core.migrationSlots = NewMigrationSlots(1)
+	core.migrationSlots.TryAcquire()
+	core.dumpSlots = NewMigrationSlots(1)
+	core.migrationPorts = NewPortAllocator(1, 0)
+	req := &Request{Method: "_dumpStart"}
+	req.DumpStart.Name = "app"
+	req.DumpStart.DstAddr = "127.0.0.1"
+	if _, err := core.DumpStart(req); err == nil || !strings.Contains(err.Error(), "No port available") {
+		t.Errorf("err = %v", err)
+	}
+	if !core.dumpSlots.TryAcquire() {
+		t.Fatal("dump slot is not released")
+	}
+	if _, err := core.DumpStart(req); ErrorCodeOf(err) != ErrCodeTooManyMigrations {
+		t.Errorf("err with all dump slots taken = %v", err)
+	}
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
 
@@ -108,6 +112,33 @@ func ReadPodFile(
 	return v, nil
 }
 
+// PodDirSize returns the disk usage of the directory in the container in bytes.
+func PodDirSize(
+	clientset kubernetes.Interface,
+	config *rest.Config,
+	namespace string,
+	podName string,
+	containerName string,
+	stderr io.Writer,
+	path string,
+) (int64, error) {
+	stdout := &bytes.Buffer{}
+	cmd := []string{"/bin/sh", "-c", fmt.Sprintf("du -sk %s", path)}
+	if err := ExecutePod(clientset, config, namespace, podName, containerName,
+		nil, stdout, stderr, cmd...); err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(stdout.String())
+	if len(fields) == 0 {
+		return 0, errors.New("Unexpected output of du: " + stdout.String())
+	}
+	kib, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return kib * 1024, nil
+}
+
 func WritePodFile(
 	clientset kubernetes.Interface,
 	config *rest.Config,
@@ -132,3 +163,31 @@ func WritePodFile(
 	}
 	return nil
 }
+
+// CheckpointContainer checkpoints the container with the checkpoint API of the kubelet of the node
+// through the API server, and returns the paths of the checkpoint archives on the node.
+// The container keeps running.
+func CheckpointContainer(
+	clientset kubernetes.Interface,
+	nodeName string,
+	namespace string,
+	podName string,
+	containerName string,
+) ([]string, error) {
+	b, err := clientset.CoreV1().RESTClient().Post().
+		AbsPath("/api/v1/nodes", nodeName, "proxy", "checkpoint", namespace, podName, containerName).
+		Do(context.TODO()).Raw()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	resp := struct {
+		Items []string `json:"items"`
+	}{}
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(resp.Items) == 0 {
+		return nil, errors.New("Kubelet returned no checkpoint archive")
+	}
+	return resp.Items, nil
+}
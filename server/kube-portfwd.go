@@ -13,10 +13,12 @@ import (
 	"k8s.io/client-go/transport/spdy"
 )
 
+// NewKubePortForward forwards localPort of address to podPort of the pod.
 func NewKubePortForward(
 	config *rest.Config,
 	namespace string,
 	podName string,
+	address string,
 	localPort int,
 	podPort int,
 	out io.Writer,
@@ -27,7 +29,7 @@ func NewKubePortForward(
 	path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/portforward", namespace, podName)
 	host := strings.TrimLeft(config.Host, "htps:/")
 	url := url.URL{Scheme: "https", Path: path, Host: host}
-	addrs := []string{"0.0.0.0"}
+	addrs := []string{address}
 	ports := []string{fmt.Sprintf("%d:%d", localPort, podPort)}
 	transport, upgrader, err := spdy.RoundTripperFor(config)
 	if err != nil {
@@ -40,6 +42,8 @@ func NewKubePortForward(
 	return portForwarder, errors.WithStack(err)
 }
 
+// OpenKubePortForwardReady forwards localPort of all the addresses of this host to podPort of the
+// pod until stopChan is closed, and waits for it to be ready.
 func OpenKubePortForwardReady(
 	config *rest.Config,
 	namespace string,
@@ -50,12 +54,51 @@ func OpenKubePortForwardReady(
 	errOut io.Writer,
 	stopChan chan struct{},
 ) error {
+	_, err := openKubePortForward(config, namespace, podName, "0.0.0.0", localPort, podPort,
+		out, errOut, stopChan)
+	return err
+}
+
+// OpenKubePortForwardLoopback forwards a free port of the loopback address to podPort of the pod
+// until stopChan is closed, and returns the port when it is ready.
+func OpenKubePortForwardLoopback(
+	config *rest.Config,
+	namespace string,
+	podName string,
+	podPort int,
+	out io.Writer,
+	errOut io.Writer,
+	stopChan chan struct{},
+) (int, error) {
+	kubePortFwd, err := openKubePortForward(config, namespace, podName, "127.0.0.1", 0, podPort,
+		out, errOut, stopChan)
+	if err != nil {
+		return 0, err
+	}
+	ports, err := kubePortFwd.GetPorts()
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return int(ports[0].Local), nil
+}
+
+func openKubePortForward(
+	config *rest.Config,
+	namespace string,
+	podName string,
+	address string,
+	localPort int,
+	podPort int,
+	out io.Writer,
+	errOut io.Writer,
+	stopChan chan struct{},
+) (*portforward.PortForwarder, error) {
 	readyChan := make(chan struct{}, 1)
 	errorChan := make(chan error, 1)
-	kubePortFwd, err := NewKubePortForward(config, namespace, podName, localPort, podPort,
+	kubePortFwd, err := NewKubePortForward(config, namespace, podName, address, localPort, podPort,
 		out, errOut, stopChan, readyChan)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	go func() {
 		if err := kubePortFwd.ForwardPorts(); err != nil {
@@ -66,7 +109,7 @@ func OpenKubePortForwardReady(
 	select {
 	case <-readyChan:
 	case err := <-errorChan:
-		return err
+		return nil, err
 	}
-	return nil
+	return kubePortFwd, nil
 }
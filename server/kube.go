@@ -2,46 +2,175 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/pkg/errors"
 
 	apiv1 "k8s.io/api/core/v1"
-	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	watchtools "k8s.io/client-go/tools/watch"
 )
 
 const (
-	PollInterval = 100 * time.Millisecond
+	DefaultNamespace = "default"
+	PodReasonDeleted = "Deleted"
+	// ManagedByLabel is set on the pods created by this server so that they can be watched
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	ManagedBy      = "container-cloudlet"
 )
 
-func NewClient() (kubernetes.Interface, *rest.Config, error) {
-	config, err := clientcmd.BuildConfigFromFlags("", clientcmd.RecommendedHomeFile)
+// KubeClient is the Kubernetes client of a cluster.
+type KubeClient struct {
+	Name      string
+	Clientset kubernetes.Interface
+	Config    *rest.Config
+}
+
+// NewKubeClients creates the Kubernetes clients of the clusters in hostConf.
+func NewKubeClients(hostConf *HostConf) ([]*KubeClient, error) {
+	var clients []*KubeClient
+	for _, cluster := range hostConf.GetClusters() {
+		clientset, config, err := NewClient(cluster.Kubeconfig, cluster.KubeContext)
+		if err != nil {
+			return nil, errors.WithMessage(err, "cluster "+cluster.Name)
+		}
+		clients = append(clients, &KubeClient{
+			Name:      cluster.Name,
+			Clientset: clientset,
+			Config:    config,
+		})
+	}
+	return clients, nil
+}
+
+// NewClient creates the Kubernetes client from the kubeconfig and context.
+// If no kubeconfig is given, the in-cluster config is used when running in a pod,
+// and ~/.kube/config otherwise.
+func NewClient(kubeconfig string, kubeContext string) (kubernetes.Interface, *rest.Config, error) {
+	config, err := NewRestConfig(kubeconfig, kubeContext)
 	if err != nil {
 		return nil, nil, err
 	}
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, errors.WithStack(err)
 	}
 	return clientset, config, nil
 }
 
+func NewRestConfig(kubeconfig string, kubeContext string) (*rest.Config, error) {
+	if kubeconfig == "" && kubeContext == "" {
+		if config, err := rest.InClusterConfig(); err == nil {
+			Logger.Info("Use in-cluster config")
+			return config, nil
+		} else if err != rest.ErrNotInCluster {
+			return nil, errors.WithStack(err)
+		}
+	}
+	loadingRules := &clientcmd.ClientConfigLoadingRules{
+		ExplicitPath: kubeconfig,
+	}
+	if loadingRules.ExplicitPath == "" {
+		loadingRules.ExplicitPath = clientcmd.RecommendedHomeFile
+	}
+	overrides := &clientcmd.ConfigOverrides{
+		CurrentContext: kubeContext,
+	}
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides).ClientConfig()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	Logger.InfoF("Use kubeconfig: %s (context: %s)\n", loadingRules.ExplicitPath, kubeContext)
+	return config, nil
+}
+
+// NewClusterClientFactory returns ClientFactory which returns the client of the named cluster.
+func NewClusterClientFactory(clients []*KubeClient) ClientFactory {
+	clientmap := map[string]*KubeClient{}
+	for _, client := range clients {
+		clientmap[client.Name] = client
+	}
+	return func(cluster string) (kubernetes.Interface, *rest.Config, error) {
+		client, ok := clientmap[cluster]
+		if !ok {
+			return nil, nil, NewAPIError(ErrCodeBadRequest, errors.New("Unknown cluster: "+cluster))
+		}
+		return client.Clientset, client.Config, nil
+	}
+}
+
+// NewSharedClientFactory returns ClientFactory of the single cluster DefaultClusterName.
+func NewSharedClientFactory(clientset kubernetes.Interface, config *rest.Config) ClientFactory {
+	return NewClusterClientFactory([]*KubeClient{{
+		Name:      DefaultClusterName,
+		Clientset: clientset,
+		Config:    config,
+	}})
+}
+
 func CreatePod(
 	clientset kubernetes.Interface,
+	namespace string,
 	podName string,
 	label string,
 	containerName string,
 	image string,
-	containerPort int32,
+	ports []PortSpec,
 	env map[string]string,
 	command []string,
 	args []string,
+	opts *PodOptions,
 ) (*apiv1.Pod, error, error) {
+	template := NewPodTemplate(label, containerName, image, ports, env, command, args, opts)
+	template.ObjectMeta.Name = podName
+	template.ObjectMeta.Namespace = namespace
+	template.Spec.RestartPolicy = apiv1.RestartPolicyNever
+	pod := &apiv1.Pod{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Pod",
+			APIVersion: "v1",
+		},
+		ObjectMeta: template.ObjectMeta,
+		Spec:       template.Spec,
+	}
+	result, err := clientset.CoreV1().Pods(namespace).
+		Create(context.TODO(), pod, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err, errors.WithStack(err)
+	}
+	return result, nil, nil
+}
+
+// NewPodTemplate returns the pod of the app labeled with "app": label.
+// It is used as is by the controllers and with RestartPolicyNever by CreatePod.
+func NewPodTemplate(
+	label string,
+	containerName string,
+	image string,
+	ports []PortSpec,
+	env map[string]string,
+	command []string,
+	args []string,
+	opts *PodOptions,
+) *apiv1.PodTemplateSpec {
+	if opts == nil {
+		opts = &PodOptions{}
+	}
+	labels := map[string]string{}
+	for k, v := range opts.Labels {
+		labels[k] = v
+	}
+	labels["app"] = label
+	labels[ManagedByLabel] = ManagedBy
 	var envVars []apiv1.EnvVar
 	for k, v := range env {
 		envVars = append(envVars, apiv1.EnvVar{
@@ -49,16 +178,19 @@ func CreatePod(
 			Value: v,
 		})
 	}
+	var containerPorts []apiv1.ContainerPort
+	for _, port := range ports {
+		containerPorts = append(containerPorts, apiv1.ContainerPort{
+			ContainerPort: int32(port.In),
+			Protocol:      apiv1.Protocol(port.GetProtocol()),
+		})
+	}
 	shareProcessNamespace := true
 	privileded := true
-	pod := &apiv1.Pod{
-		TypeMeta: metav1.TypeMeta{
-			Kind:       "Pod",
-			APIVersion: "v1",
-		},
+	return &apiv1.PodTemplateSpec{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:   podName,
-			Labels: map[string]string{"app": label},
+			Labels:      labels,
+			Annotations: opts.Annotations,
 		},
 		Spec: apiv1.PodSpec{
 			Containers: []apiv1.Container{
@@ -68,39 +200,36 @@ func CreatePod(
 					ImagePullPolicy: "Always",
 					Command:         command,
 					Args:            args,
-					Ports: []apiv1.ContainerPort{
-						{
-							ContainerPort: containerPort,
-						},
-					},
-					Env: envVars,
+					Ports:           containerPorts,
+					Env:             envVars,
+					Resources:       opts.Resources,
+					VolumeMounts:    opts.VolumeMounts,
+					ReadinessProbe:  opts.ReadinessProbe,
 					SecurityContext: &apiv1.SecurityContext{
 						Privileged: &privileded,
 					},
 				},
 			},
+			NodeSelector:          opts.NodeSelector,
+			Tolerations:           opts.Tolerations,
+			Volumes:               opts.Volumes,
 			ShareProcessNamespace: &shareProcessNamespace,
 			ImagePullSecrets: []apiv1.LocalObjectReference{
 				{
 					Name: "regcred",
 				},
 			},
-			RestartPolicy: apiv1.RestartPolicyNever,
+			RestartPolicy: apiv1.RestartPolicyAlways,
 		},
 	}
-	result, err := clientset.CoreV1().Pods("default").
-		Create(context.TODO(), pod, metav1.CreateOptions{})
-	if err != nil {
-		return nil, err, errors.WithStack(err)
-	}
-	return result, nil, nil
 }
 
 func GetPod(
 	clientset kubernetes.Interface,
+	namespace string,
 	podName string,
 ) (*apiv1.Pod, error, error) {
-	pod, err := clientset.CoreV1().Pods("default").Get(
+	pod, err := clientset.CoreV1().Pods(namespace).Get(
 		context.TODO(), podName, metav1.GetOptions{})
 	if err != nil {
 		return nil, err, errors.WithStack(err)
@@ -110,9 +239,9 @@ func GetPod(
 
 func DeletePod(
 	clientset kubernetes.Interface,
+	namespace string,
 	podName string,
 ) (error, error) {
-	namespace := "default"
 	err := clientset.CoreV1().Pods(namespace).Delete(
 		context.TODO(), podName, metav1.DeleteOptions{})
 	if err != nil {
@@ -121,78 +250,273 @@ func DeletePod(
 	return nil, nil
 }
 
-func IsPodReady(clientset kubernetes.Interface, podName string) (bool, error) {
-	pod, err, _ := GetPod(clientset, podName)
-	if err != nil {
+// PodFailedError is returned while waiting for a pod which can never become ready,
+// e.g. the pod has terminated or its image cannot be pulled.
+type PodFailedError struct {
+	PodName   string
+	Reason    string
+	Message   string
+	ImagePull bool
+}
+
+func (p *PodFailedError) Error() string {
+	msg := fmt.Sprintf("Pod %s failed: %s", p.PodName, p.Reason)
+	if p.Message != "" {
+		msg += ": " + p.Message
+	}
+	return msg
+}
+
+// podReadyCond returns true if all the containers are running and the pod has the Ready condition.
+// The readiness probes of the containers are taken into account by the Ready condition.
+func podReadyCond(pod *apiv1.Pod) (bool, error) {
+	if err := checkPodFailed(pod); err != nil {
 		return false, err
 	}
-	ans := (pod.Status.Phase != apiv1.PodPending)
-	return ans, nil
+	return isPodRunning(pod) && isPodConditionReady(pod), nil
 }
 
+func isPodConditionReady(pod *apiv1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == apiv1.PodReady {
+			return cond.Status == apiv1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// podRunningCond returns true if all the containers are running regardless of their readiness.
+func podRunningCond(pod *apiv1.Pod) (bool, error) {
+	if err := checkPodFailed(pod); err != nil {
+		return false, err
+	}
+	return isPodRunning(pod), nil
+}
+
+func isPodRunning(pod *apiv1.Pod) bool {
+	if pod.Status.Phase != apiv1.PodRunning {
+		return false
+	}
+	if len(pod.Status.ContainerStatuses) < len(pod.Spec.Containers) {
+		return false
+	}
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.State.Running == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func checkPodFailed(pod *apiv1.Pod) error {
+	podName := pod.GetName()
+	if pod.Status.Phase == apiv1.PodFailed || pod.Status.Phase == apiv1.PodSucceeded {
+		reason := pod.Status.Reason
+		if reason == "" {
+			reason = "Terminated with phase " + string(pod.Status.Phase)
+		}
+		return &PodFailedError{PodName: podName, Reason: reason, Message: pod.Status.Message}
+	}
+	for _, cs := range pod.Status.InitContainerStatuses {
+		if t := cs.State.Terminated; t != nil && t.ExitCode != 0 {
+			return &PodFailedError{PodName: podName, Reason: t.Reason,
+				Message: fmt.Sprintf("init container %s exited with %d", cs.Name, t.ExitCode)}
+		}
+		if err := checkContainerWaiting(podName, &cs); err != nil {
+			return err
+		}
+	}
+	for _, cs := range pod.Status.ContainerStatuses {
+		// The containers of controller pods are restarted by the kubelet
+		if t := cs.State.Terminated; t != nil && pod.Spec.RestartPolicy == apiv1.RestartPolicyNever {
+			return &PodFailedError{PodName: podName, Reason: t.Reason,
+				Message: fmt.Sprintf("container %s exited with %d", cs.Name, t.ExitCode)}
+		}
+		if err := checkContainerWaiting(podName, &cs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkContainerWaiting(podName string, cs *apiv1.ContainerStatus) error {
+	w := cs.State.Waiting
+	if w == nil {
+		return nil
+	}
+	switch w.Reason {
+	case "ErrImagePull", "ImagePullBackOff", "InvalidImageName", "ErrImageNeverPull":
+		return &PodFailedError{PodName: podName, Reason: w.Reason, Message: w.Message, ImagePull: true}
+	case "CrashLoopBackOff", "CreateContainerConfigError", "CreateContainerError", "RunContainerError":
+		return &PodFailedError{PodName: podName, Reason: w.Reason, Message: w.Message}
+	default:
+		return nil
+	}
+}
+
+// WaitForPodReady waits for the pod to be ready by watching it.
+// It returns PodFailedError if the pod fails or is deleted in the meantime.
 func WaitForPodReady(
 	clientset kubernetes.Interface,
+	namespace string,
 	podName string,
 	timeout time.Duration,
 ) error {
-	condFunc := func() (bool, error) {
-		return IsPodReady(clientset, podName)
+	err := waitForPod(clientset, namespace, podName, timeout, func(pod *apiv1.Pod, deleted bool) (bool, error) {
+		if deleted {
+			return false, &PodFailedError{PodName: podName, Reason: PodReasonDeleted}
+		}
+		if pod == nil {
+			return false, nil
+		}
+		return podReadyCond(pod)
+	})
+	if err == wait.ErrWaitTimeout {
+		return errors.Errorf("Timed out waiting for pod %s to be ready", podName)
 	}
-	return wait.PollImmediate(PollInterval, timeout, condFunc)
+	return err
 }
 
-func IsPodDeleted(clientset kubernetes.Interface, podName string) (bool, error) {
-	_, err, _ := GetPod(clientset, podName)
-	if err != nil {
-		if k8serrors.IsNotFound(err) {
-			return true, nil
-		} else {
-			return false, err
+// WaitForPodRunning waits for the containers to start. It is used for the pods of live migration,
+// which cannot pass their readiness probes until the app is restored.
+func WaitForPodRunning(
+	clientset kubernetes.Interface,
+	namespace string,
+	podName string,
+	timeout time.Duration,
+) error {
+	err := waitForPod(clientset, namespace, podName, timeout, func(pod *apiv1.Pod, deleted bool) (bool, error) {
+		if deleted {
+			return false, &PodFailedError{PodName: podName, Reason: PodReasonDeleted}
+		}
+		if pod == nil {
+			return false, nil
 		}
+		return podRunningCond(pod)
+	})
+	if err == wait.ErrWaitTimeout {
+		return errors.Errorf("Timed out waiting for pod %s to be running", podName)
 	}
-	return false, nil
+	return err
 }
 
 func WaitForPodDeleted(
 	clientset kubernetes.Interface,
+	namespace string,
 	podName string,
 	timeout time.Duration,
 ) error {
-	condFunc := func() (bool, error) {
-		return IsPodDeleted(clientset, podName)
+	err := waitForPod(clientset, namespace, podName, timeout, func(pod *apiv1.Pod, deleted bool) (bool, error) {
+		return deleted || pod == nil, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return errors.Errorf("Timed out waiting for pod %s to be deleted", podName)
 	}
-	return wait.PollImmediate(PollInterval, timeout, condFunc)
+	return err
+}
+
+// waitForPod watches the pod until cond returns true or an error.
+// cond is called with nil if the pod does not exist when the watch starts,
+// and with deleted set to true when the pod is deleted while watching.
+// wait.ErrWaitTimeout is returned on timeout.
+func waitForPod(
+	clientset kubernetes.Interface,
+	namespace string,
+	podName string,
+	timeout time.Duration,
+	cond func(pod *apiv1.Pod, deleted bool) (bool, error),
+) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	fieldSelector := fields.OneTermEqualSelector("metadata.name", podName).String()
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = fieldSelector
+			return clientset.CoreV1().Pods(namespace).List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = fieldSelector
+			return clientset.CoreV1().Pods(namespace).Watch(ctx, options)
+		},
+	}
+	precondition := func(store cache.Store) (bool, error) {
+		obj, exists, err := store.GetByKey(namespace + "/" + podName)
+		if err != nil {
+			return false, errors.WithStack(err)
+		}
+		if !exists {
+			return cond(nil, false)
+		}
+		return cond(obj.(*apiv1.Pod), false)
+	}
+	_, err := watchtools.UntilWithSync(ctx, lw, &apiv1.Pod{}, precondition, func(event watch.Event) (bool, error) {
+		pod, ok := event.Object.(*apiv1.Pod)
+		if !ok || pod.Name != podName {
+			return false, nil
+		}
+		switch event.Type {
+		case watch.Added, watch.Modified:
+			return cond(pod, false)
+		case watch.Deleted:
+			return cond(pod, true)
+		default:
+			return false, nil
+		}
+	})
+	return err
 }
 
 func CreateService(
 	clientset kubernetes.Interface,
+	namespace string,
 	serviceName string,
 	label string,
 	clusterIpName string,
-	port int32,
+	ports []PortSpec,
 ) (*apiv1.Service, error, error) {
+	return createService(clientset, namespace, serviceName, label, clusterIpName, ports, "")
+}
+
+// createService creates the service of clusterIP, which is allocated if empty.
+func createService(
+	clientset kubernetes.Interface,
+	namespace string,
+	serviceName string,
+	label string,
+	clusterIpName string,
+	ports []PortSpec,
+	clusterIP string,
+) (*apiv1.Service, error, error) {
+	var servicePorts []apiv1.ServicePort
+	for i, port := range ports {
+		portName := clusterIpName
+		if i > 0 {
+			portName = fmt.Sprintf("%s-%d", clusterIpName, i)
+		}
+		servicePorts = append(servicePorts, apiv1.ServicePort{
+			Name:     portName,
+			Protocol: apiv1.Protocol(port.GetProtocol()),
+			Port:     int32(port.In),
+		})
+	}
 	service := &apiv1.Service{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "Service",
 			APIVersion: "v1",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:   serviceName,
-			Labels: map[string]string{"app": label},
+			Name:      serviceName,
+			Namespace: namespace,
+			Labels:    map[string]string{"app": label},
 		},
 		Spec: apiv1.ServiceSpec{
-			Type: "ClusterIP",
-			Ports: []apiv1.ServicePort{
-				{
-					Name:     clusterIpName,
-					Protocol: "TCP",
-					Port:     port,
-				},
-			},
-			Selector: map[string]string{"app": label},
+			Type:      "ClusterIP",
+			ClusterIP: clusterIP,
+			Ports:     servicePorts,
+			Selector:  map[string]string{"app": label},
 		},
 	}
-	result, err := clientset.CoreV1().Services("default").
+	result, err := clientset.CoreV1().Services(namespace).
 		Create(context.TODO(), service, metav1.CreateOptions{})
 	if err != nil {
 		return nil, err, errors.WithStack(err)
@@ -202,9 +526,10 @@ func CreateService(
 
 func GetService(
 	clientset kubernetes.Interface,
+	namespace string,
 	serviceName string,
 ) (*apiv1.Service, error, error) {
-	svc, err := clientset.CoreV1().Services("default").
+	svc, err := clientset.CoreV1().Services(namespace).
 		Get(context.TODO(), serviceName, metav1.GetOptions{})
 	if err != nil {
 		return nil, err, errors.WithStack(err)
@@ -214,9 +539,10 @@ func GetService(
 
 func DeleteService(
 	clientset kubernetes.Interface,
+	namespace string,
 	serviceName string,
 ) (error, error) {
-	err := clientset.CoreV1().Services("default").Delete(
+	err := clientset.CoreV1().Services(namespace).Delete(
 		context.TODO(), serviceName, metav1.DeleteOptions{})
 	if err != nil {
 		return err, errors.WithStack(err)
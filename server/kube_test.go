@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestPodOptions() *PodOptions {
+	return &PodOptions{
+		Resources: apiv1.ResourceRequirements{
+			Limits: apiv1.ResourceList{
+				apiv1.ResourceCPU:    resource.MustParse("500m"),
+				apiv1.ResourceMemory: resource.MustParse("256Mi"),
+			},
+		},
+		NodeSelector: map[string]string{"disk": "ssd"},
+		Tolerations: []apiv1.Toleration{
+			{Key: "dedicated", Operator: apiv1.TolerationOpEqual, Value: "app", Effect: apiv1.TaintEffectNoSchedule},
+		},
+		Volumes: []apiv1.Volume{
+			{Name: "data", VolumeSource: apiv1.VolumeSource{EmptyDir: &apiv1.EmptyDirVolumeSource{}}},
+		},
+		VolumeMounts: []apiv1.VolumeMount{
+			{Name: "data", MountPath: "/data"},
+		},
+	}
+}
+
+// checkTestPodOptions checks that spec has the options of newTestPodOptions.
+func checkTestPodOptions(t *testing.T, spec *apiv1.PodSpec) {
+	t.Helper()
+	opts := newTestPodOptions()
+	container := spec.Containers[0]
+	if cpu := container.Resources.Limits[apiv1.ResourceCPU]; cpu.String() != "500m" {
+		t.Errorf("cpu limit = %s", cpu.String())
+	}
+	if mem := container.Resources.Limits[apiv1.ResourceMemory]; mem.String() != "256Mi" {
+		t.Errorf("memory limit = %s", mem.String())
+	}
+	if spec.NodeSelector["disk"] != "ssd" {
+		t.Errorf("node selector = %v", spec.NodeSelector)
+	}
+	if len(spec.Tolerations) != 1 || spec.Tolerations[0] != opts.Tolerations[0] {
+		t.Errorf("tolerations = %v", spec.Tolerations)
+	}
+	if len(spec.Volumes) != 1 || spec.Volumes[0].Name != "data" || spec.Volumes[0].EmptyDir == nil {
+		t.Errorf("volumes = %v", spec.Volumes)
+	}
+	if len(container.VolumeMounts) != 1 || container.VolumeMounts[0] != opts.VolumeMounts[0] {
+		t.Errorf("volume mounts = %v", container.VolumeMounts)
+	}
+}
+
+func TestCreatePodAppliesPodOptions(t *testing.T) {
+	clientset := newTestClientset()
+	ports := []PortSpec{{In: 8888, Ext: 30088}}
+	if _, err, _ := CreatePod(clientset, DefaultNamespace, "app-pod", "app", "app", "app-sample:latest",
+		ports, nil, nil, nil, newTestPodOptions()); err != nil {
+		t.Fatal(err)
+	}
+	pod, err := clientset.CoreV1().Pods(DefaultNamespace).Get(context.TODO(), "app-pod", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestPodOptions(t, &pod.Spec)
+	if pod.Spec.RestartPolicy != apiv1.RestartPolicyNever {
+		t.Errorf("restart policy = %s", pod.Spec.RestartPolicy)
+	}
+}
+
+// newTestPod returns the running and ready pod of a container, modified by f.
+func newTestPod(restartPolicy apiv1.RestartPolicy, f func(pod *apiv1.Pod)) *apiv1.Pod {
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-pod", Namespace: DefaultNamespace},
+		Spec: apiv1.PodSpec{
+			Containers:    []apiv1.Container{{Name: "app"}},
+			RestartPolicy: restartPolicy,
+		},
+	}
+	setPodReady(pod)
+	if f != nil {
+		f(pod)
+	}
+	return pod
+}
+
+func terminatedState(exitCode int32) apiv1.ContainerState {
+	return apiv1.ContainerState{Terminated: &apiv1.ContainerStateTerminated{ExitCode: exitCode, Reason: "Error"}}
+}
+
+func waitingState(reason string) apiv1.ContainerState {
+	return apiv1.ContainerState{Waiting: &apiv1.ContainerStateWaiting{Reason: reason}}
+}
+
+func TestCheckPodFailed(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		pod       *apiv1.Pod
+		failed    bool
+		imagePull bool
+	}{
+		{"running", newTestPod(apiv1.RestartPolicyNever, nil), false, false},
+		{"phase failed", newTestPod(apiv1.RestartPolicyNever, func(pod *apiv1.Pod) {
+			pod.Status.Phase = apiv1.PodFailed
+			pod.Status.Reason = "Evicted"
+		}), true, false},
+		{"phase succeeded", newTestPod(apiv1.RestartPolicyAlways, func(pod *apiv1.Pod) {
+			pod.Status.Phase = apiv1.PodSucceeded
+		}), true, false},
+		{"image pull back-off", newTestPod(apiv1.RestartPolicyNever, func(pod *apiv1.Pod) {
+			pod.Status.Phase = apiv1.PodPending
+			pod.Status.ContainerStatuses[0].State = waitingState("ImagePullBackOff")
+		}), true, true},
+		{"err image pull", newTestPod(apiv1.RestartPolicyNever, func(pod *apiv1.Pod) {
+			pod.Status.Phase = apiv1.PodPending
+			pod.Status.ContainerStatuses[0].State = waitingState("ErrImagePull")
+		}), true, true},
+		{"crash loop back-off", newTestPod(apiv1.RestartPolicyAlways, func(pod *apiv1.Pod) {
+			pod.Status.ContainerStatuses[0].State = waitingState("CrashLoopBackOff")
+		}), true, false},
+		{"container creating", newTestPod(apiv1.RestartPolicyNever, func(pod *apiv1.Pod) {
+			pod.Status.Phase = apiv1.PodPending
+			pod.Status.ContainerStatuses[0].State = waitingState("ContainerCreating")
+		}), false, false},
+		{"terminated without restart", newTestPod(apiv1.RestartPolicyNever, func(pod *apiv1.Pod) {
+			pod.Status.ContainerStatuses[0].State = terminatedState(1)
+		}), true, false},
+		{"terminated with restart", newTestPod(apiv1.RestartPolicyAlways, func(pod *apiv1.Pod) {
+			pod.Status.ContainerStatuses[0].State = terminatedState(1)
+		}), false, false},
+		{"init container failed", newTestPod(apiv1.RestartPolicyAlways, func(pod *apiv1.Pod) {
+			pod.Status.Phase = apiv1.PodPending
+			pod.Status.InitContainerStatuses = []apiv1.ContainerStatus{{Name: "init", State: terminatedState(2)}}
+		}), true, false},
+		{"init container completed", newTestPod(apiv1.RestartPolicyAlways, func(pod *apiv1.Pod) {
+			pod.Status.InitContainerStatuses = []apiv1.ContainerStatus{{Name: "init", State: terminatedState(0)}}
+		}), false, false},
+	} {
+		err := checkPodFailed(tc.pod)
+		if (err != nil) != tc.failed {
+			t.Errorf("%s: err = %v", tc.name, err)
+			continue
+		}
+		if err == nil {
+			continue
+		}
+		podErr, ok := err.(*PodFailedError)
+		if !ok {
+			t.Errorf("%s: err = %T", tc.name, err)
+		} else if podErr.ImagePull != tc.imagePull || podErr.PodName != "app-pod" {
+			t.Errorf("%s: err = %+v", tc.name, podErr)
+		}
+	}
+}
+
+func TestCheckContainerWaiting(t *testing.T) {
+	for _, tc := range []struct {
+		state     apiv1.ContainerState
+		failed    bool
+		imagePull bool
+	}{
+		{apiv1.ContainerState{Running: &apiv1.ContainerStateRunning{}}, false, false},
+		{waitingState("ContainerCreating"), false, false},
+		{waitingState("PodInitializing"), false, false},
+		{waitingState("ErrImagePull"), true, true},
+		{waitingState("ImagePullBackOff"), true, true},
+		{waitingState("InvalidImageName"), true, true},
+		{waitingState("ErrImageNeverPull"), true, true},
+		{waitingState("CrashLoopBackOff"), true, false},
+		{waitingState("CreateContainerConfigError"), true, false},
+		{waitingState("CreateContainerError"), true, false},
+		{waitingState("RunContainerError"), true, false},
+	} {
+		err := checkContainerWaiting("app-pod", &apiv1.ContainerStatus{Name: "app", State: tc.state})
+		if (err != nil) != tc.failed {
+			t.Errorf("%+v: err = %v", tc.state, err)
+			continue
+		}
+		if podErr, ok := err.(*PodFailedError); ok && podErr.ImagePull != tc.imagePull {
+			t.Errorf("%+v: err = %+v", tc.state, podErr)
+		}
+	}
+}
+
+func TestIsPodRunning(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		pod     *apiv1.Pod
+		running bool
+	}{
+		{"running", newTestPod(apiv1.RestartPolicyNever, nil), true},
+		{"running but not ready", newTestPod(apiv1.RestartPolicyNever, func(pod *apiv1.Pod) {
+			pod.Status.ContainerStatuses[0].Ready = false
+			pod.Status.Conditions[0].Status = apiv1.ConditionFalse
+		}), true},
+		{"pending", newTestPod(apiv1.RestartPolicyNever, func(pod *apiv1.Pod) {
+			pod.Status.Phase = apiv1.PodPending
+		}), false},
+		{"no container status", newTestPod(apiv1.RestartPolicyNever, func(pod *apiv1.Pod) {
+			pod.Status.ContainerStatuses = nil
+		}), false},
+		{"container waiting", newTestPod(apiv1.RestartPolicyNever, func(pod *apiv1.Pod) {
+			pod.Status.ContainerStatuses[0].State = waitingState("ContainerCreating")
+		}), false},
+		{"container terminated", newTestPod(apiv1.RestartPolicyAlways, func(pod *apiv1.Pod) {
+			pod.Status.ContainerStatuses[0].State = terminatedState(0)
+		}), false},
+		{"sidecar not started", newTestPod(apiv1.RestartPolicyNever, func(pod *apiv1.Pod) {
+			pod.Spec.Containers = append(pod.Spec.Containers, apiv1.Container{Name: "sidecar"})
+		}), false},
+	} {
+		if running := isPodRunning(tc.pod); running != tc.running {
+			t.Errorf("%s: running = %v, want %v", tc.name, running, tc.running)
+		}
+	}
+}
+
+func TestPodReadyCond(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		pod    *apiv1.Pod
+		ready  bool
+		failed bool
+	}{
+		{"ready", newTestPod(apiv1.RestartPolicyNever, nil), true, false},
+		{"ready condition false", newTestPod(apiv1.RestartPolicyNever, func(pod *apiv1.Pod) {
+			pod.Status.ContainerStatuses[0].Ready = false
+			pod.Status.Conditions[0].Status = apiv1.ConditionFalse
+		}), false, false},
+		{"no ready condition", newTestPod(apiv1.RestartPolicyNever, func(pod *apiv1.Pod) {
+			pod.Status.Conditions = []apiv1.PodCondition{
+				{Type: apiv1.PodScheduled, Status: apiv1.ConditionTrue},
+			}
+		}), false, false},
+		{"ready condition but not running", newTestPod(apiv1.RestartPolicyNever, func(pod *apiv1.Pod) {
+			pod.Status.Phase = apiv1.PodPending
+		}), false, false},
+		{"failed", newTestPod(apiv1.RestartPolicyNever, func(pod *apiv1.Pod) {
+			pod.Status.Phase = apiv1.PodFailed
+		}), false, true},
+	} {
+		ready, err := podReadyCond(tc.pod)
+		if ready != tc.ready || (err != nil) != tc.failed {
+			t.Errorf("%s: ready = %v, err = %v", tc.name, ready, err)
+		}
+	}
+}
+
+func TestWaitForPodReady(t *testing.T) {
+	pending := newTestPod(apiv1.RestartPolicyNever, func(pod *apiv1.Pod) {
+		pod.Status.Phase = apiv1.PodPending
+	})
+	for _, tc := range []struct {
+		name   string
+		update func(pod *apiv1.Pod)
+		check  func(err error) bool
+	}{
+		{"ready", setPodReady, func(err error) bool {
+			return err == nil
+		}},
+		{"image pull failed", func(pod *apiv1.Pod) {
+			pod.Status.ContainerStatuses = []apiv1.ContainerStatus{{Name: "app", State: waitingState("ErrImagePull")}}
+		}, func(err error) bool {
+			podErr, ok := err.(*PodFailedError)
+			return ok && podErr.ImagePull
+		}},
+		{"deleted", nil, func(err error) bool {
+			podErr, ok := err.(*PodFailedError)
+			return ok && podErr.Reason == PodReasonDeleted
+		}},
+	} {
+		clientset := fake.NewSimpleClientset(pending.DeepCopy())
+		pods := clientset.CoreV1().Pods(DefaultNamespace)
+		err := waitTestPods(t, func() error {
+			return WaitForPodReady(clientset, DefaultNamespace, "app-pod", 5*time.Second)
+		}, func() {
+			if tc.update == nil {
+				pods.Delete(context.TODO(), "app-pod", metav1.DeleteOptions{})
+				return
+			}
+			pod := pending.DeepCopy()
+			tc.update(pod)
+			if _, err := pods.UpdateStatus(context.TODO(), pod, metav1.UpdateOptions{}); err != nil {
+				t.Error(err)
+			}
+		})
+		if !tc.check(err) {
+			t.Errorf("%s: err = %v", tc.name, err)
+		}
+	}
+}
+
+func TestWaitForPodReadyTimeout(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	err := WaitForPodReady(clientset, DefaultNamespace, "app-pod", 200*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "Timed out") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestWaitForPodRunningAndDeleted(t *testing.T) {
+	// The pod of live migration is running before it becomes ready
+	running := newTestPod(apiv1.RestartPolicyNever, func(pod *apiv1.Pod) {
+		pod.Status.Conditions[0].Status = apiv1.ConditionFalse
+	})
+	clientset := fake.NewSimpleClientset(running)
+	if err := WaitForPodRunning(clientset, DefaultNamespace, "app-pod", time.Second); err != nil {
+		t.Errorf("wait for running pod: %v", err)
+	}
+	pods := clientset.CoreV1().Pods(DefaultNamespace)
+	err := waitTestPods(t, func() error {
+		return WaitForPodDeleted(clientset, DefaultNamespace, "app-pod", 5*time.Second)
+	}, func() {
+		pods.Delete(context.TODO(), "app-pod", metav1.DeleteOptions{})
+	})
+	if err != nil {
+		t.Errorf("wait for deleted pod: %v", err)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	MigrationStateQueued      = "queued"
+	MigrationStatePreparing   = "preparing"
+	MigrationStatePreDump     = "pre-dump"
+	MigrationStateFinalDump   = "final-dump"
+	MigrationStateRestoring   = "restoring"
+	MigrationStateResumed     = "resumed"
+	MigrationStateRollingBack = "rolling-back"
+	MigrationStateFailed      = "failed"
+	MigrationStateCancelled   = "cancelled"
+)
+
+const (
+	// The finished jobs are kept for MigrationJobTTL, and at most MigrationJobsMaxFinished of them
+	MigrationJobTTL          = time.Hour
+	MigrationJobsMaxFinished = 100
+)
+
+type MigrationJob struct {
+	mux              sync.RWMutex
+	id               string
+	name             string
+	deployType       string
+	state            string
+	preDumpIteration int
+	preDumpStop      string
+	errMsg           string
+	errCode          string
+	createdAt        time.Time
+	updatedAt        time.Time
+	finishedAt       time.Time
+	preDumpTime      time.Duration
+	finalDumpTime    time.Duration
+	downtime         time.Duration
+	iterations       []*IterationStatus
+	chanCancel       chan struct{}
+	cancelled        bool
+}
+
+type MigrationStatus struct {
+	ID                string     `json:"id"`
+	Name              string     `json:"name"`
+	Type              string     `json:"type"`
+	State             string     `json:"state"`
+	PreDumpIteration  int        `json:"preDumpIteration"`
+	PreDumpStopReason string     `json:"preDumpStopReason,omitempty"`
+	Error             string     `json:"error,omitempty"`
+	ErrorCode         string     `json:"errorCode,omitempty"`
+	CreatedAt         time.Time  `json:"createdAt"`
+	UpdatedAt         time.Time  `json:"updatedAt"`
+	FinishedAt        *time.Time `json:"finishedAt,omitempty"`
+	PreDumpTimeMs     int64      `json:"preDumpTimeMs"`
+	FinalDumpTimeMs   int64      `json:"finalDumpTimeMs"`
+	DowntimeMs        int64      `json:"downtimeMs"`
+	// Iterations are the pre-dumps and the final dump in order
+	Iterations []*IterationStatus `json:"iterations,omitempty"`
+}
+
+// IterationStatus is the result of a pre-dump or the final dump.
+// ImageBytes is the size of the images dumped, and the other byte counts are reported only by
+// the tar transfer.
+type IterationStatus struct {
+	Iteration  int    `json:"iteration"`
+	Phase      string `json:"phase"`
+	TimeMs     int64  `json:"timeMs"`
+	ImageBytes int64  `json:"imageBytes,omitempty"`
+	RawBytes   int64  `json:"rawBytes,omitempty"`
+	DedupBytes int64  `json:"dedupBytes,omitempty"`
+	SentBytes  int64  `json:"sentBytes,omitempty"`
+}
+
+func NewMigrationJob(name string, deployType string) *MigrationJob {
+	now := time.Now()
+	return &MigrationJob{
+		id:         uuid.New().String(),
+		name:       name,
+		deployType: deployType,
+		state:      MigrationStatePreparing,
+		createdAt:  now,
+		updatedAt:  now,
+		chanCancel: make(chan struct{}),
+	}
+}
+
+func (p *MigrationJob) ID() string {
+	return p.id
+}
+
+func (p *MigrationJob) SetState(state string) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.state = state
+	p.updatedAt = time.Now()
+	if p.isFinished() {
+		p.finishedAt = p.updatedAt
+	}
+}
+
+func (p *MigrationJob) Finished() bool {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	return p.isFinished()
+}
+
+// FinishedAt returns the time when the migration finished, or the zero time if not finished.
+func (p *MigrationJob) FinishedAt() time.Time {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	return p.finishedAt
+}
+
+func (p *MigrationJob) isFinished() bool {
+	switch p.state {
+	case MigrationStateResumed, MigrationStateFailed, MigrationStateCancelled:
+		return true
+	default:
+		return false
+	}
+}
+
+// Cancel requests the migration to stop and roll back. It returns false if the migration has already finished.
+func (p *MigrationJob) Cancel() bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if p.isFinished() {
+		return false
+	}
+	if !p.cancelled {
+		p.cancelled = true
+		close(p.chanCancel)
+	}
+	return true
+}
+
+func (p *MigrationJob) Cancelled() <-chan struct{} {
+	return p.chanCancel
+}
+
+func (p *MigrationJob) SetPreDump(iteration int) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.state = MigrationStatePreDump
+	p.preDumpIteration = iteration
+	p.updatedAt = time.Now()
+}
+
+func (p *MigrationJob) SetPreDumpStopReason(reason string) {
+	p.mux.Lock()
+	p.preDumpStop = reason
+	p.mux.Unlock()
+}
+
+func (p *MigrationJob) SetPreDumpTime(d time.Duration) {
+	p.mux.Lock()
+	p.preDumpTime = d
+	p.mux.Unlock()
+}
+
+func (p *MigrationJob) SetFinalDumpTime(d time.Duration) {
+	p.mux.Lock()
+	p.finalDumpTime = d
+	p.mux.Unlock()
+}
+
+func (p *MigrationJob) SetDowntime(d time.Duration) {
+	p.mux.Lock()
+	p.downtime = d
+	p.mux.Unlock()
+}
+
+// AddIteration records the result of the pre-dump or the final dump. stats may be nil.
+func (p *MigrationJob) AddIteration(
+	iteration int,
+	phase string,
+	d time.Duration,
+	imageBytes int64,
+	stats *TransferStats,
+) {
+	status := &IterationStatus{
+		Iteration:  iteration,
+		Phase:      phase,
+		TimeMs:     d.Milliseconds(),
+		ImageBytes: imageBytes,
+	}
+	if stats != nil {
+		status.RawBytes = stats.RawBytes
+		status.DedupBytes = stats.DedupBytes
+		status.SentBytes = stats.SentBytes
+	}
+	p.mux.Lock()
+	p.iterations = append(p.iterations, status)
+	p.mux.Unlock()
+}
+
+func (p *MigrationJob) Fail(err error) {
+	p.mux.Lock()
+	p.errMsg = err.Error()
+	p.errCode = ErrorCodeOf(err)
+	cancelled := p.cancelled
+	p.mux.Unlock()
+	if cancelled {
+		p.SetState(MigrationStateCancelled)
+	} else {
+		p.SetState(MigrationStateFailed)
+	}
+}
+
+func (p *MigrationJob) Status() *MigrationStatus {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	status := &MigrationStatus{
+		ID:                p.id,
+		Name:              p.name,
+		Type:              p.deployType,
+		State:             p.state,
+		PreDumpIteration:  p.preDumpIteration,
+		PreDumpStopReason: p.preDumpStop,
+		Error:             p.errMsg,
+		ErrorCode:         p.errCode,
+		CreatedAt:         p.createdAt,
+		UpdatedAt:         p.updatedAt,
+		PreDumpTimeMs:     p.preDumpTime.Milliseconds(),
+		FinalDumpTimeMs:   p.finalDumpTime.Milliseconds(),
+		DowntimeMs:        p.downtime.Milliseconds(),
+	}
+	for _, iteration := range p.iterations {
+		v := *iteration
+		status.Iterations = append(status.Iterations, &v)
+	}
+	if !p.finishedAt.IsZero() {
+		finishedAt := p.finishedAt
+		status.FinishedAt = &finishedAt
+	}
+	return status
+}
+
+type MigrationJobs struct {
+	jobs        *sync.Map
+	ttl         time.Duration
+	maxFinished int
+}
+
+func NewMigrationJobs() *MigrationJobs {
+	return &MigrationJobs{
+		jobs:        &sync.Map{},
+		ttl:         MigrationJobTTL,
+		maxFinished: MigrationJobsMaxFinished,
+	}
+}
+
+func (p *MigrationJobs) New(name string, deployType string) *MigrationJob {
+	p.evict(time.Now())
+	job := NewMigrationJob(name, deployType)
+	p.jobs.Store(job.ID(), job)
+	return job
+}
+
+func (p *MigrationJobs) Get(id string) (*MigrationJob, bool) {
+	val, ok := p.jobs.Load(id)
+	if !ok {
+		return nil, false
+	}
+	return val.(*MigrationJob), true
+}
+
+// evict drops the jobs finished more than ttl before now, and the oldest finished jobs over maxFinished.
+func (p *MigrationJobs) evict(now time.Time) {
+	var finished []*MigrationJob
+	p.jobs.Range(func(key, val interface{}) bool {
+		job := val.(*MigrationJob)
+		finishedAt := job.FinishedAt()
+		if finishedAt.IsZero() {
+			return true
+		}
+		if now.Sub(finishedAt) > p.ttl {
+			p.jobs.Delete(key)
+		} else {
+			finished = append(finished, job)
+		}
+		return true
+	})
+	if len(finished) <= p.maxFinished {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].FinishedAt().Before(finished[j].FinishedAt())
+	})
+	for _, job := range finished[:len(finished)-p.maxFinished] {
+		p.jobs.Delete(job.ID())
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestMigrationJobsEvict(t *testing.T) {
+	jobs := NewMigrationJobs()
+	jobs.maxFinished = 2
+	running := jobs.New("running", DeployTypeLM)
+	var finished []*MigrationJob
+	for i := 0; i < 3; i++ {
+		job := jobs.New("finished", DeployTypeLM)
+		job.Fail(errors.New("failed"))
+		finished = append(finished, job)
+		time.Sleep(time.Millisecond)
+	}
+	jobs.evict(time.Now())
+	if _, ok := jobs.Get(finished[0].ID()); ok {
+		t.Error("the oldest finished job over maxFinished is kept")
+	}
+	for _, job := range append(finished[1:], running) {
+		if _, ok := jobs.Get(job.ID()); !ok {
+			t.Errorf("job %s is evicted", job.Status().State)
+		}
+	}
+	jobs.evict(time.Now().Add(MigrationJobTTL + time.Minute))
+	for _, job := range finished[1:] {
+		if _, ok := jobs.Get(job.ID()); ok {
+			t.Error("the finished job over ttl is kept")
+		}
+	}
+	if _, ok := jobs.Get(running.ID()); !ok {
+		t.Error("the running job is evicted")
+	}
+}
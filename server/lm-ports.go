@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// PortAllocator allocates the host ports of the migrations from a range, so that the migrations
+// running at once do not collide on the ports of LM_HostMsgPort, LM_HostDataPort and so on.
+type PortAllocator struct {
+	mux  sync.Mutex
+	min  int
+	max  int
+	next int
+	used map[int]bool
+}
+
+func NewPortAllocator(min int, max int) *PortAllocator {
+	return &PortAllocator{
+		min:  min,
+		max:  max,
+		next: min,
+		used: map[int]bool{},
+	}
+}
+
+// Allocate returns a port which is neither allocated nor listened to by another process.
+func (p *PortAllocator) Allocate() (int, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	for i := 0; i <= p.max-p.min; i++ {
+		port := p.next
+		if p.next++; p.next > p.max {
+			p.next = p.min
+		}
+		if p.used[port] {
+			continue
+		}
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			continue
+		}
+		ln.Close()
+		p.used[port] = true
+		return port, nil
+	}
+	return 0, errors.New(fmt.Sprintf("No port available in %d-%d", p.min, p.max))
+}
+
+// Release makes the ports available again. The ports of 0 are ignored.
+func (p *PortAllocator) Release(ports ...int) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	for _, port := range ports {
+		delete(p.used, port)
+	}
+}
+
+// MigrationSlots limits the number of the migrations running at once on this host. The migrations
+// to this host and the dump services of the migrations from this host have their own slots.
+type MigrationSlots struct {
+	slots chan struct{}
+}
+
+func NewMigrationSlots(max int) *MigrationSlots {
+	return &MigrationSlots{slots: make(chan struct{}, max)}
+}
+
+// Acquire waits for a slot until cancel is closed, and returns false if cancelled.
+func (p *MigrationSlots) Acquire(cancel <-chan struct{}) bool {
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+// TryAcquire returns false without waiting if no slot is available.
+func (p *MigrationSlots) TryAcquire() bool {
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *MigrationSlots) Release() {
+	<-p.slots
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPortAllocator(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ports := NewPortAllocator(port, port)
+	if got, err := ports.Allocate(); err == nil {
+		t.Fatalf("got %d, want error for the port listened to", got)
+	}
+	ln.Close()
+	got, err := ports.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != port {
+		t.Errorf("got %d, want %d", got, port)
+	}
+	if got, err := ports.Allocate(); err == nil {
+		t.Fatalf("got %d, want error for the port allocated", got)
+	}
+	ports.Release(port)
+	if _, err := ports.Allocate(); err != nil {
+		t.Errorf("allocate after release: %v", err)
+	}
+}
+
+func TestMigrationSlots(t *testing.T) {
+	slots := NewMigrationSlots(1)
+	if !slots.TryAcquire() {
+		t.Fatal("want the first slot")
+	}
+	if slots.TryAcquire() {
+		t.Fatal("want no slot")
+	}
+	cancel := make(chan struct{})
+	close(cancel)
+	if slots.Acquire(cancel) {
+		t.Fatal("want cancelled")
+	}
+	slots.Release()
+	if !slots.Acquire(nil) {
+		t.Fatal("want the slot released")
+	}
+}
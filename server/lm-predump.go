@@ -0,0 +1,121 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	AdaptivePreDumpDefaultThresholdBytes = 4 * 1024 * 1024
+	AdaptivePreDumpDefaultMinReduction   = 0.1
+	AdaptivePreDumpDefaultMaxIterations  = 10
+	AdaptivePreDumpDefaultMaxTimeSec     = 60
+)
+
+// Reasons to stop pre-dumping and trigger the final dump
+const (
+	PreDumpStopFixed         = "fixed-iterations"
+	PreDumpStopThreshold     = "below-threshold"
+	PreDumpStopNotConverging = "not-converging"
+	PreDumpStopMaxIterations = "max-iterations"
+	PreDumpStopMaxTime       = "max-time"
+	PreDumpStopUnsupported   = "unsupported"
+)
+
+// PreDumpController decides whether to run the next pre-dump.
+// With AdaptivePreDump, it keeps pre-dumping until the size transferred by an iteration is below the
+// threshold or stops decreasing, or the iteration or time budget is used up.
+// Otherwise, it runs the fixed number of iterations.
+type PreDumpController struct {
+	adaptive   *AdaptivePreDump
+	iterations int
+	done       int
+	lastBytes  int64
+	prevBytes  int64
+}
+
+func NewPreDumpController(iterations int, adaptive *AdaptivePreDump) *PreDumpController {
+	return &PreDumpController{
+		adaptive:   adaptive,
+		iterations: iterations,
+		lastBytes:  -1,
+		prevBytes:  -1,
+	}
+}
+
+// IsAdaptive returns true if the controller needs the size of each iteration.
+func (p *PreDumpController) IsAdaptive() bool {
+	return p.adaptive != nil
+}
+
+// Record records the size transferred by the pre-dump just finished.
+func (p *PreDumpController) Record(size int64) {
+	p.done++
+	p.prevBytes = p.lastBytes
+	p.lastBytes = size
+}
+
+// Next returns true if the next pre-dump should run, or false with the reason to stop.
+// elapsed is the time since the first pre-dump started.
+func (p *PreDumpController) Next(elapsed time.Duration) (bool, string) {
+	if p.adaptive == nil {
+		if p.done >= p.iterations {
+			return false, PreDumpStopFixed
+		}
+		return true, ""
+	}
+	a := p.adaptive
+	if p.done >= a.GetMaxIterations() {
+		return false, PreDumpStopMaxIterations
+	}
+	if elapsed >= a.GetMaxTime() {
+		return false, PreDumpStopMaxTime
+	}
+	if p.done == 0 {
+		return true, ""
+	}
+	if p.lastBytes < a.GetThresholdBytes() {
+		return false, PreDumpStopThreshold
+	}
+	if p.prevBytes >= 0 && float64(p.lastBytes) > float64(p.prevBytes)*(1-a.GetMinReduction()) {
+		return false, PreDumpStopNotConverging
+	}
+	return true, ""
+}
+
+func (p *AdaptivePreDump) GetThresholdBytes() int64 {
+	if p.ThresholdBytes <= 0 {
+		return AdaptivePreDumpDefaultThresholdBytes
+	}
+	return p.ThresholdBytes
+}
+
+func (p *AdaptivePreDump) GetMinReduction() float64 {
+	if p.MinReduction <= 0 {
+		return AdaptivePreDumpDefaultMinReduction
+	}
+	return p.MinReduction
+}
+
+func (p *AdaptivePreDump) GetMaxIterations() int {
+	if p.MaxIterations <= 0 {
+		return AdaptivePreDumpDefaultMaxIterations
+	}
+	return p.MaxIterations
+}
+
+func (p *AdaptivePreDump) GetMaxTime() time.Duration {
+	if p.MaxTimeSec <= 0 {
+		return AdaptivePreDumpDefaultMaxTimeSec * time.Second
+	}
+	return time.Duration(p.MaxTimeSec) * time.Second
+}
+
+// preDumpSize returns the size transferred by the pre-dump of result.
+// It is the size received over the network if the transfer reports it, and the size of the images
+// reported by the dump service otherwise.
+func preDumpSize(result *LM_Msg, stats *TransferStats) int64 {
+	if stats != nil {
+		return stats.SentBytes
+	}
+	return result.ImageSize
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPreDumpController(t *testing.T) {
+	adaptive := &AdaptivePreDump{ThresholdBytes: 100, MinReduction: 0.5, MaxIterations: 5, MaxTimeSec: 10}
+	tests := []struct {
+		name     string
+		adaptive *AdaptivePreDump
+		sizes    []int64
+		elapsed  time.Duration
+		want     string
+	}{
+		{name: "fixed", sizes: []int64{0, 0, 0}, want: PreDumpStopFixed},
+		{name: "below threshold", adaptive: adaptive, sizes: []int64{1000, 400, 99}, want: PreDumpStopThreshold},
+		{name: "not converging", adaptive: adaptive, sizes: []int64{1000, 600}, want: PreDumpStopNotConverging},
+		{name: "max iterations", adaptive: adaptive, sizes: []int64{10000, 5000, 2500, 1200, 600},
+			want: PreDumpStopMaxIterations},
+		{name: "max time", adaptive: adaptive, sizes: []int64{1000}, elapsed: 10 * time.Second,
+			want: PreDumpStopMaxTime},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctl := NewPreDumpController(3, tt.adaptive)
+			for i, size := range tt.sizes {
+				if next, reason := ctl.Next(0); !next {
+					t.Fatalf("stopped before iteration %d: %s", i+1, reason)
+				}
+				ctl.Record(size)
+			}
+			next, reason := ctl.Next(tt.elapsed)
+			if next {
+				t.Fatalf("want stop after %d iterations", len(tt.sizes))
+			}
+			if reason != tt.want {
+				t.Errorf("reason = %s, want %s", reason, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The control messages between LM_Restore and LM_DumpService on its MsgPort are framed as
+//
+//	frame version (1 byte) | type (1 byte) | payload length (4 bytes, big endian) | payload
+//
+// where the payload is a sequence of fields of tag (1 byte) | value length (uvarint) | value.
+// Zero fields are omitted and unknown tags are skipped, so fields can be added without a new version.
+// The frame version is fixed to LM_FrameVersion, and the protocol version is negotiated by the
+// version field of LM_MsgHello and LM_MsgHelloAck, so that any version can read the hello.
+const (
+	LM_FrameVersion       = 1
+	LM_ProtocolVersion    = 1
+	LM_ProtocolMinVersion = 1
+	LM_MsgHeaderSize      = 6
+	LM_MsgMaxPayloadSize  = 64 * 1024
+	LM_MsgMaxErrorSize    = 4 * 1024
+)
+
+// Message types other than the requests LM_MsgReq*
+const (
+	LM_MsgHello    = 0x10
+	LM_MsgHelloAck = 0x11
+	LM_MsgResult   = 0x20
+)
+
+// Capabilities of the dump service, negotiated by LM_MsgHello
+const (
+	LM_CapPreDump   = 1 << 0
+	LM_CapLazyPages = 1 << 1
+	// LM_CapComplete is set if the dump service accepts LM_MsgReqComplete
+	LM_CapComplete = 1 << 2
+	// LM_CapPageServerTunnel is set if the page server of LazyDump is reachable only through the
+	// peer tunnel
+	LM_CapPageServerTunnel = 1 << 3
+)
+
+const (
+	lmMsgTagVersion      = 1
+	lmMsgTagCapabilities = 2
+	lmMsgTagIteration    = 3
+	lmMsgTagImageSize    = 4
+	lmMsgTagDuration     = 5
+	lmMsgTagError        = 6
+	// lmMsgMaxInt is the max of the int fields, which fit in int on any platform
+	lmMsgMaxInt = 1<<31 - 1
+)
+
+// LM_Msg is a control message. The fields used depend on Type.
+type LM_Msg struct {
+	Type byte
+	// Version and Capabilities are for LM_MsgHello and LM_MsgHelloAck
+	Version      int
+	Capabilities uint64
+	// Iteration is the iteration of the dump request and its result
+	Iteration int
+	// ImageSize is the size of the images dumped, and Duration is the time of the dump and the transfer
+	ImageSize int64
+	Duration  time.Duration
+	// Error is empty if the request succeeded
+	Error string
+}
+
+func (p *LM_Msg) String() string {
+	return fmt.Sprintf("type=0x%02x, version=%d, capabilities=0x%x, iteration=%d, imageSize=%d,"+
+		" duration=%v, error=%q", p.Type, p.Version, p.Capabilities, p.Iteration, p.ImageSize, p.Duration, p.Error)
+}
+
+// EncodeLM_Msg returns the frame of msg.
+func EncodeLM_Msg(msg *LM_Msg) ([]byte, error) {
+	if msg.Version < 0 || msg.Version > lmMsgMaxInt || msg.Iteration < 0 || msg.Iteration > lmMsgMaxInt {
+		return nil, errors.New("Invalid version or iteration: " + msg.String())
+	}
+	payload := &bytes.Buffer{}
+	putUvarintField(payload, lmMsgTagVersion, uint64(msg.Version))
+	putUvarintField(payload, lmMsgTagCapabilities, msg.Capabilities)
+	putUvarintField(payload, lmMsgTagIteration, uint64(msg.Iteration))
+	putVarintField(payload, lmMsgTagImageSize, msg.ImageSize)
+	putVarintField(payload, lmMsgTagDuration, int64(msg.Duration))
+	if msg.Error != "" {
+		putField(payload, lmMsgTagError, []byte(msg.Error))
+	}
+	if payload.Len() > LM_MsgMaxPayloadSize {
+		return nil, errors.New(fmt.Sprintf("Too large message payload: %d bytes", payload.Len()))
+	}
+	frame := make([]byte, LM_MsgHeaderSize, LM_MsgHeaderSize+payload.Len())
+	frame[0] = LM_FrameVersion
+	frame[1] = msg.Type
+	binary.BigEndian.PutUint32(frame[2:LM_MsgHeaderSize], uint32(payload.Len()))
+	return append(frame, payload.Bytes()...), nil
+}
+
+// DecodeLM_Msg decodes the frame b, which must be a whole frame.
+func DecodeLM_Msg(b []byte) (*LM_Msg, error) {
+	if len(b) < LM_MsgHeaderSize {
+		return nil, errors.New(fmt.Sprintf("Insufficient message header: %d bytes", len(b)))
+	}
+	size, err := parseLM_MsgHeader(b[:LM_MsgHeaderSize])
+	if err != nil {
+		return nil, err
+	}
+	if len(b)-LM_MsgHeaderSize != size {
+		return nil, errors.New(fmt.Sprintf("Message payload length mismatch: %d != %d",
+			len(b)-LM_MsgHeaderSize, size))
+	}
+	return decodeLM_MsgPayload(b[1], b[LM_MsgHeaderSize:])
+}
+
+// WriteLM_Msg writes the frame of msg to w.
+func WriteLM_Msg(w io.Writer, msg *LM_Msg) error {
+	frame, err := EncodeLM_Msg(msg)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(frame); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// ReadLM_Msg reads a frame from r. It returns io.EOF as is if r is closed before the frame.
+func ReadLM_Msg(r io.Reader) (*LM_Msg, error) {
+	header := make([]byte, LM_MsgHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, errors.WithStack(err)
+	}
+	size, err := parseLM_MsgHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return decodeLM_MsgPayload(header[1], payload)
+}
+
+func parseLM_MsgHeader(header []byte) (int, error) {
+	if header[0] != LM_FrameVersion {
+		return 0, errors.New(fmt.Sprintf("Unsupported frame version: %d", header[0]))
+	}
+	size := binary.BigEndian.Uint32(header[2:LM_MsgHeaderSize])
+	if size > LM_MsgMaxPayloadSize {
+		return 0, errors.New(fmt.Sprintf("Too large message payload: %d bytes", size))
+	}
+	return int(size), nil
+}
+
+func decodeLM_MsgPayload(msgType byte, payload []byte) (*LM_Msg, error) {
+	msg := &LM_Msg{Type: msgType}
+	for len(payload) > 0 {
+		tag := payload[0]
+		size, n := binary.Uvarint(payload[1:])
+		if n <= 0 || size > uint64(len(payload)-1-n) {
+			return nil, errors.New(fmt.Sprintf("Invalid length of message field %d", tag))
+		}
+		value := payload[1+n : 1+n+int(size)]
+		payload = payload[1+n+int(size):]
+		var err error
+		switch tag {
+		case lmMsgTagVersion:
+			msg.Version, err = uvarintIntValue(value)
+		case lmMsgTagCapabilities:
+			msg.Capabilities, err = uvarintValue(value)
+		case lmMsgTagIteration:
+			msg.Iteration, err = uvarintIntValue(value)
+		case lmMsgTagImageSize:
+			msg.ImageSize, err = varintValue(value)
+		case lmMsgTagDuration:
+			var d int64
+			d, err = varintValue(value)
+			msg.Duration = time.Duration(d)
+		case lmMsgTagError:
+			msg.Error = string(value)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("Invalid message field %d", tag))
+		}
+	}
+	return msg, nil
+}
+
+func putField(w *bytes.Buffer, tag byte, value []byte) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	w.WriteByte(tag)
+	w.Write(buf[:binary.PutUvarint(buf, uint64(len(value)))])
+	w.Write(value)
+}
+
+func putUvarintField(w *bytes.Buffer, tag byte, v uint64) {
+	if v == 0 {
+		return
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	putField(w, tag, buf[:binary.PutUvarint(buf, v)])
+}
+
+func putVarintField(w *bytes.Buffer, tag byte, v int64) {
+	if v == 0 {
+		return
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	putField(w, tag, buf[:binary.PutVarint(buf, v)])
+}
+
+func uvarintValue(value []byte) (uint64, error) {
+	v, n := binary.Uvarint(value)
+	if n != len(value) {
+		return 0, errors.New("Invalid uvarint")
+	}
+	return v, nil
+}
+
+func uvarintIntValue(value []byte) (int, error) {
+	v, err := uvarintValue(value)
+	if err != nil {
+		return 0, err
+	}
+	if v > lmMsgMaxInt {
+		return 0, errors.New("Too large value")
+	}
+	return int(v), nil
+}
+
+func varintValue(value []byte) (int64, error) {
+	v, n := binary.Varint(value)
+	if n != len(value) {
+		return 0, errors.New("Invalid varint")
+	}
+	return v, nil
+}
+
+// NewLM_MsgResult returns the result of the request of iteration, which failed if err is not nil.
+func NewLM_MsgResult(iteration int, imageSize int64, d time.Duration, err error) *LM_Msg {
+	msg := &LM_Msg{
+		Type:      LM_MsgResult,
+		Iteration: iteration,
+		ImageSize: imageSize,
+		Duration:  d,
+	}
+	if err != nil {
+		msg.Error = err.Error()
+		if msg.Error == "" {
+			msg.Error = "Unknown error"
+		}
+		if len(msg.Error) > LM_MsgMaxErrorSize {
+			msg.Error = msg.Error[:LM_MsgMaxErrorSize]
+		}
+	}
+	return msg
+}
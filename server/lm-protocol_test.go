@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLM_MsgRoundTrip(t *testing.T) {
+	msgs := []*LM_Msg{
+		{Type: LM_MsgHello, Version: LM_ProtocolVersion},
+		{Type: LM_MsgHelloAck, Version: LM_ProtocolVersion, Capabilities: LM_CapPreDump | LM_CapLazyPages},
+		{Type: LM_MsgReqPreDump, Iteration: 1},
+		{Type: LM_MsgResult, Iteration: 3, ImageSize: 1 << 40, Duration: 1500 * time.Millisecond},
+		{Type: LM_MsgResult, Iteration: 4, Error: "criu dump failed"},
+		{Type: LM_MsgReqRollback},
+	}
+	buf := &bytes.Buffer{}
+	for _, msg := range msgs {
+		if err := WriteLM_Msg(buf, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range msgs {
+		got, err := ReadLM_Msg(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+	if _, err := ReadLM_Msg(buf); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+}
+
+func TestDecodeLM_MsgInvalid(t *testing.T) {
+	frame, err := EncodeLM_Msg(&LM_Msg{Type: LM_MsgResult, Iteration: 1, Error: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknownVersion := append([]byte{}, frame...)
+	unknownVersion[0] = LM_FrameVersion + 1
+	tooLarge := []byte{LM_FrameVersion, LM_MsgResult, 0xFF, 0xFF, 0xFF, 0xFF}
+	tests := map[string][]byte{
+		"short header":    frame[:LM_MsgHeaderSize-1],
+		"short payload":   frame[:len(frame)-1],
+		"unknown version": unknownVersion,
+		"too large":       tooLarge,
+		"invalid length":  {LM_FrameVersion, LM_MsgResult, 0, 0, 0, 2, lmMsgTagError, 0x05},
+		"invalid varint":  {LM_FrameVersion, LM_MsgResult, 0, 0, 0, 3, lmMsgTagIteration, 0x01, 0x80},
+	}
+	for name, b := range tests {
+		if msg, err := DecodeLM_Msg(b); err == nil {
+			t.Errorf("%s: got %s, want error", name, msg)
+		}
+	}
+}
+
+func TestDecodeLM_MsgUnknownField(t *testing.T) {
+	b := []byte{LM_FrameVersion, LM_MsgResult, 0, 0, 0, 7, 0x7F, 0x02, 0xAA, 0xBB, lmMsgTagIteration, 0x01, 0x02}
+	msg, err := DecodeLM_Msg(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&LM_Msg{Type: LM_MsgResult, Iteration: 2}); !reflect.DeepEqual(msg, want) {
+		t.Errorf("got %s, want %s", msg, want)
+	}
+}
+
+func TestAcceptHelloNegotiatesVersion(t *testing.T) {
+	for _, tc := range []struct {
+		version int
+		want    int
+		ok      bool
+	}{
+		{LM_ProtocolVersion, LM_ProtocolVersion, true},
+		// The hello of a newer restorer is acked with the version of this dump service
+		{LM_ProtocolVersion + 1, LM_ProtocolVersion, true},
+		{LM_ProtocolMinVersion - 1, LM_ProtocolMinVersion - 1, false},
+	} {
+		server, client := net.Pipe()
+		chanErr := make(chan error, 1)
+		go func() {
+			chanErr <- (&LM_DumpService{}).acceptHello(server, &CRIUCheckpointer{})
+			server.Close()
+		}()
+		if err := WriteLM_Msg(client, &LM_Msg{Type: LM_MsgHello, Version: tc.version}); err != nil {
+			t.Fatal(err)
+		}
+		ack, err := ReadLM_Msg(client)
+		if err != nil {
+			t.Fatalf("version %d: %v", tc.version, err)
+		}
+		if ack.Type != LM_MsgHelloAck || ack.Version != tc.want || (ack.Error == "") != tc.ok {
+			t.Errorf("version %d: ack = %s", tc.version, ack)
+		}
+		if err := <-chanErr; (err == nil) != tc.ok {
+			t.Errorf("version %d: err = %v", tc.version, err)
+		}
+		client.Close()
+	}
+}
+
+func FuzzDecodeLM_Msg(f *testing.F) {
+	for _, msg := range []*LM_Msg{
+		{Type: LM_MsgHello, Version: LM_ProtocolVersion, Capabilities: LM_CapPreDump},
+		{Type: LM_MsgResult, Iteration: 2, ImageSize: 4096, Duration: time.Second, Error: "error"},
+	} {
+		frame, err := EncodeLM_Msg(msg)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(frame)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		msg, err := DecodeLM_Msg(b)
+		if err != nil {
+			return
+		}
+		frame, err := EncodeLM_Msg(msg)
+		if err != nil {
+			t.Fatalf("encode %s: %v", msg, err)
+		}
+		msg2, err := DecodeLM_Msg(frame)
+		if err != nil {
+			t.Fatalf("decode %s: %v", msg, err)
+		}
+		if !reflect.DeepEqual(msg, msg2) {
+			t.Errorf("got %s, want %s", msg2, msg)
+		}
+	})
+}
+
+func FuzzLM_MsgRoundTrip(f *testing.F) {
+	f.Add(byte(LM_MsgResult), 1, uint64(0), 3, int64(1024), int64(time.Second), "")
+	f.Add(byte(LM_MsgResult), 0, uint64(0), 0, int64(-1), int64(-1), "error")
+	f.Fuzz(func(t *testing.T, msgType byte, version int, capabilities uint64, iteration int,
+		imageSize int64, duration int64, errMsg string) {
+		msg := &LM_Msg{
+			Type:         msgType,
+			Version:      version,
+			Capabilities: capabilities,
+			Iteration:    iteration,
+			ImageSize:    imageSize,
+			Duration:     time.Duration(duration),
+			Error:        errMsg,
+		}
+		frame, err := EncodeLM_Msg(msg)
+		if err != nil {
+			return
+		}
+		got, err := ReadLM_Msg(bytes.NewReader(frame))
+		if err != nil {
+			t.Fatalf("decode %s: %v", msg, err)
+		}
+		if !reflect.DeepEqual(got, msg) {
+			t.Errorf("got %s, want %s", got, msg)
+		}
+	})
+}
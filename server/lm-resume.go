@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	LM_DefaultResumeTimeout  = 30 * time.Second
+	LM_ResumeSignalTimeout   = 5 * time.Second
+	LM_RestoreLogName        = "restore.log"
+	LM_RestoreLogTailLines   = 10
+	LM_ResumeEventResumed    = "resumed"
+	LM_ResumeEventExited     = "exited"
+	lmResumeSignalQueueSize  = 4
+	lmResumeSignalMaxLineLen = 256
+)
+
+// ResumeSignal is sent by the restored pod to the resume signal port as "<token> <event> <value>":
+// LM_ResumeEventResumed with the pid of the restored app from the post-resume action script,
+// or LM_ResumeEventExited with the exit status of criu restore when it exits.
+type ResumeSignal struct {
+	Event string
+	Value int
+}
+
+// ResumeListener receives the resume signals with the token of the migration.
+type ResumeListener struct {
+	ln         net.Listener
+	token      string
+	chanSignal chan *ResumeSignal
+}
+
+func ListenResumeSignal(port int, token string) (*ResumeListener, error) {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	p := &ResumeListener{
+		ln:         ln,
+		token:      token,
+		chanSignal: make(chan *ResumeSignal, lmResumeSignalQueueSize),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !IsClosedError(err) {
+					Logger.ErrorE(errors.WithStack(err))
+				}
+				return
+			}
+			go p.receive(conn)
+		}
+	}()
+	return p, nil
+}
+
+func (p *ResumeListener) Signals() <-chan *ResumeSignal {
+	return p.chanSignal
+}
+
+func (p *ResumeListener) Close() {
+	p.ln.Close()
+}
+
+func (p *ResumeListener) receive(conn net.Conn) {
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(LM_ResumeSignalTimeout)); err != nil {
+		Logger.ErrorE(errors.WithStack(err))
+		return
+	}
+	line, err := Readline(io.LimitReader(conn, lmResumeSignalMaxLineLen))
+	if err != nil {
+		Logger.Warn("[Restore] Read resume signal: " + err.Error())
+		return
+	}
+	signal, err := parseResumeSignal(string(line), p.token)
+	if err != nil {
+		Logger.Warn("[Restore] Reject resume signal from " + conn.RemoteAddr().String() + ": " + err.Error())
+		return
+	}
+	Logger.InfoF("[Restore] Resume signal: %s %d\n", signal.Event, signal.Value)
+	select {
+	case p.chanSignal <- signal:
+	default:
+		Logger.Warn("[Restore] Drop resume signal: " + signal.Event)
+	}
+}
+
+func parseResumeSignal(line string, token string) (*ResumeSignal, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return nil, errors.New("Invalid resume signal")
+	}
+	if subtle.ConstantTimeCompare([]byte(fields[0]), []byte(token)) != 1 {
+		return nil, errors.New("Invalid token")
+	}
+	if fields[1] != LM_ResumeEventResumed && fields[1] != LM_ResumeEventExited {
+		return nil, errors.New("Unknown event: " + fields[1])
+	}
+	value, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &ResumeSignal{Event: fields[1], Value: value}, nil
+}
+
+// getPostResumeScript returns the action script of criu restore, which sends the resumed signal
+// if the restored app is alive. The app is found by CRTOOLS_INIT_PID, or MainPidFilePath if criu
+// does not set it, and no signal is sent if its PID is unknown.
+func (p *LM_Restore) getPostResumeScript() string {
+	return fmt.Sprintf("#!/bin/sh\n"+
+		"if test \"$CRTOOLS_SCRIPT_ACTION\" = \"post-resume\"; then\n"+
+		"  pid=${CRTOOLS_INIT_PID:-$(cat %s 2>/dev/null)}\n"+
+		"  if test -n \"$pid\" && kill -0 \"$pid\"; then\n"+
+		"    echo Send resume signal; echo \"%s %s $pid\" | nc %s %d\n"+
+		"  else\n"+
+		"    echo Restored app is not alive: \"$pid\" >&2\n"+
+		"  fi\n"+
+		"fi\n",
+		MainPidFilePath, p.TransferToken, LM_ResumeEventResumed, p.ThisAddr, p.resumeSigPort)
+}
+
+// getRestoreCommand returns the command to run criu restore in the background, which sends the
+// exited signal with the exit status of criu restore when it exits.
+func (p *LM_Restore) getRestoreCommand(extraOpts string) string {
+	return fmt.Sprintf("(%s -o %s; echo \"%s %s $?\" | nc %s %d) &",
+		GetCriuRestoreCommand(extraOpts), LM_RestoreLogName,
+		p.TransferToken, LM_ResumeEventExited, p.ThisAddr, p.resumeSigPort)
+}
+
+// waitForResume waits for the restored app to resume by ResumeTimeout, and then for the restored pod
+// to be ready if WaitForReady. It returns the time of the resume.
+func (p *LM_Restore) waitForResume(listener *ResumeListener, chanExecErr <-chan error) (time.Time, error) {
+	timeout := p.ResumeTimeout
+	if timeout <= 0 {
+		timeout = LM_DefaultResumeTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var resumedAt time.Time
+	for resumedAt.IsZero() {
+		select {
+		case signal := <-listener.Signals():
+			if signal.Event == LM_ResumeEventExited {
+				return resumedAt, NewAPIError(ErrCodeMigrationError, errors.New(fmt.Sprintf(
+					"criu restore exited with status %d before resume%s", signal.Value, p.restoreLogTail())))
+			}
+			resumedAt = time.Now()
+		case err := <-chanExecErr:
+			if err != nil {
+				return resumedAt, NewAPIError(ErrCodeMigrationError, errors.Wrap(err, "Exec criu restore"))
+			}
+			chanExecErr = nil
+		case <-timer.C:
+			return resumedAt, NewAPIError(ErrCodeMigrationError, errors.New(fmt.Sprintf(
+				"Restored app did not resume in %v%s", timeout, p.restoreLogTail())))
+		case <-p.Job.Cancelled():
+			return resumedAt, errors.New("Migration cancelled")
+		}
+	}
+	if p.WaitForReady {
+		Logger.Info("[Restore] Wait for restored pod to be ready")
+		if err := WaitForPodReady(p.Clientset, p.DstNamespace, p.DstPodName, time.Until(deadline)); err != nil {
+			return resumedAt, NewAPIError(ErrCodeMigrationError, errors.Wrap(err, "Restored app is not ready"))
+		}
+	}
+	return resumedAt, nil
+}
+
+// restoreLogTail returns the last lines of the log of criu restore to append to the error, or an
+// empty string if it cannot be read.
+func (p *LM_Restore) restoreLogTail() string {
+	stdout := &bytes.Buffer{}
+	cmd := fmt.Sprintf("tail -n %d %s/final/%s", LM_RestoreLogTailLines, LM_DumpImagesDir, LM_RestoreLogName)
+	if err := ExecutePod(p.Clientset, p.RestConfig, p.DstNamespace, p.DstPodName, p.DstContainerName,
+		nil, stdout, os.Stderr, "/bin/sh", "-c", cmd); err != nil {
+		Logger.Warn("[Restore] Read restore log: " + err.Error())
+		return ""
+	}
+	return ":\n" + strings.TrimSpace(stdout.String())
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseResumeSignal(t *testing.T) {
+	token := "0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		line string
+		want *ResumeSignal
+	}{
+		{line: token + " resumed 42", want: &ResumeSignal{Event: LM_ResumeEventResumed, Value: 42}},
+		{line: token + " exited 1", want: &ResumeSignal{Event: LM_ResumeEventExited, Value: 1}},
+		{line: "fedcba9876543210fedcba9876543210 resumed 42"},
+		{line: token + " started 42"},
+		{line: token + " resumed"},
+		{line: token + " resumed pid"},
+		{line: ""},
+	}
+	for _, tt := range tests {
+		got, err := parseResumeSignal(tt.line, token)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%q: got %+v, want error", tt.line, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+		} else if *got != *tt.want {
+			t.Errorf("%q: got %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestResumeListener(t *testing.T) {
+	token := "0123456789abcdef0123456789abcdef"
+	ports := NewPortAllocator(20000, 20999)
+	port, err := ports.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := ListenResumeSignal(port, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	for _, line := range []string{"invalid resumed 1", token + " resumed 7"} {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintln(conn, line)
+		conn.Close()
+	}
+	select {
+	case signal := <-listener.Signals():
+		if signal.Event != LM_ResumeEventResumed || signal.Value != 7 {
+			t.Errorf("got %+v", signal)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no resume signal")
+	}
+}
+
+func TestPostResumeScript(t *testing.T) {
+	if _, err := os.Stat(MainPidFilePath); err == nil {
+		t.Skip(MainPidFilePath + " exists")
+	}
+	dir, err := ioutil.TempDir("", "cloudlet-resume-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// nc records the signal instead of sending it
+	signalPath := filepath.Join(dir, "signal")
+	nc := "#!/bin/sh\ncat > " + signalPath + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "nc"), []byte(nc), 0755); err != nil {
+		t.Fatal(err)
+	}
+	p := &LM_Restore{
+		TransferToken: "0123456789abcdef0123456789abcdef",
+		ThisAddr:      "127.0.0.1",
+		resumeSigPort: 9999,
+	}
+	scriptPath := filepath.Join(dir, "action-script")
+	if err := ioutil.WriteFile(scriptPath, []byte(p.getPostResumeScript()), 0755); err != nil {
+		t.Fatal(err)
+	}
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		env  []string
+		want string
+	}{
+		{env: []string{"CRTOOLS_SCRIPT_ACTION=post-resume", "CRTOOLS_INIT_PID=" + pid},
+			want: p.TransferToken + " " + LM_ResumeEventResumed + " " + pid},
+		{env: []string{"CRTOOLS_SCRIPT_ACTION=pre-resume", "CRTOOLS_INIT_PID=" + pid}},
+		{env: []string{"CRTOOLS_SCRIPT_ACTION=post-resume", "CRTOOLS_INIT_PID=999999999"}},
+		// The PID of the app is unknown
+		{env: []string{"CRTOOLS_SCRIPT_ACTION=post-resume"}},
+	}
+	for _, tt := range tests {
+		os.Remove(signalPath)
+		cmd := exec.Command("/bin/sh", scriptPath)
+		cmd.Env = append(tt.env, "PATH="+dir+":"+os.Getenv("PATH"))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v: %v: %s", tt.env, err, out)
+		}
+		got, err := ioutil.ReadFile(signalPath)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(string(got)) != tt.want {
+			t.Errorf("%v: signal = %q, want %q", tt.env, got, tt.want)
+		}
+	}
+}
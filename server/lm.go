@@ -7,8 +7,6 @@ import (
 	"io"
 	"net"
 	"os"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -16,29 +14,52 @@ import (
 	"k8s.io/client-go/rest"
 )
 
+// The host ports are allocated for each migration from the range of HostConf, and these fixed ports
+// are used only with the peers which do not tell the allocated ports.
 const (
 	LM_HostMsgPort          = 19999
 	LM_HostDataPort         = 19998
-	LM_HostResumeSigPort    = 19997
+	LM_HostPageServerPort   = 19996
 	LM_PodRsyncPort         = 873
+	LM_PodPageServerPort    = 19996
 	LM_DumpImagesDir        = "/tmp/cloudlet-live-migration/images"
 	LM_RsyncModuleName      = "tmp"
 	LM_RsyncModuleDirectory = "/tmp"
 	LM_PostResumeScriptPath = "/tmp/cloudlet-live-migration.post-resume.sh"
 	MainPidFilePath         = "/MAIN_PID"
+	LM_DumpAcceptTimeout    = 60 * time.Second
+	LM_LazyPagesTimeout     = 10 * time.Minute
 )
 
 const (
-	LM_MsgReqPreDump = 0x01
-	LM_MsgReqDump    = 0x02
-	LM_MsgRespOk     = 0x00
-	LM_MsgRespError  = 0xFF
+	// MigrationModePreCopy sends all the memory pages before the app is restored
+	MigrationModePreCopy = "precopy"
+	// MigrationModePostCopy restores the app right after the final dump without the memory pages,
+	// which the restored app fetches from the page server on the source host
+	MigrationModePostCopy = "postcopy"
+)
+
+const (
+	LM_MsgReqPreDump  = 0x01
+	LM_MsgReqDump     = 0x02
+	LM_MsgReqRollback = 0x03
+	LM_MsgReqLazyDump = 0x04
+	// LM_MsgReqComplete tells the dump service that the restored app has resumed
+	LM_MsgReqComplete = 0x05
+	LM_MsgRespOk      = 0x00
+	LM_MsgRespError   = 0xFF
 )
 
 func GetRestorePodCommand() ([]string, []string) {
 	return []string{"/bin/sh", "-c", "--"}, []string{"while true; do sleep 60; done"}
 }
 
+func GetCriuRestoreCommand(extraOpts string) string {
+	return fmt.Sprintf("unshare -p -m --fork --mount-proc"+
+		" criu restore --images-dir %s/final --shell-job --tcp-close %s",
+		LM_DumpImagesDir, extraOpts)
+}
+
 type LM_Restore struct {
 	HostConf         *HostConf
 	Clientset        kubernetes.Interface
@@ -50,10 +71,38 @@ type LM_Restore struct {
 	SrcAddr          string
 	SrcAPIServerAddr string
 	SrcName          string
-	Fwdsvc           *ForwarderService
-	DstPodAddr       *net.TCPAddr
+	SrcNamespace     string
+	SrcPod           string
+	SrcCluster       string
+	FwdTargets       []*LM_FwdTarget
 	BwLimit          int
 	Iteration        int
+	AdaptivePreDump  *AdaptivePreDump
+	Mode             string
+	// ResumeTimeout is the time to wait for the restored app to resume, and WaitForReady waits for
+	// the restored pod to be ready as well
+	ResumeTimeout    time.Duration
+	WaitForReady     bool
+	Transfer         string
+	TransferToken    string
+	Compression      string
+	CompressionLevel int
+	Dedup            bool
+	Ports            *PortAllocator
+	PeerTLS          *PeerTLS
+	Job              *MigrationJob
+	// dataPort, resumeSigPort and pageRelayPort are allocated for the migration, and pageServerPort
+	// is the port of the peer tunnel to the page server of the source host
+	dataPort       int
+	resumeSigPort  int
+	pageRelayPort  int
+	pageServerPort int
+}
+
+// LM_FwdTarget is a forwarding service to redirect to DstAddr of the restored pod after ExecFwdLM.
+type LM_FwdTarget struct {
+	Fwdsvc  ForwardingService
+	DstAddr string
 }
 
 func (p *LM_Restore) ExecLM() error {
@@ -65,70 +114,89 @@ func (p *LM_Restore) ExecFwdLM() error {
 }
 
 func (p *LM_Restore) exec(withFwd bool) (reterr error) {
+	var conn net.Conn
+	fwdSuspended := false
 	defer func() {
 		if reterr != nil {
 			Logger.Warn("[Restore] Abort")
+			p.rollback(conn)
 		} else {
 			Logger.Info("[Restore] Complete")
 		}
+		if fwdSuspended {
+			Logger.Info("[Restore] Resume forwarding services")
+			for _, target := range p.FwdTargets {
+				target.Fwdsvc.Resume()
+			}
+		}
+		if conn != nil {
+			conn.Close()
+		}
 	}()
+	if err := p.checkCancelled(); err != nil {
+		return err
+	}
+	if err := p.allocatePorts(); err != nil {
+		return err
+	}
+	defer p.Ports.Release(p.dataPort, p.resumeSigPort, p.pageRelayPort)
+	// The token authenticates the images and the resume signals of the migration
+	token, err := NewTransferToken()
+	if err != nil {
+		return err
+	}
+	p.TransferToken = token
 	Logger.Info("[Restore] Listen to resume signal")
-	lnResumeAddr := fmt.Sprintf(":%d", LM_HostResumeSigPort)
-	lnResume, err := net.Listen("tcp", lnResumeAddr)
+	resumeListener, err := ListenResumeSignal(p.resumeSigPort, token)
 	if err != nil {
-		return errors.WithStack(err)
+		return err
 	}
-	defer lnResume.Close()
-	resumeChan := make(chan struct{}, 1)
-	go func() {
-		defer close(resumeChan)
-		conn, err := lnResume.Accept()
-		if err != nil {
-			if IsClosedError(err) {
-				Logger.Warn("[Restore] Resume signal listener close")
-			} else {
-				Logger.ErrorE(err)
-			}
-			return
-		}
-		Logger.Info("[Restore] Resume signal accept")
-		defer conn.Close()
-		conn.SetDeadline(time.Now().Add(1 * time.Second))
-		buf := make([]byte, 1)
-		_, _ = conn.Read(buf)
-	}()
+	defer resumeListener.Close()
 	Logger.Info("[Restore] Prepare post-resume script")
-	postResumeScript := fmt.Sprintf("#!/bin/sh\n"+
-		"if test \"$CRTOOLS_SCRIPT_ACTION\" = \"post-resume\"; then echo Send resume signal; nc -vz %s %d; fi\n",
-		p.ThisAddr, LM_HostResumeSigPort)
 	if err := WritePodFile(p.Clientset, p.RestConfig, p.DstNamespace, p.DstPodName, p.DstContainerName,
-		os.Stderr, LM_PostResumeScriptPath, postResumeScript, "755"); err != nil {
+		os.Stderr, LM_PostResumeScriptPath, p.getPostResumeScript(), "755"); err != nil {
 		return err
 	}
-	Logger.Info("[Restore] Exec rsync --daemon")
-	if err := ExecutePod(p.Clientset, p.RestConfig, p.DstNamespace, p.DstPodName, p.DstContainerName,
-		nil, os.Stdout, os.Stderr, "/bin/sh", "-c", "rsync --daemon"); err != nil {
+	receiver, err := NewImageReceiver(p)
+	if err != nil {
+		return err
+	}
+	defer receiver.Close()
+	if err := receiver.Start(); err != nil {
 		return err
 	}
 	Logger.Info("[Restore] Send DumpStart request")
-	if resp, err := p.sendDumpStartRequest(); err != nil {
+	resp, err := p.sendDumpStartRequest()
+	if err != nil {
 		return err
 	} else if !resp.Ok {
 		return errors.New("DumpStart response error: " + resp.Msg)
 	}
-	dumpServiceAddr := fmt.Sprintf("%s:%d", p.SrcAddr, LM_HostMsgPort)
-	conn, err := net.Dial("tcp", dumpServiceAddr)
+	msgPort := resp.MsgPort
+	if msgPort == 0 {
+		msgPort = LM_HostMsgPort
+	}
+	p.pageServerPort = resp.PageServerPort
+	if p.pageServerPort == 0 {
+		p.pageServerPort = LM_HostPageServerPort
+	}
+	dumpServiceAddr := fmt.Sprintf("%s:%d", p.SrcAddr, msgPort)
+	conn, err = p.PeerTLS.DialPeer(dumpServiceAddr, 0)
 	if err != nil {
+		conn = nil
 		return err
 	}
-	defer conn.Close()
-	k8sPortFwdCloseChan := make(chan struct{})
-	defer close(k8sPortFwdCloseChan)
-	Logger.Info("[Restore] Open kube port-forward")
-	if err := OpenKubePortForwardReady(p.RestConfig, p.DstNamespace, p.DstPodName,
-		LM_HostDataPort, LM_PodRsyncPort, os.Stdout, os.Stderr, k8sPortFwdCloseChan); err != nil {
+	capabilities, err := p.sendDumpServiceHello(conn)
+	if err != nil {
 		return err
 	}
+	postCopy := p.Mode == MigrationModePostCopy
+	if postCopy && capabilities&LM_CapLazyPages == 0 {
+		return errors.New("Dump service does not support lazy pages for " + MigrationModePostCopy)
+	}
+	if postCopy && capabilities&LM_CapPageServerTunnel == 0 {
+		return errors.New("Dump service does not tunnel the page server for " + MigrationModePostCopy)
+	}
 	iteration := 1
 	if p.Iteration > 0 {
 		iteration = p.Iteration
@@ -137,87 +205,258 @@ func (p *LM_Restore) exec(withFwd bool) (reterr error) {
 	} else {
 		iteration = 0
 	}
-	Logger.DebugF("[Restore] Pre-dump iteration: %d\n", iteration)
+	adaptive := p.AdaptivePreDump
+	preDumpSupported := capabilities&LM_CapPreDump != 0
+	if !preDumpSupported {
+		Logger.Info("[Restore] Skip pre-dump which the dump service does not support")
+		iteration = 0
+		adaptive = nil
+	}
+	if adaptive != nil {
+		Logger.DebugF("[Restore] Adaptive pre-dump: threshold %d bytes, max %d iterations, max %v\n",
+			adaptive.GetThresholdBytes(), adaptive.GetMaxIterations(), adaptive.GetMaxTime())
+	} else {
+		Logger.DebugF("[Restore] Pre-dump iteration: %d\n", iteration)
+	}
+	preDumpCtl := NewPreDumpController(iteration, adaptive)
 	startPreDump := time.Now()
-	for itr := 0; itr < iteration; itr++ {
-		Logger.InfoF("[Restore] Send pre-dump request (%d)\n", (itr + 1))
-		if err := p.sendDumpServiceRequest(conn, LM_MsgReqPreDump); err != nil {
+	itr := 0
+	for {
+		next, reason := preDumpCtl.Next(time.Now().Sub(startPreDump))
+		if !next {
+			if !preDumpSupported {
+				reason = PreDumpStopUnsupported
+			}
+			Logger.Info("[Restore] Stop pre-dump: " + reason)
+			p.Job.SetPreDumpStopReason(reason)
+			break
+		}
+		if err := p.checkCancelled(); err != nil {
 			return err
 		}
+		itr++
+		Logger.InfoF("[Restore] Send pre-dump request (%d)\n", itr)
+		p.Job.SetPreDump(itr)
+		startIteration := time.Now()
+		result, err := p.sendDumpServiceRequest(conn, LM_MsgReqPreDump, itr)
+		if err != nil {
+			return err
+		}
+		stats := receiver.TakeStats()
+		p.Job.AddIteration(itr, MigrationStatePreDump, time.Now().Sub(startIteration), result.ImageSize, stats)
+		size := preDumpSize(result, stats)
+		Logger.DebugF("[Restore] Pre-dump size (%d): %d bytes\n", itr, size)
+		preDumpCtl.Record(size)
+	}
+	preDumpTime := time.Now().Sub(startPreDump)
+	p.Job.SetPreDumpTime(preDumpTime)
+	Logger.DebugF("[Restore] Pre-dump time (ms): %d\n", preDumpTime.Milliseconds())
+	if err := p.checkCancelled(); err != nil {
+		return err
 	}
-	Logger.DebugF("[Restore] Pre-dump time (ms): %d\n", time.Now().Sub(startPreDump).Milliseconds())
 	if withFwd {
-		Logger.Info("[Restore] Suspend forwarding service")
-		p.Fwdsvc.Suspend()
-		defer func() {
-			Logger.Info("[Restore] Resume forwarding service")
-			p.Fwdsvc.Resume()
-		}()
+		Logger.Info("[Restore] Suspend forwarding services")
+		for _, target := range p.FwdTargets {
+			target.Fwdsvc.Suspend()
+		}
+		fwdSuspended = true
 		Logger.Info("[Restore] Close all forwarding streams")
-		p.Fwdsvc.CloseAllForwarders()
+		for _, target := range p.FwdTargets {
+			target.Fwdsvc.CloseAllForwarders()
+		}
 	}
-	Logger.Info("[Restore] Send final dump request")
+	finalDumpReq := byte(LM_MsgReqDump)
+	if postCopy {
+		Logger.Info("[Restore] Send lazy dump request")
+		finalDumpReq = LM_MsgReqLazyDump
+	} else {
+		Logger.Info("[Restore] Send final dump request")
+	}
+	p.Job.SetState(MigrationStateFinalDump)
 	startFinalDump := time.Now()
 	startDowntime := time.Now()
-	if err := p.sendDumpServiceRequest(conn, LM_MsgReqDump); err != nil {
+	result, err := p.sendDumpServiceRequest(conn, finalDumpReq, itr+1)
+	if err != nil {
 		return err
 	}
-	Logger.DebugF("[Restore] Final dump time (ms): %d\n", time.Now().Sub(startFinalDump).Milliseconds())
+	finalDumpTime := time.Now().Sub(startFinalDump)
+	p.Job.SetFinalDumpTime(finalDumpTime)
+	p.Job.AddIteration(itr+1, MigrationStateFinalDump, finalDumpTime, result.ImageSize, receiver.TakeStats())
+	Logger.DebugF("[Restore] Final dump time (ms): %d\n", finalDumpTime.Milliseconds())
+	p.Job.SetState(MigrationStateRestoring)
+	restoreOpts := fmt.Sprintf("--action-script %s", LM_PostResumeScriptPath)
+	if postCopy {
+		Logger.Info("[Restore] Open relay to page server")
+		pod, _, errStack := GetPod(p.Clientset, p.DstNamespace, p.DstPodName)
+		if errStack != nil {
+			return errStack
+		}
+		pageRelayCloseChan := make(chan struct{})
+		defer close(pageRelayCloseChan)
+		tunnelAddr := fmt.Sprintf("%s:%d", p.SrcAddr, p.pageServerPort)
+		if err := OpenPeerTunnelRelay(p.PeerTLS, p.pageRelayPort, p.TransferToken, pod.Status.PodIP,
+			tunnelAddr, pageRelayCloseChan); err != nil {
+			return err
+		}
+		Logger.Info("[Restore] Exec criu lazy-pages")
+		if err := p.startLazyPages(); err != nil {
+			return err
+		}
+		restoreOpts += " --lazy-pages"
+	}
 	Logger.Info("[Restore] Exec unshare criu restore")
-	timeoutChan := make(chan struct{}, 1)
-	go func() {
-		defer close(timeoutChan)
-		time.Sleep(5 * time.Second)
-	}()
+	chanExecErr := make(chan error, 1)
 	go func() {
-		actionScriptOpt := fmt.Sprintf("--action-script %s", LM_PostResumeScriptPath)
-		if err := ExecutePod(p.Clientset, p.RestConfig, p.DstNamespace, p.DstPodName, p.DstContainerName,
-			nil, os.Stdout, os.Stderr, "/bin/sh", "-c", fmt.Sprintf(
-				"unshare -p -m --fork --mount-proc"+
-					" criu restore --images-dir %s/final --shell-job --tcp-close %s &",
-				LM_DumpImagesDir, actionScriptOpt)); err != nil {
-			Logger.ErrorE(err)
-		}
+		chanExecErr <- ExecutePod(p.Clientset, p.RestConfig, p.DstNamespace, p.DstPodName, p.DstContainerName,
+			nil, os.Stdout, os.Stderr, "/bin/sh", "-c", p.getRestoreCommand(restoreOpts))
 	}()
-	for waitForResume := true; waitForResume; {
-		select {
-		case <-resumeChan:
-			Logger.DebugF("[Restore] Estimated downtime (ms): %d\n", time.Now().Sub(startDowntime).Milliseconds())
-			waitForResume = false
-		case <-timeoutChan:
-			Logger.Warn("[Restore] Waiting for resume timeout")
-			waitForResume = false
-		default:
-			time.Sleep(10 * time.Millisecond)
-		}
+	resumedAt, err := p.waitForResume(resumeListener, chanExecErr)
+	if err != nil {
+		return err
 	}
+	downtime := resumedAt.Sub(startDowntime)
+	p.Job.SetDowntime(downtime)
+	Logger.DebugF("[Restore] Estimated downtime (ms): %d\n", downtime.Milliseconds())
 	if withFwd {
 		Logger.Info("[Restore] Change forwarding dst addr to the restored pod")
-		p.Fwdsvc.ChangeServerAddr(p.DstPodAddr)
-		p.Fwdsvc.ChangeDataRate(0)
+		if err := p.changeFwdTargets(); err != nil {
+			return err
+		}
+	}
+	if capabilities&LM_CapComplete != 0 {
+		// The migration has succeeded even if the source app cannot be stopped
+		Logger.Info("[Restore] Send complete request")
+		if _, err := p.sendDumpServiceRequest(conn, LM_MsgReqComplete, 0); err != nil {
+			Logger.Warn("[Restore] Complete request: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// changeFwdTargets changes the forwarding services suspended to the restored pod. If any of them
+// fails, the services already changed are reverted so that the forwarding keeps pointing to the source.
+func (p *LM_Restore) changeFwdTargets() error {
+	srcAddrs := make([]string, len(p.FwdTargets))
+	dataRates := make([]int, len(p.FwdTargets))
+	for i, target := range p.FwdTargets {
+		srcAddrs[i] = target.Fwdsvc.ServerAddr().String()
+		dataRates[i] = target.Fwdsvc.DataRate()
+	}
+	for i, target := range p.FwdTargets {
+		if err := target.Fwdsvc.ChangeServerAddr(target.DstAddr); err != nil {
+			for j := 0; j < i; j++ {
+				if err := p.FwdTargets[j].Fwdsvc.ChangeServerAddr(srcAddrs[j]); err != nil {
+					Logger.ErrorE(err)
+				}
+				p.FwdTargets[j].Fwdsvc.ChangeDataRate(dataRates[j])
+			}
+			return err
+		}
+		target.Fwdsvc.ChangeDataRate(0)
 	}
 	return nil
 }
 
+// startLazyPages runs the lazy-pages daemon of criu in the restored pod, which fetches the memory
+// pages through the relay at pageRelayPort of this host, and waits until it is ready.
+func (p *LM_Restore) startLazyPages() error {
+	statusFifo := LM_DumpImagesDir + "/lazy-pages.status"
+	cmd := fmt.Sprintf("rm -f %[1]s && mkfifo %[1]s"+
+		" && (criu lazy-pages --page-server --address %[2]s --port %[3]d --images-dir %[4]s/final"+
+		" -o lazy-pages.log --status-fd 3 3>%[1]s >/dev/null 2>&1 &)"+
+		" && test \"$(head -c 1 %[1]s | wc -c)\" -eq 1",
+		statusFifo, p.ThisAddr, p.pageRelayPort, LM_DumpImagesDir)
+	if err := ExecutePod(p.Clientset, p.RestConfig, p.DstNamespace, p.DstPodName, p.DstContainerName,
+		nil, os.Stdout, os.Stderr, "/bin/sh", "-c", cmd); err != nil {
+		return errors.Wrap(err, "criu lazy-pages is not ready")
+	}
+	return nil
+}
+
+func (p *LM_Restore) allocatePorts() error {
+	dataPort, err := p.Ports.Allocate()
+	if err != nil {
+		return err
+	}
+	resumeSigPort, err := p.Ports.Allocate()
+	if err != nil {
+		p.Ports.Release(dataPort)
+		return err
+	}
+	if p.Mode == MigrationModePostCopy {
+		pageRelayPort, err := p.Ports.Allocate()
+		if err != nil {
+			p.Ports.Release(dataPort, resumeSigPort)
+			return err
+		}
+		p.pageRelayPort = pageRelayPort
+	}
+	p.dataPort = dataPort
+	p.resumeSigPort = resumeSigPort
+	return nil
+}
+
+func (p *LM_Restore) checkCancelled() error {
+	select {
+	case <-p.Job.Cancelled():
+		return errors.New("Migration cancelled")
+	default:
+		return nil
+	}
+}
+
+// rollback resumes the source process. The forwarding services of ExecFwdLM keep pointing to the
+// source and are resumed, and the destination pod and service are torn down by APICore.
+func (p *LM_Restore) rollback(conn net.Conn) {
+	p.Job.SetState(MigrationStateRollingBack)
+	if conn != nil {
+		Logger.Info("[Restore] Send rollback request")
+		if _, err := p.sendDumpServiceRequest(conn, LM_MsgReqRollback, 0); err != nil {
+			Logger.ErrorE(err)
+		}
+	}
+}
+
 func (p *LM_Restore) sendDumpStartRequest() (*Response, error) {
 	req := &Request{
 		Method: "_dumpStart",
 		DumpStart: RequestDumpStart{
-			Name:    p.SrcName,
-			DstAddr: p.ThisAddr,
-			BwLimit: p.BwLimit,
+			Name:             p.SrcName,
+			Namespace:        p.SrcNamespace,
+			Pod:              p.SrcPod,
+			Cluster:          p.SrcCluster,
+			DstAddr:          p.ThisAddr,
+			DstDataPort:      p.dataPort,
+			BwLimit:          p.BwLimit,
+			Transfer:         p.Transfer,
+			TransferToken:    p.TransferToken,
+			Compression:      p.Compression,
+			CompressionLevel: p.CompressionLevel,
+			Dedup:            p.Dedup,
+			Mode:             p.Mode,
 		},
 	}
+	return SendAPIRequest(p.PeerTLS, p.SrcAPIServerAddr, req, 0)
+}
+
+// SendAPIRequest sends req to the API server of the cloudlet at addr and returns the response.
+// There is no timeout if timeout is 0.
+func SendAPIRequest(peerTLS *PeerTLS, addr string, req *Request, timeout time.Duration) (*Response, error) {
 	breq, err := json.Marshal(req)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 	breq = append(breq, []byte("\n")...)
-	conn, err := net.Dial("tcp", p.SrcAPIServerAddr)
+	conn, err := peerTLS.DialPeer(addr, timeout)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, err
 	}
 	defer conn.Close()
+	if timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
 	_, err = conn.Write(breq)
 	if err != nil {
 		return nil, errors.WithStack(err)
@@ -233,22 +472,50 @@ func (p *LM_Restore) sendDumpStartRequest() (*Response, error) {
 	return &resp, nil
 }
 
-func (p *LM_Restore) sendDumpServiceRequest(conn net.Conn, req byte) error {
-	reqbuf := []byte{req}
-	if _, err := conn.Write(reqbuf); err != nil {
-		return errors.WithStack(err)
+// sendDumpServiceHello negotiates the protocol version, and returns the capabilities of the dump service.
+func (p *LM_Restore) sendDumpServiceHello(conn net.Conn) (uint64, error) {
+	hello := &LM_Msg{Type: LM_MsgHello, Version: LM_ProtocolVersion}
+	if err := WriteLM_Msg(conn, hello); err != nil {
+		return 0, err
 	}
-	respbuf := make([]byte, 1)
-	if n, err := conn.Read(respbuf); !(n > 0) {
-		if err != nil {
-			return errors.WithStack(err)
-		} else {
-			return errors.New("Read 0 bytes")
+	ack, err := ReadLM_Msg(conn)
+	if err != nil {
+		return 0, err
+	}
+	if ack.Type != LM_MsgHelloAck {
+		return 0, errors.New("Unexpected response to hello: " + ack.String())
+	}
+	if ack.Error != "" {
+		return 0, errors.New("Dump service rejected hello: " + ack.Error)
+	}
+	if ack.Version < LM_ProtocolMinVersion || ack.Version > LM_ProtocolVersion {
+		return 0, errors.New(fmt.Sprintf("Unsupported protocol version of dump service: %d", ack.Version))
+	}
+	Logger.DebugF("[Restore] Dump service protocol version: %d, capabilities: 0x%x\n",
+		ack.Version, ack.Capabilities)
+	return ack.Capabilities, nil
+}
+
+// sendDumpServiceRequest sends the request of iteration and returns the result if it succeeded.
+func (p *LM_Restore) sendDumpServiceRequest(conn net.Conn, req byte, iteration int) (*LM_Msg, error) {
+	if err := WriteLM_Msg(conn, &LM_Msg{Type: req, Iteration: iteration}); err != nil {
+		return nil, err
+	}
+	result, err := ReadLM_Msg(conn)
+	if err != nil {
+		if err == io.EOF {
+			return nil, errors.New("Dump service closed the connection")
 		}
-	} else if respbuf[0] != LM_MsgRespOk {
-		return stderrors.New("Dump service respond an error")
+		return nil, err
 	}
-	return nil
+	if result.Type != LM_MsgResult || result.Iteration != iteration {
+		return nil, errors.New("Unexpected result: " + result.String())
+	}
+	if result.Error != "" {
+		return nil, stderrors.New("Dump service respond an error: " + result.Error)
+	}
+	Logger.DebugF("[Restore] Dump service result: %s\n", result.String())
+	return result, nil
 }
 
 type LM_DumpService struct {
@@ -259,18 +526,38 @@ type LM_DumpService struct {
 	PodName       string
 	ContainerName string
 	DstAddr       string
-	BwLimit       int
+	// IsLocal is true if the destination is this host, where the data port is already open
+	IsLocal bool
+	BwLimit int
+	// Checkpoint is the checkpoint backend of the source deployment
+	Checkpoint       string
+	Transfer         string
+	TransferToken    string
+	Compression      string
+	CompressionLevel int
+	Dedup            bool
+	// MsgPort, TunnelPort and PageServerPort are the ports of this host allocated for the migration,
+	// and DstDataPort is the port of DstAddr which receives the images
+	MsgPort        int
+	DstDataPort    int
+	TunnelPort     int
+	PageServerPort int
+	PeerTLS        *PeerTLS
+	// OnFinish is called when the dump service finishes
+	OnFinish func()
+	sender   ImageSender
 }
 
 func (p *LM_DumpService) Start() (reterr error) {
 	defer func() {
 		if reterr != nil {
 			Logger.Warn("[Dump] Abort")
+			p.finish()
 		} else {
 			Logger.Info("[Dump] Complete")
 		}
 	}()
-	lnAddr := fmt.Sprintf(":%d", LM_HostMsgPort)
+	lnAddr := fmt.Sprintf(":%d", p.MsgPort)
 	lnTCPAddr, err := net.ResolveTCPAddr("tcp", lnAddr)
 	if err != nil {
 		return err
@@ -285,106 +572,91 @@ func (p *LM_DumpService) Start() (reterr error) {
 			ln.Close()
 		}
 	}()
-	sshClient, err := NewSSHClient(TheAPICore.HostConf)
+	sender, err := NewImageSender(p)
 	if err != nil {
 		return err
 	}
-	hostEndAddr := fmt.Sprintf("%s:%d", p.ThisAddr, LM_HostDataPort)
-	remoteEndAddr := fmt.Sprintf("%s:%d", p.DstAddr, LM_HostDataPort)
-	sshCloseChan := make(chan struct{})
+	p.sender = sender
 	defer func() {
 		if reterr != nil {
-			close(sshCloseChan)
+			sender.Close()
 		}
 	}()
-	Logger.Info("[Dump] Open SSH tunnel")
-	if err := sshClient.OpenTunnel(hostEndAddr, remoteEndAddr, sshCloseChan); err != nil {
-		return err
-	}
-	Logger.Info("[Dump] Get main pid")
-	pid, err := p.getMainPid()
+	checkpointer, err := NewCheckpointer(p)
 	if err != nil {
 		return err
 	}
-	rsyncBw := p.getRsyncBandwidth()
-	rsyncBwOpt := ""
-	if rsyncBw > 0 {
-		rsyncBwOpt = fmt.Sprintf("--bwlimit=%d", rsyncBw)
+	if err := ln.SetDeadline(time.Now().Add(LM_DumpAcceptTimeout)); err != nil {
+		checkpointer.Close()
+		return errors.WithStack(err)
 	}
 	go func() {
 		defer func() {
-			close(sshCloseChan)
+			checkpointer.Close()
+			sender.Close()
 			ln.Close()
+			p.finish()
 		}()
 		conn, err := ln.Accept()
 		if err != nil {
 			Logger.ErrorE(err)
 			return
 		}
+		conn, err = p.PeerTLS.ServerPeer(conn)
+		if err != nil {
+			Logger.ErrorE(err)
+			return
+		}
 		defer conn.Close()
-		reqbuf := make([]byte, 1)
+		if err := p.acceptHello(conn, checkpointer); err != nil {
+			Logger.ErrorE(err)
+			return
+		}
+		finalDumped := false
 		for itercnt := 1; true; itercnt++ {
-			if n, err := conn.Read(reqbuf); !(n > 0) {
+			req, err := ReadLM_Msg(conn)
+			if err != nil {
 				if err == io.EOF {
 					Logger.Info("[Dump][svc] Received EOF")
-				} else if err != nil {
-					Logger.ErrorE(err)
 				} else {
-					Logger.ErrorE(errors.New("Read 0 bytes"))
+					Logger.ErrorE(err)
 				}
 				return
 			}
-			req := reqbuf[0]
-			var resp byte
-			if req == LM_MsgReqPreDump {
-				argb := strings.Builder{}
-				fmt.Fprintf(&argb, "mkdir -p %s/%d", LM_DumpImagesDir, itercnt)
-				imagesDir := fmt.Sprintf("%s/%d", LM_DumpImagesDir, itercnt)
-				prevImagesDirOpt := ""
-				if itercnt > 1 {
-					prevImagesDirOpt = fmt.Sprintf("--prev-images-dir ../%d", itercnt-1)
+			start := time.Now()
+			size := int64(0)
+			if req.Type != LM_MsgReqRollback && req.Type != LM_MsgReqComplete && req.Iteration != itercnt {
+				err = errors.New(fmt.Sprintf("Unexpected iteration: %d != %d", req.Iteration, itercnt))
+			} else if req.Type == LM_MsgReqPreDump {
+				size, err = checkpointer.PreDump(itercnt)
+			} else if req.Type == LM_MsgReqDump {
+				finalDumped = true
+				size, err = checkpointer.Dump(itercnt)
+			} else if req.Type == LM_MsgReqLazyDump {
+				finalDumped = true
+				size, err = checkpointer.LazyDump(itercnt)
+			} else if req.Type == LM_MsgReqRollback || req.Type == LM_MsgReqComplete {
+				if finalDumped {
+					if req.Type == LM_MsgReqRollback {
+						err = checkpointer.Rollback()
+					} else {
+						err = checkpointer.Complete()
+					}
 				}
-				fmt.Fprintf(&argb, " && criu pre-dump --tree %d --images-dir %s %s --tcp-close --shell-job",
-					pid, imagesDir, prevImagesDirOpt)
-				fmt.Fprintf(&argb, " && rsync %s -rlOt %s/ rsync://%s:%d/%s",
-					rsyncBwOpt, LM_RsyncModuleDirectory, p.ThisAddr, LM_HostDataPort, LM_RsyncModuleName)
-				Logger.Info("[Dump][svc] Exec mkdir && criu pre-dump && rsync")
-				if rsyncBwOpt != "" {
-					Logger.InfoF("[Dump][svc] Rsync bandwidth: %d KiB/s\n", rsyncBw)
-				}
-				if err := ExecutePod(p.Clientset, p.RestConfig, p.Namespace, p.PodName, p.ContainerName,
-					nil, os.Stdout, os.Stderr, "/bin/sh", "-c", argb.String()); err != nil {
+				if err != nil {
 					Logger.ErrorE(err)
-					resp = LM_MsgRespError
-				} else {
-					resp = LM_MsgRespOk
-				}
-			} else if req == LM_MsgReqDump {
-				argb := strings.Builder{}
-				fmt.Fprintf(&argb, "mkdir -p %s/final", LM_DumpImagesDir)
-				imagesDir := fmt.Sprintf("%s/final", LM_DumpImagesDir)
-				prevImagesDirOpt := ""
-				if itercnt > 1 {
-					prevImagesDirOpt = fmt.Sprintf("--prev-images-dir ../%d", itercnt-1)
 				}
-				fmt.Fprintf(&argb, " && criu dump --tree %d --images-dir %s %s --tcp-close --shell-job --track-mem",
-					pid, imagesDir, prevImagesDirOpt)
-				fmt.Fprintf(&argb, " && rsync -rlOt %s/ rsync://%s:%d/%s",
-					LM_RsyncModuleDirectory, p.ThisAddr, LM_HostDataPort, LM_RsyncModuleName)
-				Logger.Info("[Dump][svc] Exec mkdir && criu dump && rsync")
-				if err := ExecutePod(p.Clientset, p.RestConfig, p.Namespace, p.PodName, p.ContainerName,
-					nil, os.Stdout, os.Stderr, "/bin/sh", "-c", argb.String()); err != nil {
+				if err := WriteLM_Msg(conn, NewLM_MsgResult(req.Iteration, 0, time.Now().Sub(start), err)); err != nil {
 					Logger.ErrorE(err)
-					resp = LM_MsgRespError
-				} else {
-					resp = LM_MsgRespOk
 				}
+				return
 			} else {
-				Logger.ErrorF("[Dump][svc] Unexpected message: %x\n", req)
-				resp = LM_MsgRespError
+				err = errors.New(fmt.Sprintf("Unexpected message: 0x%02x", req.Type))
 			}
-			respbuf := []byte{resp}
-			if _, err := conn.Write(respbuf); err != nil {
+			if err != nil {
+				Logger.ErrorE(err)
+			}
+			if err := WriteLM_Msg(conn, NewLM_MsgResult(req.Iteration, size, time.Now().Sub(start), err)); err != nil {
 				Logger.ErrorE(err)
 				return
 			}
@@ -393,17 +665,41 @@ func (p *LM_DumpService) Start() (reterr error) {
 	return nil
 }
 
-func (p *LM_DumpService) getMainPid() (int, error) {
-	v, err := ReadPodFile(p.Clientset, p.RestConfig, p.Namespace, p.PodName, p.ContainerName, os.Stderr,
-		MainPidFilePath)
+// acceptHello negotiates the protocol version, and sends the capabilities of checkpointer.
+func (p *LM_DumpService) acceptHello(conn net.Conn, checkpointer Checkpointer) error {
+	hello, err := ReadLM_Msg(conn)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	ans, err := strconv.Atoi(v)
-	if err != nil {
-		return 0, errors.WithStack(err)
+	ack := &LM_Msg{Type: LM_MsgHelloAck, Version: LM_ProtocolVersion}
+	if hello.Version < ack.Version {
+		ack.Version = hello.Version
+	}
+	if hello.Type != LM_MsgHello {
+		ack.Error = "Expected hello: " + hello.String()
+	} else if ack.Version < LM_ProtocolMinVersion {
+		ack.Error = fmt.Sprintf("Unsupported protocol version: %d", hello.Version)
+	}
+	if checkpointer.SupportsPreDump() {
+		ack.Capabilities |= LM_CapPreDump
+	}
+	if checkpointer.SupportsLazyPages() {
+		ack.Capabilities |= LM_CapLazyPages | LM_CapPageServerTunnel
+	}
+	ack.Capabilities |= LM_CapComplete
+	if err := WriteLM_Msg(conn, ack); err != nil {
+		return err
+	}
+	if ack.Error != "" {
+		return errors.New(ack.Error)
+	}
+	return nil
+}
+
+func (p *LM_DumpService) finish() {
+	if p.OnFinish != nil {
+		p.OnFinish()
 	}
-	return ans, nil
 }
 
 func (p *LM_DumpService) getRsyncBandwidth() int {
@@ -13,6 +13,7 @@ import (
 
 const (
 	APIServerPort          = 9999
+	HTTPServerPort         = 9990
 	RequestTimeout         = 30
 	DefaultGatewayIf       = "docker0"
 	Env_InterhostBandwidth = "INTERHOST_BANDWIDTH"
@@ -62,15 +63,37 @@ func main() {
 	// if bandwidth > 0 {
 	// 	fmt.Printf("Interhost bandwidth: %d Mbps\n", bandwidth)
 	// }
-	TheAPICore = NewAPICore(hostConf, hostAddr, gatewayAddr)
-	fmt.Println("Interface IP addresses:")
-	if err := PrintInterfaceAddrs("- "); err != nil {
+	registry, err := LoadRegistry(hostConf)
+	if err != nil {
+		panic(err)
+	}
+	clients, err := NewKubeClients(hostConf)
+	if err != nil {
 		panic(err)
 	}
+	peerTLS, err := NewPeerTLS(hostConf.TLS)
+	if err != nil {
+		panic(err)
+	}
+	TheAPICore = NewAPICore(hostConf, hostAddr, gatewayAddr, registry,
+		NewClusterClientFactory(clients), peerTLS)
+	if err := TheAPICore.Reconcile(); err != nil {
+		Logger.ErrorE(err)
+	}
 	apiServerAddr := fmt.Sprintf(":%d", APIServerPort)
 	chanClose := make(chan interface{})
-	go StartAPIServer(apiServerAddr, chanClose)
+	for _, client := range clients {
+		go TheAPICore.WatchPods(client.Name, client.Clientset, chanClose)
+	}
+	fmt.Println("Interface IP addresses:")
+	if err := PrintInterfaceAddrs("- "); err != nil {
+		panic(err)
+	}
+	go StartAPIServer(apiServerAddr, peerTLS, chanClose)
 	fmt.Println("API server is starting at: " + apiServerAddr)
+	httpServerAddr := fmt.Sprintf(":%d", HTTPServerPort)
+	go StartHTTPServer(httpServerAddr, peerTLS, chanClose)
+	fmt.Println("HTTP server is starting at: " + httpServerAddr)
 	if interactive {
 		startCommandLine()
 	} else {
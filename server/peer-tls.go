@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	PeerTLSHandshakeTimeout = 10 * time.Second
+)
+
+// PeerTLS authenticates the API server and the connections between the cloudlets with mutual TLS.
+// The API server accepts the clients with a certificate signed by the CA, and the connections
+// between the cloudlets also require the peer to be one of the allowed peers.
+// A nil PeerTLS uses plain TCP.
+type PeerTLS struct {
+	cert         tls.Certificate
+	roots        *x509.CertPool
+	allowedPeers map[string]bool
+}
+
+// NewPeerTLS loads the certificates of conf. It returns nil if conf is nil.
+func NewPeerTLS(conf *TLSConf) (*PeerTLS, error) {
+	if conf == nil {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(conf.CertPath, conf.KeyPath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	b, err := ioutil.ReadFile(conf.CAPath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(b) {
+		return nil, errors.New("No CA certificate in " + conf.CAPath)
+	}
+	allowedPeers := map[string]bool{}
+	for _, peer := range conf.AllowedPeers {
+		allowedPeers[peer] = true
+	}
+	return &PeerTLS{
+		cert:         cert,
+		roots:        roots,
+		allowedPeers: allowedPeers,
+	}, nil
+}
+
+// Listen listens at addr for the API clients. The peer of a connection accepted is checked by
+// IsAllowedConn after the first read, which completes the handshake.
+func (p *PeerTLS) Listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if p == nil {
+		return ln, nil
+	}
+	return tls.NewListener(ln, p.serverConfig(false)), nil
+}
+
+// ServerPeer runs the handshake of conn accepted from a cloudlet, which must be an allowed peer.
+// conn is closed if the handshake fails.
+func (p *PeerTLS) ServerPeer(conn net.Conn) (net.Conn, error) {
+	if p == nil {
+		return conn, nil
+	}
+	return handshakeTLS(tls.Server(conn, p.serverConfig(true)))
+}
+
+// DialPeer connects to the cloudlet at addr, which must be an allowed peer.
+// There is no timeout of the dial if timeout is 0.
+func (p *PeerTLS) DialPeer(addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if p == nil {
+		return conn, nil
+	}
+	return handshakeTLS(tls.Client(conn, p.clientConfig()))
+}
+
+// IsAllowedConn returns true if the peer of conn accepted by Listen is an allowed peer.
+func (p *PeerTLS) IsAllowedConn(conn net.Conn) bool {
+	if p == nil {
+		return true
+	}
+	tconn, ok := conn.(*tls.Conn)
+	if !ok {
+		return false
+	}
+	certs := tconn.ConnectionState().PeerCertificates
+	return len(certs) > 0 && p.IsAllowed(certs[0])
+}
+
+// IsAllowed returns true if any identity of cert is an allowed peer, or no allowed peer is given.
+func (p *PeerTLS) IsAllowed(cert *x509.Certificate) bool {
+	if len(p.allowedPeers) == 0 {
+		return true
+	}
+	for _, id := range PeerIdentities(cert) {
+		if p.allowedPeers[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// PeerIdentities returns the identities of cert, which are its common name and DNS names.
+func PeerIdentities(cert *x509.Certificate) []string {
+	ids := []string{}
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	return append(ids, cert.DNSNames...)
+}
+
+func (p *PeerTLS) serverConfig(allowedOnly bool) *tls.Config {
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{p.cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    p.roots,
+		MinVersion:   tls.VersionTLS12,
+	}
+	if allowedOnly {
+		conf.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+			if len(chains) == 0 || len(chains[0]) == 0 {
+				return errors.New("No verified peer certificate")
+			}
+			return p.checkAllowed(chains[0][0])
+		}
+	}
+	return conf
+}
+
+// clientConfig verifies the certificate of the server by the CA and the allowed peers instead of
+// the host name, since the cloudlets are dialed by address.
+func (p *PeerTLS) clientConfig() *tls.Config {
+	return &tls.Config{
+		Certificates:          []tls.Certificate{p.cert},
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: p.verifyServer,
+		MinVersion:            tls.VersionTLS12,
+	}
+}
+
+func (p *PeerTLS) verifyServer(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("No peer certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		certs[i] = cert
+	}
+	opts := x509.VerifyOptions{
+		Roots:         p.roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return errors.WithStack(err)
+	}
+	return p.checkAllowed(certs[0])
+}
+
+func (p *PeerTLS) checkAllowed(cert *x509.Certificate) error {
+	if !p.IsAllowed(cert) {
+		return errors.New("Peer is not allowed: " + cert.Subject.CommonName)
+	}
+	return nil
+}
+
+func handshakeTLS(conn *tls.Conn) (net.Conn, error) {
+	if err := conn.SetDeadline(time.Now().Add(PeerTLSHandshakeTimeout)); err != nil {
+		conn.Close()
+		return nil, errors.WithStack(err)
+	}
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "TLS handshake")
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, errors.WithStack(err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// newTestPeerTLS returns PeerTLS with the certificate of name signed by ca.
+func newTestPeerTLS(t *testing.T, ca *testCA, name string, allowedPeers ...string) *PeerTLS {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bkey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "cloudlet-tls-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	conf := &TLSConf{
+		CertPath:     filepath.Join(dir, "cert.pem"),
+		KeyPath:      filepath.Join(dir, "key.pem"),
+		CAPath:       filepath.Join(dir, "ca.pem"),
+		AllowedPeers: allowedPeers,
+	}
+	files := map[string][]byte{
+		conf.CertPath: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		conf.KeyPath:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: bkey}),
+		conf.CAPath:   ca.pem,
+	}
+	for path, b := range files {
+		if err := ioutil.WriteFile(path, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	peerTLS, err := NewPeerTLS(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return peerTLS
+}
+
+// dialTestPeer connects client to server by DialPeer and ServerPeer, and returns their errors.
+func dialTestPeer(t *testing.T, server *PeerTLS, client *PeerTLS) (error, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	chanServerErr := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			chanServerErr <- err
+			return
+		}
+		conn, err = server.ServerPeer(conn)
+		if err == nil {
+			_, err = conn.Write([]byte{LM_MsgRespOk})
+			conn.Close()
+		}
+		chanServerErr <- err
+	}()
+	conn, clientErr := client.DialPeer(ln.Addr().String(), time.Second)
+	if clientErr == nil {
+		b := make([]byte, 1)
+		_, clientErr = io.ReadFull(conn, b)
+		conn.Close()
+	}
+	return <-chanServerErr, clientErr
+}
+
+func TestPeerTLSAllowedPeers(t *testing.T) {
+	ca := newTestCA(t)
+	a := newTestPeerTLS(t, ca, "cloudlet-a", "cloudlet-b")
+	b := newTestPeerTLS(t, ca, "cloudlet-b", "cloudlet-a")
+	c := newTestPeerTLS(t, ca, "cloudlet-c")
+	other := newTestPeerTLS(t, newTestCA(t), "cloudlet-b")
+
+	if serverErr, clientErr := dialTestPeer(t, a, b); serverErr != nil || clientErr != nil {
+		t.Errorf("b -> a: %v, %v", serverErr, clientErr)
+	}
+	// c allows any peer, but a does not allow c
+	if serverErr, _ := dialTestPeer(t, a, c); serverErr == nil {
+		t.Error("c -> a: accepted")
+	}
+	if _, clientErr := dialTestPeer(t, c, a); clientErr == nil {
+		t.Error("a -> c: connected")
+	}
+	if serverErr, _ := dialTestPeer(t, a, other); serverErr == nil {
+		t.Error("b of other CA -> a: accepted")
+	}
+	if serverErr, clientErr := dialTestPeer(t, nil, nil); serverErr != nil || clientErr != nil {
+		t.Errorf("plain TCP: %v, %v", serverErr, clientErr)
+	}
+}
+
+func TestPeerTLSListen(t *testing.T) {
+	ca := newTestCA(t)
+	server := newTestPeerTLS(t, ca, "cloudlet-a", "cloudlet-b")
+	ln, err := server.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	for _, tc := range []struct {
+		name    string
+		allowed bool
+	}{
+		{"cloudlet-b", true},
+		{"admin", false},
+	} {
+		chanAllowed := make(chan bool, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				chanAllowed <- false
+				return
+			}
+			defer conn.Close()
+			b := make([]byte, 1)
+			if _, err := conn.Read(b); err != nil {
+				chanAllowed <- false
+				return
+			}
+			chanAllowed <- server.IsAllowedConn(conn)
+		}()
+		// The API server accepts any client signed by the CA, and the client accepts the server
+		conn, err := newTestPeerTLS(t, ca, tc.name, "cloudlet-a").DialPeer(ln.Addr().String(), time.Second)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if _, err := conn.Write([]byte{0}); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if allowed := <-chanAllowed; allowed != tc.allowed {
+			t.Errorf("%s: allowed = %v, want %v", tc.name, allowed, tc.allowed)
+		}
+		conn.Close()
+	}
+}
+
+func TestHTTPServerTLS(t *testing.T) {
+	ca := newTestCA(t)
+	server := newTestPeerTLS(t, ca, "cloudlet-a")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	chanClose := make(chan interface{})
+	defer close(chanClose)
+	go StartHTTPServer(addr, server, chanClose)
+	get := func(client *PeerTLS) (*http.Response, error) {
+		// The client without certificate trusts any server
+		conf := &tls.Config{InsecureSkipVerify: true}
+		if client != nil {
+			conf = client.clientConfig()
+		}
+		httpClient := &http.Client{Timeout: time.Second, Transport: &http.Transport{TLSClientConfig: conf}}
+		return httpClient.Get("https://" + addr + HTTPPathMigrations)
+	}
+	// Wait for the server to listen
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	resp, err := get(newTestPeerTLS(t, ca, "admin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("status = %d", resp.StatusCode)
+	}
+	if _, err := get(nil); err == nil {
+		t.Error("client without certificate is accepted")
+	}
+	if _, err := get(newTestPeerTLS(t, newTestCA(t), "admin")); err == nil {
+		t.Error("client of other CA is accepted")
+	}
+}
+
+func TestNewPeerTLSNil(t *testing.T) {
+	peerTLS, err := NewPeerTLS(nil)
+	if err != nil || peerTLS != nil {
+		t.Fatalf("NewPeerTLS(nil) = %v, %v", peerTLS, err)
+	}
+	if !peerTLS.IsAllowedConn(nil) {
+		t.Error("plain TCP is not allowed")
+	}
+}
+
+func TestHostConfValidateTLS(t *testing.T) {
+	for _, tc := range []struct {
+		conf *TLSConf
+		ok   bool
+	}{
+		{nil, true},
+		{&TLSConf{CertPath: "c", KeyPath: "k", CAPath: "ca"}, true},
+		{&TLSConf{CertPath: "c", KeyPath: "k", CAPath: "ca", AllowedPeers: []string{"a"}}, true},
+		{&TLSConf{CertPath: "c", KeyPath: "k"}, false},
+		{&TLSConf{CertPath: "c", KeyPath: "k", CAPath: "ca", AllowedPeers: []string{""}}, false},
+	} {
+		err := (&HostConf{TLS: tc.conf}).validateTLS()
+		if (err == nil) != tc.ok {
+			t.Errorf("%+v: err = %v", tc.conf, err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	PodWatcherResync = 5 * time.Minute
+)
+
+const (
+	// PodFailurePolicyNone only records the failure in the deployment status
+	PodFailurePolicyNone    = "none"
+	PodFailurePolicySuspend = "suspend"
+	PodFailurePolicyClose   = "close"
+)
+
+// WatchPods watches the pods created by this server in the cluster until chanClose is closed.
+// When a deployed pod crashes, is evicted or is deleted, the failure is recorded in the deployment
+// status and the forwarding services are handled according to HostConf.PodFailurePolicy.
+func (p *APICore) WatchPods(cluster string, clientset kubernetes.Interface, chanClose chan interface{}) {
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, PodWatcherResync,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = ManagedByLabel + "=" + ManagedBy
+		}))
+	informer := factory.Core().V1().Pods().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if pod, ok := obj.(*apiv1.Pod); ok {
+				p.onPodChanged(cluster, pod, false)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if pod, ok := newObj.(*apiv1.Pod); ok {
+				p.onPodChanged(cluster, pod, false)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if pod, ok := obj.(*apiv1.Pod); ok {
+				p.onPodChanged(cluster, pod, true)
+			}
+		},
+	})
+	chanStop := make(chan struct{})
+	factory.Start(chanStop)
+	Logger.Info("Pod watcher started: " + cluster)
+	<-chanClose
+	close(chanStop)
+	Logger.Info("Pod watcher close: " + cluster)
+}
+
+// onPodChanged records the failure or the recovery of the pod of the deployment. The informer handler
+// must not wait for res.mux, which Deploy and Remove hold while waiting for the pods, so the forwarding
+// services are changed by syncPodFailure in another goroutine.
+func (p *APICore) onPodChanged(cluster string, pod *apiv1.Pod, deleted bool) {
+	name := pod.Labels["app"]
+	val, ok := p.resmap.Load(resKey{cluster: cluster, namespace: pod.Namespace, name: name})
+	if !ok {
+		return
+	}
+	res := val.(*DeployResource)
+	deployType, namespace, _ := res.info()
+	if deployType == "" || deployType == DeployTypeFwd {
+		return
+	}
+	if pod.Namespace != namespace || pod.Name != ToPodName(name) {
+		return
+	}
+	var podErr error
+	if deleted {
+		podErr = &PodFailedError{PodName: pod.Name, Reason: PodReasonDeleted}
+	} else {
+		podErr = checkPodFailed(pod)
+	}
+	if podErr == nil {
+		if res.setPodError("") != "" {
+			Logger.Info("Pod recovered: " + pod.Name)
+			go p.syncPodFailure(res, name)
+		}
+		return
+	}
+	if res.setPodError(podErr.Error()) != "" {
+		return
+	}
+	Logger.Warn("Pod failure detected: " + podErr.Error())
+	go p.syncPodFailure(res, name)
+}
+
+// syncPodFailure applies the pod failure policy to the forwarding services by the pod error recorded
+// last, so that the changes are not reordered even if the goroutines run out of order.
+func (p *APICore) syncPodFailure(res *DeployResource, name string) {
+	res.muxWatcher.Lock()
+	defer res.muxWatcher.Unlock()
+	_, _, fwdsvcs := res.info()
+	if res.getPodError() == "" {
+		if res.setSuspendedByWatcher(false) {
+			Logger.Info("Resume forwarding services of " + name)
+			for _, fwdsvc := range fwdsvcs {
+				fwdsvc.Resume()
+			}
+		}
+		return
+	}
+	if res.isMigrating() {
+		// The migration rolls back by itself and its forwarding must not be touched
+		return
+	}
+	switch p.HostConf.PodFailurePolicy {
+	case PodFailurePolicySuspend:
+		if res.setSuspendedByWatcher(true) {
+			return
+		}
+		Logger.Info("Suspend forwarding services of " + name)
+		for _, fwdsvc := range fwdsvcs {
+			if !fwdsvc.IsSuspended() {
+				fwdsvc.Suspend()
+			}
+		}
+	case PodFailurePolicyClose:
+		if len(fwdsvcs) == 0 || !res.takeFwdsvcsIf(fwdsvcs) {
+			return
+		}
+		Logger.Info("Close forwarding services of " + name)
+		for _, fwdsvc := range fwdsvcs {
+			if err := fwdsvc.Close(); err != nil {
+				Logger.Warn(err.Error())
+			}
+		}
+	}
+}
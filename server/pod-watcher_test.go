@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// startTestPodWatcher deploys app with the pod failure policy and starts watching its pod.
+func startTestPodWatcher(t *testing.T, policy string) (*APICore, *fake.Clientset, *DeployResource) {
+	core, clientset := newTestAPICore(t)
+	core.HostConf.PodFailurePolicy = policy
+	if _, err := core.Deploy(newTestDeployRequest("app", PortSpec{In: 8888, Ext: 0})); err != nil {
+		t.Fatal(err)
+	}
+	chanClose := make(chan interface{})
+	go core.WatchPods(DefaultClusterName, clientset, chanClose)
+	t.Cleanup(func() {
+		close(chanClose)
+		core.Remove(newTestRemoveRequest("app"))
+	})
+	return core, clientset, core.loadResource(DefaultClusterName, DefaultNamespace, "app")
+}
+
+func updateTestPod(t *testing.T, clientset *fake.Clientset, f func(pod *apiv1.Pod)) {
+	pods := clientset.CoreV1().Pods(DefaultNamespace)
+	pod, err := pods.Get(context.TODO(), "app-pod", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f(pod)
+	if _, err := pods.UpdateStatus(context.TODO(), pod, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func failTestPod(pod *apiv1.Pod) {
+	pod.Status.Phase = apiv1.PodFailed
+	pod.Status.Reason = "Evicted"
+}
+
+// waitForPodError waits until the pod error of res is set or cleared.
+func waitForPodError(t *testing.T, res *DeployResource, set bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for (res.getPodError() != "") != set {
+		if time.Now().After(deadline) {
+			t.Fatalf("pod error = %q", res.getPodError())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForFwdsvcs waits until cond returns true for the forwarding services of res.
+func waitForFwdsvcs(
+	t *testing.T,
+	res *DeployResource,
+	msg string,
+	cond func(fwdsvcs []ForwardingService) bool,
+) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, _, fwdsvcs := res.info()
+		if cond(fwdsvcs) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: %v", msg, fwdsvcs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func isTestFwdsvcSuspended(fwdsvcs []ForwardingService) bool {
+	return len(fwdsvcs) == 1 && fwdsvcs[0].IsSuspended()
+}
+
+func TestPodWatcherPolicyNone(t *testing.T) {
+	_, clientset, res := startTestPodWatcher(t, PodFailurePolicyNone)
+	updateTestPod(t, clientset, failTestPod)
+	waitForPodError(t, res, true)
+	_, _, fwdsvcs := res.info()
+	if len(fwdsvcs) != 1 || fwdsvcs[0].IsSuspended() {
+		t.Errorf("forwarding services = %v", fwdsvcs)
+	}
+}
+
+func TestPodWatcherPolicySuspend(t *testing.T) {
+	_, clientset, res := startTestPodWatcher(t, PodFailurePolicySuspend)
+	updateTestPod(t, clientset, func(pod *apiv1.Pod) {
+		pod.Status.ContainerStatuses[0].State = waitingState("CrashLoopBackOff")
+	})
+	waitForPodError(t, res, true)
+	waitForFwdsvcs(t, res, "forwarding services are not suspended", isTestFwdsvcSuspended)
+	updateTestPod(t, clientset, setPodReady)
+	waitForPodError(t, res, false)
+	waitForFwdsvcs(t, res, "forwarding services are not resumed", func(fwdsvcs []ForwardingService) bool {
+		return len(fwdsvcs) == 1 && !fwdsvcs[0].IsSuspended()
+	})
+}
+
+func TestPodWatcherNotBlockedByDeploy(t *testing.T) {
+	_, clientset, res := startTestPodWatcher(t, PodFailurePolicySuspend)
+	// Deploy and Remove hold res.mux while waiting for the pod
+	res.mux.Lock()
+	defer res.mux.Unlock()
+	updateTestPod(t, clientset, failTestPod)
+	waitForPodError(t, res, true)
+	waitForFwdsvcs(t, res, "forwarding services are not suspended", isTestFwdsvcSuspended)
+}
+
+func TestPodWatcherPolicyClose(t *testing.T) {
+	core, clientset, res := startTestPodWatcher(t, PodFailurePolicyClose)
+	_, _, fwdsvcs := res.info()
+	updateTestPod(t, clientset, failTestPod)
+	waitForPodError(t, res, true)
+	waitForFwdsvcs(t, res, "forwarding services are not closed", func(closed []ForwardingService) bool {
+		return len(closed) == 0
+	})
+	// The forwarding services closed by the watcher can be closed again
+	for _, fwdsvc := range fwdsvcs {
+		if err := fwdsvc.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := core.Remove(newTestRemoveRequest("app")); err != nil {
+		t.Error(err)
+	}
+}
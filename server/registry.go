@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultRegistryPath = "./registry.json"
+)
+
+// Registry records the deployments so that they can be restored on restart.
+// Entries are keyed by <cluster>/<namespace>/<name> of their deploy request. The keys are rebuilt
+// on load, so that the entries recorded with former keys are found by their deploy request.
+type Registry struct {
+	path    string
+	mux     sync.Mutex
+	entries map[string]*RegistryEntry
+}
+
+type RegistryEntry struct {
+	Deploy RequestDeploy `json:"deploy"`
+	// Migrating is true until the live migration of lm or fwdlm completes
+	Migrating bool      `json:"migrating,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func LoadRegistry(hostConf *HostConf) (*Registry, error) {
+	path := hostConf.RegistryPath
+	if path == "" {
+		path = DefaultRegistryPath
+	}
+	return LoadRegistryFrom(path)
+}
+
+func LoadRegistryFrom(path string) (*Registry, error) {
+	p := &Registry{
+		path:    path,
+		entries: map[string]*RegistryEntry{},
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return p, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	entries := map[string]*RegistryEntry{}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, e := range entries {
+		p.entries[registryKey(e.Deploy.Cluster, e.Deploy.Namespace, e.Deploy.Name)] = e
+	}
+	return p, nil
+}
+
+func (p *Registry) Put(deploy *RequestDeploy) error {
+	return p.put(deploy, false)
+}
+
+// PutMigrating records the deployment of lm or fwdlm whose migration has not completed yet.
+func (p *Registry) PutMigrating(deploy *RequestDeploy) error {
+	return p.put(deploy, true)
+}
+
+// SetMigrated records that the migration of the deployment has completed.
+// It does nothing if the deployment has been removed.
+func (p *Registry) SetMigrated(cluster string, namespace string, name string) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	e, ok := p.entries[registryKey(cluster, namespace, name)]
+	if !ok {
+		return nil
+	}
+	e.Migrating = false
+	e.UpdatedAt = time.Now()
+	return p.save()
+}
+
+func (p *Registry) put(deploy *RequestDeploy, migrating bool) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.entries[registryKey(deploy.Cluster, deploy.Namespace, deploy.Name)] = &RegistryEntry{
+		Deploy:    *deploy,
+		Migrating: migrating,
+		UpdatedAt: time.Now(),
+	}
+	return p.save()
+}
+
+// Get returns the entry of the deployment, or nil if not found.
+func (p *Registry) Get(cluster string, namespace string, name string) *RegistryEntry {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	e, ok := p.entries[registryKey(cluster, namespace, name)]
+	if !ok {
+		return nil
+	}
+	entry := *e
+	return &entry
+}
+
+func (p *Registry) Delete(cluster string, namespace string, name string) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	key := registryKey(cluster, namespace, name)
+	if _, ok := p.entries[key]; !ok {
+		return nil
+	}
+	delete(p.entries, key)
+	return p.save()
+}
+
+func (p *Registry) Entries() []*RegistryEntry {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	var ans []*RegistryEntry
+	for _, e := range p.entries {
+		entry := *e
+		ans = append(ans, &entry)
+	}
+	return ans
+}
+
+func registryKey(cluster string, namespace string, name string) string {
+	return cluster + "/" + namespace + "/" + name
+}
+
+// save writes the entries to a temporary file and renames it so that a crash never leaves a partial registry.
+func (p *Registry) save() error {
+	b, err := json.MarshalIndent(p.entries, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p.path), filepath.Base(p.path)+".tmp")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return errors.WithStack(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.WithStack(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.Rename(tmp.Name(), p.path); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
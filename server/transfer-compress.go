@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// The tar stream is compressed with zstd or lz4 of the host, which must be installed on both hosts.
+// The rsync transfer uses the compression of rsync instead.
+const (
+	CompressionNone = "none"
+	CompressionZstd = "zstd"
+	CompressionLZ4  = "lz4"
+)
+
+const (
+	ZstdMaxLevel = 19
+	LZ4MaxLevel  = 12
+)
+
+func compressionMaxLevel(compression string) int {
+	switch compression {
+	case CompressionZstd:
+		return ZstdMaxLevel
+	case CompressionLZ4:
+		return LZ4MaxLevel
+	default:
+		return 0
+	}
+}
+
+func isCompressed(compression string) bool {
+	return compression != "" && compression != CompressionNone
+}
+
+type compressWriter struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+// newCompressWriter returns the writer which compresses to w. Close must be called to flush.
+// level is the default of the command if 0.
+func newCompressWriter(w io.Writer, compression string, level int) (io.WriteCloser, error) {
+	args := []string{"-q", "-c"}
+	if level > 0 {
+		args = append(args, "-"+strconv.Itoa(level))
+	}
+	cmd := exec.Command(compression, args...)
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &compressWriter{cmd: cmd, stdin: stdin}, nil
+}
+
+func (p *compressWriter) Write(b []byte) (int, error) {
+	return p.stdin.Write(b)
+}
+
+func (p *compressWriter) Close() error {
+	p.stdin.Close()
+	return errors.WithStack(p.cmd.Wait())
+}
+
+type decompressReader struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+}
+
+// newDecompressReader returns the reader which decompresses r. Close must be called to wait for
+// the command.
+func newDecompressReader(r io.Reader, compression string) (io.ReadCloser, error) {
+	cmd := exec.Command(compression, "-q", "-d", "-c")
+	cmd.Stdin = r
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &decompressReader{cmd: cmd, stdout: stdout}, nil
+}
+
+func (p *decompressReader) Read(b []byte) (int, error) {
+	return p.stdout.Read(b)
+}
+
+func (p *decompressReader) Close() error {
+	io.Copy(ioutil.Discard, p.stdout)
+	return errors.WithStack(p.cmd.Wait())
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DedupPageSize    = 4096
+	DedupMaxDataSize = 1024 * 1024
+	dedupDataSize    = 32 * 1024
+)
+
+// Frames of the dedup stream. A tar stream is encoded as H (tar header) followed by the frames
+// of the file content, and ends with E. The content of criu page files is sent by page; a page
+// already sent in the migration is sent as R (sha256 of the page) instead of P.
+const (
+	DedupFrameHeader = 'H'
+	DedupFrameData   = 'D'
+	DedupFramePage   = 'P'
+	DedupFrameRef    = 'R'
+	DedupFrameEnd    = 'E'
+)
+
+type dedupHeader struct {
+	Name     string    `json:"name"`
+	Typeflag byte      `json:"typeflag"`
+	Mode     int64     `json:"mode"`
+	Size     int64     `json:"size"`
+	Linkname string    `json:"linkname,omitempty"`
+	ModTime  time.Time `json:"modTime"`
+}
+
+// DedupEncoder encodes tar streams into dedup streams.
+// It remembers the pages sent in the previous streams of the migration.
+type DedupEncoder struct {
+	sent map[[sha256.Size]byte]bool
+}
+
+func NewDedupEncoder() *DedupEncoder {
+	return &DedupEncoder{
+		sent: map[[sha256.Size]byte]bool{},
+	}
+}
+
+// Encode reads the tar stream from r and writes the dedup stream to w.
+// It returns the number of bytes of the pages which were not sent again.
+func (p *DedupEncoder) Encode(w io.Writer, r io.Reader) (int64, error) {
+	bw := bufio.NewWriter(w)
+	tr := tar.NewReader(r)
+	dedupBytes := int64(0)
+	buf := make([]byte, dedupDataSize)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return dedupBytes, errors.WithStack(err)
+		}
+		bhdr, err := json.Marshal(&dedupHeader{
+			Name:     hdr.Name,
+			Typeflag: hdr.Typeflag,
+			Mode:     hdr.Mode,
+			Size:     hdr.Size,
+			Linkname: hdr.Linkname,
+			ModTime:  hdr.ModTime,
+		})
+		if err != nil {
+			return dedupBytes, errors.WithStack(err)
+		}
+		if err := writeDedupFrame(bw, DedupFrameHeader, bhdr); err != nil {
+			return dedupBytes, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		chunkSize := dedupDataSize
+		isPages := isCriuPagesFile(hdr.Name)
+		if isPages {
+			chunkSize = DedupPageSize
+		}
+		for {
+			n, err := io.ReadFull(tr, buf[:chunkSize])
+			if n > 0 {
+				chunk := buf[:n]
+				if isPages && n == DedupPageSize {
+					sum := sha256.Sum256(chunk)
+					if p.sent[sum] {
+						err = writeDedupFrame(bw, DedupFrameRef, sum[:])
+						dedupBytes += int64(n)
+					} else {
+						p.sent[sum] = true
+						err = writeDedupFrame(bw, DedupFramePage, chunk)
+					}
+				} else {
+					err = writeDedupFrame(bw, DedupFrameData, chunk)
+				}
+				if err != nil {
+					return dedupBytes, err
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				return dedupBytes, errors.WithStack(err)
+			}
+		}
+	}
+	if err := bw.WriteByte(DedupFrameEnd); err != nil {
+		return dedupBytes, errors.WithStack(err)
+	}
+	return dedupBytes, errors.WithStack(bw.Flush())
+}
+
+func isCriuPagesFile(name string) bool {
+	base := path.Base(name)
+	return strings.HasPrefix(base, "pages-") && strings.HasSuffix(base, ".img")
+}
+
+func writeDedupFrame(w *bufio.Writer, frameType byte, b []byte) error {
+	if err := w.WriteByte(frameType); err != nil {
+		return errors.WithStack(err)
+	}
+	switch frameType {
+	case DedupFrameHeader, DedupFrameData:
+		var lenbuf [4]byte
+		binary.BigEndian.PutUint32(lenbuf[:], uint32(len(b)))
+		if _, err := w.Write(lenbuf[:]); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	_, err := w.Write(b)
+	return errors.WithStack(err)
+}
+
+// DedupDecoder decodes dedup streams into tar streams.
+// The pages received in the migration are kept in a spool file until Close.
+type DedupDecoder struct {
+	spool     *os.File
+	spoolSize int64
+	pages     map[[sha256.Size]byte]int64
+}
+
+func NewDedupDecoder() *DedupDecoder {
+	return &DedupDecoder{
+		pages: map[[sha256.Size]byte]int64{},
+	}
+}
+
+// Decode reads the dedup stream from r and writes the tar stream to w.
+// It returns the number of bytes of the pages restored from the previous streams.
+func (p *DedupDecoder) Decode(w io.Writer, r io.Reader) (int64, error) {
+	br := bufio.NewReader(r)
+	tw := tar.NewWriter(w)
+	dedupBytes := int64(0)
+	page := make([]byte, DedupPageSize)
+	for {
+		frameType, err := br.ReadByte()
+		if err != nil {
+			return dedupBytes, errors.WithStack(err)
+		}
+		switch frameType {
+		case DedupFrameHeader:
+			b, err := readDedupFrameData(br, DedupMaxDataSize)
+			if err != nil {
+				return dedupBytes, err
+			}
+			hdr := &dedupHeader{}
+			if err := json.Unmarshal(b, hdr); err != nil {
+				return dedupBytes, errors.WithStack(err)
+			}
+			if err := tw.WriteHeader(&tar.Header{
+				Name:     hdr.Name,
+				Typeflag: hdr.Typeflag,
+				Mode:     hdr.Mode,
+				Size:     hdr.Size,
+				Linkname: hdr.Linkname,
+				ModTime:  hdr.ModTime,
+			}); err != nil {
+				return dedupBytes, errors.WithStack(err)
+			}
+		case DedupFrameData:
+			b, err := readDedupFrameData(br, DedupMaxDataSize)
+			if err != nil {
+				return dedupBytes, err
+			}
+			if _, err := tw.Write(b); err != nil {
+				return dedupBytes, errors.WithStack(err)
+			}
+		case DedupFramePage:
+			if _, err := io.ReadFull(br, page); err != nil {
+				return dedupBytes, errors.WithStack(err)
+			}
+			if err := p.store(page); err != nil {
+				return dedupBytes, err
+			}
+			if _, err := tw.Write(page); err != nil {
+				return dedupBytes, errors.WithStack(err)
+			}
+		case DedupFrameRef:
+			var sum [sha256.Size]byte
+			if _, err := io.ReadFull(br, sum[:]); err != nil {
+				return dedupBytes, errors.WithStack(err)
+			}
+			offset, ok := p.pages[sum]
+			if !ok {
+				return dedupBytes, errors.Errorf("Unknown page: %x", sum)
+			}
+			if _, err := p.spool.ReadAt(page, offset); err != nil {
+				return dedupBytes, errors.WithStack(err)
+			}
+			if _, err := tw.Write(page); err != nil {
+				return dedupBytes, errors.WithStack(err)
+			}
+			dedupBytes += DedupPageSize
+		case DedupFrameEnd:
+			return dedupBytes, errors.WithStack(tw.Close())
+		default:
+			return dedupBytes, errors.Errorf("Unknown dedup frame: %x", frameType)
+		}
+	}
+}
+
+func (p *DedupDecoder) Close() {
+	if p.spool != nil {
+		p.spool.Close()
+		os.Remove(p.spool.Name())
+		p.spool = nil
+	}
+}
+
+func (p *DedupDecoder) store(page []byte) error {
+	sum := sha256.Sum256(page)
+	if _, ok := p.pages[sum]; ok {
+		return nil
+	}
+	if p.spool == nil {
+		spool, err := ioutil.TempFile("", "cloudlet-dedup")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		p.spool = spool
+	}
+	if _, err := p.spool.WriteAt(page, p.spoolSize); err != nil {
+		return errors.WithStack(err)
+	}
+	p.pages[sum] = p.spoolSize
+	p.spoolSize += int64(len(page))
+	return nil
+}
+
+func readDedupFrameData(r io.Reader, maxSize int) ([]byte, error) {
+	var lenbuf [4]byte
+	if _, err := io.ReadFull(r, lenbuf[:]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	n := binary.BigEndian.Uint32(lenbuf[:])
+	if n > uint32(maxSize) {
+		return nil, errors.Errorf("Too large dedup frame: %d", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return b, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// RsyncImageSender runs rsync to the rsync daemon of the restored pod, which is reachable at
+// TunnelPort of this host through the SSH tunnel to DstDataPort of the destination host.
+// The pod and this host need rsync, and the restored pod runs the rsync daemon.
+type RsyncImageSender struct {
+	dump         *LM_DumpService
+	sshCloseChan chan struct{}
+	closeOnce    sync.Once
+}
+
+func NewRsyncImageSender(dump *LM_DumpService) (*RsyncImageSender, error) {
+	p := &RsyncImageSender{
+		dump:         dump,
+		sshCloseChan: make(chan struct{}),
+	}
+	if dump.IsLocal {
+		Logger.Info("[Dump] Skip SSH tunnel to this host")
+		return p, nil
+	}
+	sshClient, err := NewSSHClient(TheAPICore.HostConf)
+	if err != nil {
+		return nil, err
+	}
+	hostEndAddr := fmt.Sprintf("%s:%d", dump.ThisAddr, dump.TunnelPort)
+	remoteEndAddr := fmt.Sprintf("%s:%d", dump.DstAddr, dump.DstDataPort)
+	Logger.Info("[Dump] Open SSH tunnel")
+	if err := sshClient.OpenTunnel(hostEndAddr, remoteEndAddr, p.sshCloseChan); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// SendPodDir syncs the whole LM_RsyncModuleDirectory, where rsync skips the files sent before.
+func (p *RsyncImageSender) SendPodDir(dir string) error {
+	cmd := fmt.Sprintf("rsync %s %s -rlOt %s/ %s", p.bwLimitOpt(), p.compressOpt(), LM_RsyncModuleDirectory,
+		p.moduleURL())
+	Logger.Info("[Dump][svc] Exec rsync")
+	return ExecutePod(p.dump.Clientset, p.dump.RestConfig, p.dump.Namespace, p.dump.PodName,
+		p.dump.ContainerName, nil, os.Stdout, os.Stderr, "/bin/sh", "-c", cmd)
+}
+
+func (p *RsyncImageSender) SendLocalDir(dir string) error {
+	args := []string{"-rlOt"}
+	if opt := p.bwLimitOpt(); opt != "" {
+		args = append(args, opt)
+	}
+	args = append(args, strings.Fields(p.compressOpt())...)
+	args = append(args, dir+"/", p.moduleURL())
+	Logger.Info("[Dump][svc] Exec rsync on this host")
+	cmd := exec.Command("rsync", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (p *RsyncImageSender) Close() {
+	p.closeOnce.Do(func() {
+		close(p.sshCloseChan)
+	})
+}
+
+func (p *RsyncImageSender) moduleURL() string {
+	port := p.dump.TunnelPort
+	if p.dump.IsLocal {
+		port = p.dump.DstDataPort
+	}
+	return fmt.Sprintf("rsync://%s:%d/%s", p.dump.ThisAddr, port, LM_RsyncModuleName)
+}
+
+func (p *RsyncImageSender) compressOpt() string {
+	if !isCompressed(p.dump.Compression) {
+		return ""
+	}
+	opt := "-z --compress-choice=" + p.dump.Compression
+	if p.dump.CompressionLevel > 0 {
+		opt += fmt.Sprintf(" --compress-level=%d", p.dump.CompressionLevel)
+	}
+	return opt
+}
+
+func (p *RsyncImageSender) bwLimitOpt() string {
+	rsyncBw := p.dump.getRsyncBandwidth()
+	if rsyncBw <= 0 {
+		return ""
+	}
+	Logger.InfoF("[Dump][svc] Rsync bandwidth: %d KiB/s\n", rsyncBw)
+	return fmt.Sprintf("--bwlimit=%d", rsyncBw)
+}
+
+// RsyncImageReceiver runs the rsync daemon in the restored pod and forwards the data port of
+// this host to it.
+type RsyncImageReceiver struct {
+	restore   *LM_Restore
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+func NewRsyncImageReceiver(restore *LM_Restore) *RsyncImageReceiver {
+	return &RsyncImageReceiver{
+		restore:   restore,
+		closeChan: make(chan struct{}),
+	}
+}
+
+func (p *RsyncImageReceiver) Start() error {
+	r := p.restore
+	Logger.Info("[Restore] Exec rsync --daemon")
+	if err := ExecutePod(r.Clientset, r.RestConfig, r.DstNamespace, r.DstPodName, r.DstContainerName,
+		nil, os.Stdout, os.Stderr, "/bin/sh", "-c", "rsync --daemon"); err != nil {
+		return err
+	}
+	Logger.Info("[Restore] Open kube port-forward")
+	return OpenKubePortForwardReady(r.RestConfig, r.DstNamespace, r.DstPodName,
+		r.dataPort, LM_PodRsyncPort, os.Stdout, os.Stderr, p.closeChan)
+}
+
+func (p *RsyncImageReceiver) TakeStats() *TransferStats {
+	return nil
+}
+
+func (p *RsyncImageReceiver) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closeChan)
+	})
+}
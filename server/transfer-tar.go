@@ -0,0 +1,334 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	LM_TransferDialTimeout = 10 * time.Second
+	LM_TransferAckTimeout  = 5 * time.Minute
+)
+
+// TarImageSender streams the images as tar to the TarImageReceiver at DstDataPort of the
+// destination host. Each send is a connection which starts with the transfer token and ends when
+// the receiver acknowledges the extraction. The pods need tar instead of rsync.
+type TarImageSender struct {
+	dump    *LM_DumpService
+	encoder *DedupEncoder
+}
+
+func NewTarImageSender(dump *LM_DumpService) (*TarImageSender, error) {
+	if len(dump.TransferToken) != LM_TransferTokenSize*2 {
+		return nil, errors.New("Invalid transfer token")
+	}
+	p := &TarImageSender{dump: dump}
+	if dump.Dedup {
+		p.encoder = NewDedupEncoder()
+	}
+	return p, nil
+}
+
+func (p *TarImageSender) SendPodDir(dir string) error {
+	rel := strings.TrimPrefix(dir, LM_RsyncModuleDirectory+"/")
+	if rel == dir {
+		return errors.New("Not in " + LM_RsyncModuleDirectory + ": " + dir)
+	}
+	Logger.Info("[Dump][svc] Send tar stream of " + dir)
+	return p.send(func(w io.Writer) error {
+		return ExecutePod(p.dump.Clientset, p.dump.RestConfig, p.dump.Namespace, p.dump.PodName,
+			p.dump.ContainerName, nil, w, os.Stderr, "tar", "c", "-C", LM_RsyncModuleDirectory, rel)
+	})
+}
+
+func (p *TarImageSender) SendLocalDir(dir string) error {
+	Logger.Info("[Dump][svc] Send tar stream of local " + dir)
+	return p.send(func(w io.Writer) error {
+		return writeTar(w, dir)
+	})
+}
+
+func (p *TarImageSender) Close() {
+}
+
+func (p *TarImageSender) send(write func(w io.Writer) error) error {
+	addr := net.JoinHostPort(p.dump.DstAddr, strconv.Itoa(p.dump.DstDataPort))
+	conn, err := p.dump.PeerTLS.DialPeer(addr, LM_TransferDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(p.dump.TransferToken)); err != nil {
+		return errors.WithStack(err)
+	}
+	var out io.Writer = newRateLimitWriter(conn, p.dump.BwLimit)
+	var cw io.WriteCloser
+	if isCompressed(p.dump.Compression) {
+		if cw, err = newCompressWriter(out, p.dump.Compression, p.dump.CompressionLevel); err != nil {
+			return err
+		}
+		out = cw
+	}
+	if p.encoder != nil {
+		err = p.encode(out, write)
+	} else {
+		err = write(out)
+	}
+	if cw != nil {
+		if cerr := cw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		if err := cw.CloseWrite(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(LM_TransferAckTimeout)); err != nil {
+		return errors.WithStack(err)
+	}
+	ack := make([]byte, 1)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		return errors.WithStack(err)
+	}
+	if ack[0] != LM_MsgRespOk {
+		return errors.New("Receiver failed to extract the images")
+	}
+	return nil
+}
+
+// encode writes the tar stream written by write to out as the dedup stream.
+func (p *TarImageSender) encode(out io.Writer, write func(w io.Writer) error) error {
+	pr, pw := io.Pipe()
+	chanWriteErr := make(chan error, 1)
+	go func() {
+		err := write(pw)
+		pw.CloseWithError(err)
+		chanWriteErr <- err
+	}()
+	dedupBytes, err := p.encoder.Encode(out, pr)
+	// Drain the padding after the end of the tar stream
+	io.Copy(ioutil.Discard, pr)
+	pr.CloseWithError(io.ErrClosedPipe)
+	if werr := <-chanWriteErr; err == nil {
+		err = werr
+	}
+	if err != nil {
+		return err
+	}
+	Logger.DebugF("[Dump][svc] Deduplicated bytes: %d\n", dedupBytes)
+	return nil
+}
+
+// writeTar writes the contents of dir as tar.
+func writeTar(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(tw.Close())
+}
+
+// TarImageReceiver listens at the data port of the migration and extracts the tar streams sent
+// with the transfer token into LM_RsyncModuleDirectory of the restored pod.
+type TarImageReceiver struct {
+	restore *LM_Restore
+	ln      net.Listener
+	decoder *DedupDecoder
+	// untar extracts the decoded tar stream in the restored pod
+	untar     func(in io.Reader) error
+	muxStats  sync.Mutex
+	stats     TransferStats
+	closeOnce sync.Once
+}
+
+func NewTarImageReceiver(restore *LM_Restore) *TarImageReceiver {
+	p := &TarImageReceiver{restore: restore}
+	p.untar = p.untarInPod
+	if restore.Dedup {
+		p.decoder = NewDedupDecoder()
+	}
+	return p
+}
+
+func (p *TarImageReceiver) Start() error {
+	Logger.Info("[Restore] Listen to tar stream")
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", p.restore.dataPort))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	p.ln = ln
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !IsClosedError(err) {
+					Logger.ErrorE(errors.WithStack(err))
+				}
+				return
+			}
+			p.receive(conn)
+		}
+	}()
+	return nil
+}
+
+func (p *TarImageReceiver) TakeStats() *TransferStats {
+	p.muxStats.Lock()
+	defer p.muxStats.Unlock()
+	stats := p.stats
+	p.stats = TransferStats{}
+	return &stats
+}
+
+// Close stops accepting the streams. The stream being received is not interrupted.
+func (p *TarImageReceiver) Close() {
+	p.closeOnce.Do(func() {
+		if p.ln != nil {
+			p.ln.Close()
+		}
+		if p.decoder != nil {
+			p.decoder.Close()
+		}
+	})
+}
+
+func (p *TarImageReceiver) receive(conn net.Conn) {
+	r := p.restore
+	conn, err := r.PeerTLS.ServerPeer(conn)
+	if err != nil {
+		Logger.Warn("[Restore] Reject tar stream: " + err.Error())
+		return
+	}
+	defer conn.Close()
+	if err := readTransferToken(conn, r.TransferToken); err != nil {
+		Logger.Warn("[Restore] Reject tar stream: " + err.Error())
+		return
+	}
+	Logger.Info("[Restore] Extract tar stream")
+	ack := byte(LM_MsgRespOk)
+	stats, err := p.extract(conn)
+	if err != nil {
+		Logger.ErrorE(err)
+		ack = LM_MsgRespError
+	} else {
+		Logger.DebugF("[Restore] Received bytes: %d (raw: %d, deduplicated: %d)\n",
+			stats.SentBytes, stats.RawBytes, stats.DedupBytes)
+		p.muxStats.Lock()
+		p.stats.add(stats)
+		p.muxStats.Unlock()
+	}
+	if _, err := conn.Write([]byte{ack}); err != nil {
+		Logger.ErrorE(errors.WithStack(err))
+	}
+}
+
+// extract decompresses and decodes the stream from conn, and extracts it in the restored pod.
+func (p *TarImageReceiver) extract(conn net.Conn) (*TransferStats, error) {
+	r := p.restore
+	wire := &countingReader{reader: conn}
+	var in io.Reader = wire
+	if isCompressed(r.Compression) {
+		dr, err := newDecompressReader(wire, r.Compression)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err := dr.Close(); err != nil {
+				Logger.Warn("[Restore] Decompress: " + err.Error())
+			}
+		}()
+		in = dr
+	}
+	chanDecodeErr := make(chan error, 1)
+	dedupBytes := int64(0)
+	var pr *io.PipeReader
+	if p.decoder != nil {
+		var pw *io.PipeWriter
+		pr, pw = io.Pipe()
+		encoded := in
+		go func() {
+			n, err := p.decoder.Decode(pw, encoded)
+			dedupBytes = n
+			pw.CloseWithError(err)
+			chanDecodeErr <- err
+		}()
+		in = pr
+	} else {
+		chanDecodeErr <- nil
+	}
+	raw := &countingReader{reader: in}
+	err := p.untar(raw)
+	if err != nil {
+		// Unblock the decoder and the decompressor
+		conn.Close()
+	}
+	if pr != nil {
+		// The decoder blocks on writing the rest of the stream unless the pipe is closed
+		pr.CloseWithError(err)
+	}
+	if derr := <-chanDecodeErr; err == nil {
+		err = derr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &TransferStats{
+		RawBytes:   raw.n,
+		DedupBytes: dedupBytes,
+		SentBytes:  wire.n,
+	}, nil
+}
+
+func (p *TarImageReceiver) untarInPod(in io.Reader) error {
+	r := p.restore
+	return ExecutePod(r.Clientset, r.RestConfig, r.DstNamespace, r.DstPodName, r.DstContainerName,
+		in, nil, os.Stderr, "tar", "x", "-C", LM_RsyncModuleDirectory)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The page server of postcopy is only reachable at the loopback address of the source host. The
+// restored pod connects to the relay of the destination host, which forwards the connection to
+// the peer tunnel of the source host with mutual TLS and the transfer token of the migration.
+const (
+	LM_TunnelDialTimeout = 10 * time.Second
+)
+
+// OpenPeerTunnel listens at port for the peer cloudlet, which presents token after the TLS
+// handshake, and forwards the connections to addr of this host until closeChan is closed.
+func OpenPeerTunnel(peerTLS *PeerTLS, port int, token string, addr string, closeChan chan struct{}) error {
+	return openTunnel(port, closeChan, func(conn net.Conn) (net.Conn, error) {
+		conn, err := peerTLS.ServerPeer(conn)
+		if err != nil {
+			return nil, err
+		}
+		if err := readTransferToken(conn, token); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}, func() (net.Conn, error) {
+		conn, err := net.DialTimeout("tcp", addr, LM_TunnelDialTimeout)
+		return conn, errors.WithStack(err)
+	})
+}
+
+// OpenPeerTunnelRelay listens at port for the restored pod at podAddr, and forwards the connections
+// to the peer tunnel at tunnelAddr of the peer cloudlet with token until closeChan is closed. The
+// connections from other addresses are rejected before the peer tunnel is dialed.
+func OpenPeerTunnelRelay(
+	peerTLS *PeerTLS,
+	port int,
+	token string,
+	podAddr string,
+	tunnelAddr string,
+	closeChan chan struct{},
+) error {
+	podIP := net.ParseIP(podAddr)
+	if podIP == nil {
+		return errors.New("Invalid pod address: " + podAddr)
+	}
+	return openTunnel(port, closeChan, func(conn net.Conn) (net.Conn, error) {
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); !ok || !addr.IP.Equal(podIP) {
+			conn.Close()
+			return nil, errors.New("Connection from " + conn.RemoteAddr().String() + " is not the restored pod")
+		}
+		return conn, nil
+	}, func() (net.Conn, error) {
+		conn, err := peerTLS.DialPeer(tunnelAddr, LM_TunnelDialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write([]byte(token)); err != nil {
+			conn.Close()
+			return nil, errors.WithStack(err)
+		}
+		return conn, nil
+	})
+}
+
+// openTunnel accepts the connections at port, and forwards each connection prepared by accept to
+// the connection opened by dial. Closing closeChan stops accepting, and the connections forwarded
+// are closed when either end closes.
+func openTunnel(
+	port int,
+	closeChan chan struct{},
+	accept func(conn net.Conn) (net.Conn, error),
+	dial func() (net.Conn, error),
+) error {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	go func() {
+		<-closeChan
+		ln.Close()
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !IsClosedError(err) {
+					Logger.ErrorE(errors.WithStack(err))
+				}
+				return
+			}
+			go func() {
+				conn, err := accept(conn)
+				if err != nil {
+					Logger.Warn("Reject tunnel connection: " + err.Error())
+					return
+				}
+				defer conn.Close()
+				remoteConn, err := dial()
+				if err != nil {
+					Logger.ErrorE(err)
+					return
+				}
+				defer remoteConn.Close()
+				chanDone := make(chan struct{}, 2)
+				go func() {
+					io.Copy(remoteConn, conn)
+					chanDone <- struct{}{}
+				}()
+				go func() {
+					io.Copy(conn, remoteConn)
+					chanDone <- struct{}{}
+				}()
+				<-chanDone
+			}()
+		}
+	}()
+	return nil
+}
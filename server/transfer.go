@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// TransferRsync syncs the images with rsync through the SSH tunnel and kube port-forward
+	TransferRsync = "rsync"
+	// TransferTar streams the images as tar over a direct connection between the cloudlets
+	TransferTar = "tar"
+)
+
+const (
+	LM_TransferTokenSize    = 16
+	LM_TransferTokenTimeout = 10 * time.Second
+)
+
+// ImageSender sends the checkpoint images on the source host to the restored pod.
+// The images are put in the same path under LM_RsyncModuleDirectory of the restored pod.
+type ImageSender interface {
+	// SendPodDir sends dir under LM_RsyncModuleDirectory of the source container
+	SendPodDir(dir string) error
+	// SendLocalDir sends the contents of dir of this host to LM_RsyncModuleDirectory
+	SendLocalDir(dir string) error
+	Close()
+}
+
+// ImageReceiver receives the checkpoint images into the restored pod on the destination host.
+type ImageReceiver interface {
+	Start() error
+	// TakeStats returns the stats of the images received since the last call, or nil if unknown
+	TakeStats() *TransferStats
+	Close()
+}
+
+// TransferStats is the number of bytes of the images received.
+type TransferStats struct {
+	// RawBytes is the size of the tar stream extracted in the pod
+	RawBytes int64
+	// DedupBytes is the size of the pages which were not sent again
+	DedupBytes int64
+	// SentBytes is the size received over the network
+	SentBytes int64
+}
+
+func (p *TransferStats) add(stats *TransferStats) {
+	p.RawBytes += stats.RawBytes
+	p.DedupBytes += stats.DedupBytes
+	p.SentBytes += stats.SentBytes
+}
+
+// NewImageSender returns the ImageSender of dump.Transfer.
+func NewImageSender(dump *LM_DumpService) (ImageSender, error) {
+	switch dump.Transfer {
+	case "", TransferRsync:
+		return NewRsyncImageSender(dump)
+	case TransferTar:
+		return NewTarImageSender(dump)
+	default:
+		return nil, errors.New("Unsupported transfer backend: " + dump.Transfer)
+	}
+}
+
+// NewImageReceiver returns the ImageReceiver of restore.Transfer.
+func NewImageReceiver(restore *LM_Restore) (ImageReceiver, error) {
+	switch restore.Transfer {
+	case "", TransferRsync:
+		return NewRsyncImageReceiver(restore), nil
+	case TransferTar:
+		return NewTarImageReceiver(restore), nil
+	default:
+		return nil, errors.New("Unsupported transfer backend: " + restore.Transfer)
+	}
+}
+
+// NewTransferToken returns a random token which the source presents to send the images.
+func NewTransferToken() (string, error) {
+	b := make([]byte, LM_TransferTokenSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// readTransferToken reads the transfer token which starts conn, and checks that it is token.
+func readTransferToken(conn net.Conn, token string) error {
+	if err := conn.SetReadDeadline(time.Now().Add(LM_TransferTokenTimeout)); err != nil {
+		return errors.WithStack(err)
+	}
+	b := make([]byte, LM_TransferTokenSize*2)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return errors.Wrap(err, "Read transfer token")
+	}
+	if subtle.ConstantTimeCompare(b, []byte(token)) != 1 {
+		return errors.New("Invalid transfer token from " + conn.RemoteAddr().String())
+	}
+	return errors.WithStack(conn.SetReadDeadline(time.Time{}))
+}
+
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (p *countingReader) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+	p.n += int64(n)
+	return n, err
+}
+
+// rateLimitWriter limits the rate of writes to bwLimit Mbps.
+type rateLimitWriter struct {
+	writer  io.Writer
+	bwLimit int
+}
+
+func newRateLimitWriter(writer io.Writer, bwLimit int) io.Writer {
+	if bwLimit <= 0 {
+		return writer
+	}
+	return &rateLimitWriter{writer: writer, bwLimit: bwLimit}
+}
+
+func (p *rateLimitWriter) Write(b []byte) (int, error) {
+	timeWriteStart := time.Now()
+	nw, err := p.writer.Write(b)
+	timeWrite := time.Now().Sub(timeWriteStart)
+	rateBps := float64(p.bwLimit) * 125000.0
+	timeToSleep := (float64(nw) / rateBps) - timeWrite.Seconds()
+	if timeToSleep > 0 {
+		time.Sleep(time.Duration(timeToSleep*1000000000) * time.Nanosecond)
+	}
+	return nw, err
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteTar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlet-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	imagesDir := filepath.Join(dir, "cloudlet-live-migration", "images")
+	if err := os.MkdirAll(filepath.Join(imagesDir, "1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(imagesDir, "1", "pages-1.img"), []byte("pages"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../1", filepath.Join(imagesDir, "parent")); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := writeTar(buf, dir); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]*tar.Header{}
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[hdr.Name] = hdr
+		if hdr.Name == "cloudlet-live-migration/images/1/pages-1.img" {
+			if b, _ := ioutil.ReadAll(tr); string(b) != "pages" {
+				t.Errorf("content = %q", b)
+			}
+		}
+	}
+	for name, typeflag := range map[string]byte{
+		"cloudlet-live-migration":                      tar.TypeDir,
+		"cloudlet-live-migration/images/1":             tar.TypeDir,
+		"cloudlet-live-migration/images/1/pages-1.img": tar.TypeReg,
+		"cloudlet-live-migration/images/parent":        tar.TypeSymlink,
+	} {
+		hdr, ok := got[name]
+		if !ok {
+			t.Errorf("%s is not in tar", name)
+			continue
+		}
+		if hdr.Typeflag != typeflag {
+			t.Errorf("%s: typeflag = %c, want %c", name, hdr.Typeflag, typeflag)
+		}
+	}
+	if link := got["cloudlet-live-migration/images/parent"].Linkname; link != "../1" {
+		t.Errorf("linkname = %s", link)
+	}
+}
+
+func newTestTar(t *testing.T, files map[string][]byte) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, name := range []string{"images/1/pages-1.img", "images/1/pagemap-1.img"} {
+		b, ok := files[name]
+		if !ok {
+			continue
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644,
+			Size: int64(len(b))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readTestTar(t *testing.T, b []byte) map[string][]byte {
+	files := map[string][]byte{}
+	tr := tar.NewReader(bytes.NewReader(b))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = content
+	}
+	return files
+}
+
+func TestDedupRoundTrip(t *testing.T) {
+	page := func(c byte) []byte {
+		return bytes.Repeat([]byte{c}, DedupPageSize)
+	}
+	pages := bytes.Join([][]byte{page('a'), page('b'), page('a'), []byte("tail")}, nil)
+	files := map[string][]byte{
+		"images/1/pages-1.img":   pages,
+		"images/1/pagemap-1.img": bytes.Join([][]byte{page('a'), page('a')}, nil),
+	}
+	encoder := NewDedupEncoder()
+	decoder := NewDedupDecoder()
+	defer decoder.Close()
+	for i, wantDedup := range []int64{DedupPageSize, 3 * DedupPageSize} {
+		encoded := &bytes.Buffer{}
+		dedupBytes, err := encoder.Encode(encoded, bytes.NewReader(newTestTar(t, files)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dedupBytes != wantDedup {
+			t.Errorf("[%d] encoded dedupBytes = %d, want %d", i, dedupBytes, wantDedup)
+		}
+		decoded := &bytes.Buffer{}
+		dedupBytes, err = decoder.Decode(decoded, encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dedupBytes != wantDedup {
+			t.Errorf("[%d] decoded dedupBytes = %d, want %d", i, dedupBytes, wantDedup)
+		}
+		got := readTestTar(t, decoded.Bytes())
+		for name, want := range files {
+			if !bytes.Equal(got[name], want) {
+				t.Errorf("[%d] %s differs", i, name)
+			}
+		}
+	}
+}
+
+func TestDedupDecodeUnknownPage(t *testing.T) {
+	encoded := append([]byte{DedupFrameRef}, make([]byte, 32)...)
+	decoder := NewDedupDecoder()
+	defer decoder.Close()
+	if _, err := decoder.Decode(ioutil.Discard, bytes.NewReader(encoded)); err == nil {
+		t.Error("unknown page is decoded")
+	}
+}
+
+func TestTarImageReceiverExtractSinkFails(t *testing.T) {
+	files := map[string][]byte{
+		"images/1/pages-1.img": bytes.Repeat([]byte{'a'}, 64*DedupPageSize),
+	}
+	encoded := &bytes.Buffer{}
+	if _, err := NewDedupEncoder().Encode(encoded, bytes.NewReader(newTestTar(t, files))); err != nil {
+		t.Fatal(err)
+	}
+	p := NewTarImageReceiver(&LM_Restore{Dedup: true})
+	defer p.Close()
+	errSink := errors.New("sink failed")
+	// The decoder is blocked on writing the rest of the header when the sink fails
+	p.untar = func(in io.Reader) error {
+		if _, err := io.ReadFull(in, make([]byte, 1)); err != nil {
+			return err
+		}
+		return errSink
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	go io.Copy(client, encoded)
+	chanErr := make(chan error, 1)
+	go func() {
+		_, err := p.extract(server)
+		chanErr <- err
+	}()
+	select {
+	case err := <-chanErr:
+		if err != errSink {
+			t.Errorf("err = %v, want %v", err, errSink)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("extract does not return")
+	}
+}
+
+func TestPeerTunnel(t *testing.T) {
+	ca := newTestCA(t)
+	src := newTestPeerTLS(t, ca, "cloudlet-a", "cloudlet-b")
+	dst := newTestPeerTLS(t, ca, "cloudlet-b", "cloudlet-a")
+	token, err := NewTransferToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The echo server stands for the page server at the loopback address
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	ports := NewPortAllocator(21000, 21999)
+	tunnelPort, err := ports.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayPort, err := ports.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeChan := make(chan struct{})
+	defer close(closeChan)
+	if err := OpenPeerTunnel(src, tunnelPort, token, echo.Addr().String(), closeChan); err != nil {
+		t.Fatal(err)
+	}
+	tunnelAddr := fmt.Sprintf("127.0.0.1:%d", tunnelPort)
+	if err := OpenPeerTunnelRelay(dst, relayPort, token, "127.0.0.1", tunnelAddr, closeChan); err != nil {
+		t.Fatal(err)
+	}
+	otherRelayPort, err := ports.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := OpenPeerTunnelRelay(dst, otherRelayPort, token, "192.0.2.1", tunnelAddr, closeChan); err != nil {
+		t.Fatal(err)
+	}
+	echoTest := func(conn net.Conn) error {
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Write([]byte("page")); err != nil {
+			return err
+		}
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		if string(b) != "page" {
+			return errors.New("echo: " + string(b))
+		}
+		return nil
+	}
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", relayPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := echoTest(conn); err != nil {
+		t.Errorf("relay: %v", err)
+	}
+	// The relay rejects the connections from other than the restored pod
+	if conn, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", otherRelayPort)); err != nil {
+		t.Fatal(err)
+	}
+	if err := echoTest(conn); err == nil {
+		t.Error("connection from other than the restored pod is relayed")
+	}
+	// The tunnel rejects the connections without TLS or the token
+	if conn, err = net.Dial("tcp", tunnelAddr); err != nil {
+		t.Fatal(err)
+	}
+	if err := echoTest(conn); err == nil {
+		t.Error("plain connection is tunneled")
+	}
+	if conn, err = dst.DialPeer(tunnelAddr, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte(strings.Repeat("0", LM_TransferTokenSize*2)))
+	if err := echoTest(conn); err == nil {
+		t.Error("connection with invalid token is tunneled")
+	}
+}
@@ -1,5 +1,12 @@
 package main
 
+import (
+	"reflect"
+
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+)
+
 const (
 	DeployTypeNew   = "new"
 	DeployTypeFwd   = "fwd"
@@ -7,68 +14,336 @@ const (
 	DeployTypeFwdLM = "fwdlm"
 )
 
+const (
+	ProtocolTCP = "TCP"
+	ProtocolUDP = "UDP"
+)
+
 type Request struct {
-	Method string `json:"method"`
-	Deploy struct {
-		Name   string `json:"name"`
-		Type   string `json:"type"`
-		NewApp struct {
-			Image string `json:"image"`
-			Port  struct {
-				In  int `json:"in"`
-				Ext int `json:"ext"`
-			} `json:"port"`
-			Env map[string]string `json:"env"`
-		} `json:"newApp"`
-		Fwd struct {
-			SrcAddr string `json:"srcAddr"`
-			Port    struct {
-				In  int `json:"in"`
-				Ext int `json:"ext"`
-			} `json:"port"`
-		} `json:"fwd"`
-		LM struct {
-			Image   string `json:"image"`
-			SrcAddr string `json:"srcAddr"`
-			SrcName string `json:"srcName"`
-			Port    struct {
-				In  int `json:"in"`
-				Ext int `json:"ext"`
-			} `json:"port"`
-			DstAddr   string            `json:"dstAddr"`
-			Env       map[string]string `json:"env"`
-			BwLimit   int               `json:"bwLimit"`
-			Iteration int               `json:"iteration"`
-		} `json:"lm"`
-		FwdLM struct {
-			Image   string `json:"image"`
-			SrcAddr string `json:"srcAddr"`
-			SrcName string `json:"srcName"`
-			SrcPort int    `json:"srcPort"`
-			Port    struct {
-				In  int `json:"in"`
-				Ext int `json:"ext"`
-			} `json:"port"`
-			DstAddr   string            `json:"dstAddr"`
-			Env       map[string]string `json:"env"`
-			BwLimit   int               `json:"bwLimit"`
-			Iteration int               `json:"iteration"`
-			DataRate  int               `json:"dataRate"`
-		} `json:"fwdlm"`
-	} `json:"deploy"`
-	Remove struct {
-		Name string `json:"name"`
-	} `json:"remove"`
-	DumpStart RequestDumpStart `json:"_startDump"`
+	Method          string                 `json:"method"`
+	Deploy          RequestDeploy          `json:"deploy"`
+	Remove          RequestRemove          `json:"remove"`
+	Status          RequestStatus          `json:"status"`
+	MigrationStatus RequestMigrationStatus `json:"migrationStatus"`
+	MigrationCancel RequestMigrationCancel `json:"migrationCancel"`
+	DumpStart       RequestDumpStart       `json:"_startDump"`
+}
+
+type RequestDeploy struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	// Cluster is the name of the cluster in HostConf; the default cluster is used if empty
+	Cluster string `json:"cluster"`
+	Type    string `json:"type"`
+	NewApp  struct {
+		Image string `json:"image"`
+		Port  struct {
+			In  int `json:"in"`
+			Ext int `json:"ext"`
+		} `json:"port"`
+		Ports      []PortSpec        `json:"ports"`
+		Env        map[string]string `json:"env"`
+		PodOptions PodOptions        `json:"podOptions"`
+		// Controller is "pod" (default), "deployment" or "statefulset"
+		Controller string `json:"controller"`
+		Replicas   int    `json:"replicas"`
+		// Checkpoint is the checkpoint backend used to migrate the app: "criu" (default) or "kubelet"
+		Checkpoint string `json:"checkpoint"`
+	} `json:"newApp"`
+	Fwd struct {
+		SrcAddr string `json:"srcAddr"`
+		Port    struct {
+			In  int `json:"in"`
+			Ext int `json:"ext"`
+		} `json:"port"`
+		Ports []PortSpec `json:"ports"`
+	} `json:"fwd"`
+	LM struct {
+		Image   string `json:"image"`
+		SrcAddr string `json:"srcAddr"`
+		SrcName string `json:"srcName"`
+		Port    struct {
+			In  int `json:"in"`
+			Ext int `json:"ext"`
+		} `json:"port"`
+		Ports        []PortSpec        `json:"ports"`
+		DstAddr      string            `json:"dstAddr"`
+		Env          map[string]string `json:"env"`
+		BwLimit      int               `json:"bwLimit"`
+		Iteration    int               `json:"iteration"`
+		SrcNamespace string            `json:"srcNamespace"`
+		SrcPod       string            `json:"srcPod"`
+		SrcCluster   string            `json:"srcCluster"`
+		PodOptions   PodOptions        `json:"podOptions"`
+		Checkpoint   string            `json:"checkpoint"`
+		// Transfer is the transfer backend of the images: "rsync" (default) or "tar"
+		Transfer string `json:"transfer"`
+		// Compression is "none" (default), "zstd" or "lz4" with CompressionLevel (0 for the default)
+		Compression      string `json:"compression"`
+		CompressionLevel int    `json:"compressionLevel"`
+		// Dedup skips the pages sent in the previous iterations; only for the tar transfer
+		Dedup bool `json:"dedup"`
+		// AdaptivePreDump decides the number of pre-dumps instead of Iteration if set
+		AdaptivePreDump *AdaptivePreDump `json:"adaptivePreDump"`
+		// Mode is "precopy" (default) or "postcopy"
+		Mode string `json:"mode"`
+		// ResumeTimeoutSec is the time to wait for the restored app to resume and to be ready
+		// with PodOptions.ReadinessProbe; LM_DefaultResumeTimeout if 0
+		ResumeTimeoutSec int `json:"resumeTimeoutSec"`
+	} `json:"lm"`
+	FwdLM struct {
+		Image   string `json:"image"`
+		SrcAddr string `json:"srcAddr"`
+		SrcName string `json:"srcName"`
+		SrcPort int    `json:"srcPort"`
+		Port    struct {
+			In  int `json:"in"`
+			Ext int `json:"ext"`
+		} `json:"port"`
+		Ports            []PortSpec        `json:"ports"`
+		DstAddr          string            `json:"dstAddr"`
+		Env              map[string]string `json:"env"`
+		BwLimit          int               `json:"bwLimit"`
+		Iteration        int               `json:"iteration"`
+		DataRate         int               `json:"dataRate"`
+		SrcNamespace     string            `json:"srcNamespace"`
+		SrcPod           string            `json:"srcPod"`
+		SrcCluster       string            `json:"srcCluster"`
+		PodOptions       PodOptions        `json:"podOptions"`
+		Checkpoint       string            `json:"checkpoint"`
+		Transfer         string            `json:"transfer"`
+		Compression      string            `json:"compression"`
+		CompressionLevel int               `json:"compressionLevel"`
+		Dedup            bool              `json:"dedup"`
+		AdaptivePreDump  *AdaptivePreDump  `json:"adaptivePreDump"`
+		Mode             string            `json:"mode"`
+		ResumeTimeoutSec int               `json:"resumeTimeoutSec"`
+	} `json:"fwdlm"`
+}
+
+// AdaptivePreDump keeps pre-dumping until the size transferred by an iteration is below
+// ThresholdBytes or does not decrease by MinReduction (a ratio of the previous iteration),
+// for up to MaxIterations and MaxTimeSec. The defaults are used for the fields of 0.
+type AdaptivePreDump struct {
+	ThresholdBytes int64   `json:"thresholdBytes"`
+	MinReduction   float64 `json:"minReduction"`
+	MaxIterations  int     `json:"maxIterations"`
+	MaxTimeSec     int     `json:"maxTimeSec"`
+}
+
+// PodOptions are optional settings of the pod created for a deployment.
+// lm and fwdlm take the options of the source deployment unless the request gives them.
+type PodOptions struct {
+	Resources    apiv1.ResourceRequirements `json:"resources"`
+	NodeSelector map[string]string          `json:"nodeSelector"`
+	Tolerations  []apiv1.Toleration         `json:"tolerations"`
+	Volumes      []apiv1.Volume             `json:"volumes"`
+	VolumeMounts []apiv1.VolumeMount        `json:"volumeMounts"`
+	Labels       map[string]string          `json:"labels"`
+	Annotations  map[string]string          `json:"annotations"`
+	// ReadinessProbe is a TCP or HTTP probe of the app container
+	ReadinessProbe *apiv1.Probe `json:"readinessProbe"`
+}
+
+func (p *PodOptions) IsZero() bool {
+	return reflect.DeepEqual(*p, PodOptions{})
+}
+
+// PortSpec maps the external port of this host to the port of the app.
+// Src is the external port of the source host and is used only by fwdlm.
+type PortSpec struct {
+	In       int    `json:"in"`
+	Ext      int    `json:"ext"`
+	Src      int    `json:"src,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+}
+
+func (p *PortSpec) Network() string {
+	if p.GetProtocol() == ProtocolUDP {
+		return "udp"
+	}
+	return "tcp"
+}
+
+func (p *PortSpec) GetProtocol() string {
+	if p.Protocol == "" {
+		return ProtocolTCP
+	}
+	return p.Protocol
+}
+
+// GetPodOptions returns the pod options of the deploy type, or nil if it creates no pod.
+func (p *RequestDeploy) GetPodOptions() *PodOptions {
+	switch p.Type {
+	case DeployTypeNew:
+		return &p.NewApp.PodOptions
+	case DeployTypeLM:
+		return &p.LM.PodOptions
+	case DeployTypeFwdLM:
+		return &p.FwdLM.PodOptions
+	default:
+		return nil
+	}
+}
+
+// GetController returns the kind of the controller of a new app.
+func (p *RequestDeploy) GetController() string {
+	if p.Type != DeployTypeNew || p.NewApp.Controller == "" {
+		return ControllerPod
+	}
+	return p.NewApp.Controller
+}
+
+// GetCheckpoint returns the checkpoint backend used to migrate the deployment.
+func (p *RequestDeploy) GetCheckpoint() string {
+	checkpoint := ""
+	switch p.Type {
+	case DeployTypeNew:
+		checkpoint = p.NewApp.Checkpoint
+	case DeployTypeLM:
+		checkpoint = p.LM.Checkpoint
+	case DeployTypeFwdLM:
+		checkpoint = p.FwdLM.Checkpoint
+	}
+	if checkpoint == "" {
+		return CheckpointCRIU
+	}
+	return checkpoint
+}
+
+func (p *RequestDeploy) GetReplicas() int {
+	if p.NewApp.Replicas <= 0 {
+		return 1
+	}
+	return p.NewApp.Replicas
+}
+
+// GetPorts returns the port mappings of the deployment.
+// The single port in the legacy "port" field is used if "ports" is empty.
+func (p *RequestDeploy) GetPorts() []PortSpec {
+	switch p.Type {
+	case DeployTypeNew:
+		if len(p.NewApp.Ports) > 0 {
+			return p.NewApp.Ports
+		}
+		return []PortSpec{{In: p.NewApp.Port.In, Ext: p.NewApp.Port.Ext}}
+	case DeployTypeFwd:
+		if len(p.Fwd.Ports) > 0 {
+			return p.Fwd.Ports
+		}
+		return []PortSpec{{In: p.Fwd.Port.In, Ext: p.Fwd.Port.Ext}}
+	case DeployTypeLM:
+		if len(p.LM.Ports) > 0 {
+			return p.LM.Ports
+		}
+		return []PortSpec{{In: p.LM.Port.In, Ext: p.LM.Port.Ext}}
+	case DeployTypeFwdLM:
+		if len(p.FwdLM.Ports) > 0 {
+			return p.FwdLM.Ports
+		}
+		return []PortSpec{{In: p.FwdLM.Port.In, Ext: p.FwdLM.Port.Ext, Src: p.FwdLM.SrcPort}}
+	default:
+		return nil
+	}
+}
+
+type RequestRemove struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Cluster   string `json:"cluster"`
+}
+
+type RequestStatus struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Cluster   string `json:"cluster"`
+}
+
+type RequestMigrationStatus struct {
+	ID string `json:"id"`
+}
+
+type RequestMigrationCancel struct {
+	ID string `json:"id"`
 }
 
 type RequestDumpStart struct {
-	Name    string `json:"name"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	// Pod is the pod to dump if the source app is run by a controller
+	Pod     string `json:"pod"`
+	Cluster string `json:"cluster"`
 	DstAddr string `json:"dstAddr"`
-	BwLimit int    `json:"bwLimit"`
+	// DstDataPort is the port of DstAddr which receives the images; LM_HostDataPort if 0
+	DstDataPort int `json:"dstDataPort"`
+	BwLimit     int `json:"bwLimit"`
+	// Transfer is the transfer backend, and TransferToken authenticates the tar stream
+	Transfer         string `json:"transfer"`
+	TransferToken    string `json:"transferToken"`
+	Compression      string `json:"compression"`
+	CompressionLevel int    `json:"compressionLevel"`
+	Dedup            bool   `json:"dedup"`
+	// Mode is the migration mode, which the checkpoint backend must support
+	Mode string `json:"mode"`
 }
 
 type Response struct {
-	Ok  bool   `json:"ok"`
-	Msg string `json:"msg"`
+	Ok         bool   `json:"ok"`
+	Code       string `json:"code,omitempty"`
+	Msg        string `json:"msg"`
+	Pod        string `json:"pod,omitempty"`
+	Controller string `json:"controller,omitempty"`
+	Service    string `json:"service,omitempty"`
+	ClusterIP  string `json:"clusterIP,omitempty"`
+	Checkpoint string `json:"checkpoint,omitempty"`
+	// Ports are the ports of the deployment, whose ext ports are forwarded by this host
+	Ports []PortSpec `json:"ports,omitempty"`
+	// MsgPort and PageServerPort are the ports of the dump service started by _dumpStart
+	MsgPort        int `json:"msgPort,omitempty"`
+	PageServerPort int `json:"pageServerPort,omitempty"`
+
+	Errors []FieldError `json:"errors,omitempty"`
+
+	Deployments []*DeploymentStatus `json:"deployments,omitempty"`
+
+	MigrationID string           `json:"migrationId,omitempty"`
+	Migration   *MigrationStatus `json:"migration,omitempty"`
+}
+
+type DeploymentStatus struct {
+	Cluster       string              `json:"cluster"`
+	Name          string              `json:"name"`
+	Namespace     string              `json:"namespace,omitempty"`
+	Type          string              `json:"type"`
+	PodPhase      string              `json:"podPhase,omitempty"`
+	PodReady      bool                `json:"podReady"`
+	Replicas      int                 `json:"replicas,omitempty"`
+	ReadyReplicas int                 `json:"readyReplicas,omitempty"`
+	PodError      string              `json:"podError,omitempty"`
+	ClusterIP     string              `json:"clusterIP,omitempty"`
+	Forwarding    []*ForwardingStatus `json:"forwarding,omitempty"`
+	// PodOptions are those of the deploy request, which the live migrations from this host take
+	PodOptions *PodOptions `json:"podOptions,omitempty"`
+}
+
+type ForwardingStatus struct {
+	Protocol         string `json:"protocol"`
+	ListenAddr       string `json:"listenAddr"`
+	TargetAddr       string `json:"targetAddr"`
+	Suspended        bool   `json:"suspended"`
+	ActiveForwarders int    `json:"activeForwarders"`
+	DataRate         int    `json:"dataRate"`
+}
+
+func NewErrorResponse(err error) *Response {
+	resp := &Response{
+		Ok:   false,
+		Code: ErrorCodeOf(err),
+		Msg:  err.Error(),
+	}
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		resp.Errors = verr.Errors
+	}
+	return resp
 }
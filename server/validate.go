@@ -0,0 +1,354 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+type FieldError struct {
+	Field string `json:"field"`
+	Msg   string `json:"msg"`
+}
+
+// ValidationError is returned when a request is malformed. It lists every invalid field.
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (p *ValidationError) Error() string {
+	var msgs []string
+	for _, e := range p.Errors {
+		msgs = append(msgs, e.Field+": "+e.Msg)
+	}
+	return "Invalid request: " + strings.Join(msgs, "; ")
+}
+
+func (p *ValidationError) add(field string, msg string) {
+	p.Errors = append(p.Errors, FieldError{Field: field, Msg: msg})
+}
+
+func (p *ValidationError) requireString(field string, value string) {
+	if value == "" {
+		p.add(field, "must not be empty")
+	}
+}
+
+func (p *ValidationError) requirePort(field string, port int) {
+	for _, msg := range validation.IsValidPortNum(port) {
+		p.add(field, msg)
+	}
+}
+
+func (p *ValidationError) requireNonNegative(field string, value int) {
+	if value < 0 {
+		p.add(field, "must be greater than or equal to 0")
+	}
+}
+
+func (p *ValidationError) requireName(field string, name string) {
+	if name == "" {
+		p.add(field, "must not be empty")
+		return
+	}
+	// The name is used as the prefix of the pod and service names and as the app label.
+	for _, msg := range validation.IsDNS1035Label(ToServiceName(name)) {
+		p.add(field, msg)
+	}
+}
+
+// requirePorts checks the "ports" list if it is given, and the legacy single "port" otherwise.
+func (p *ValidationError) requirePorts(field string, ports []PortSpec, in int, ext int, requireSrc bool) {
+	if len(ports) == 0 {
+		p.requirePort(field+".port.in", in)
+		p.requirePort(field+".port.ext", ext)
+		return
+	}
+	exts := map[string]bool{}
+	for i, port := range ports {
+		portField := fmt.Sprintf("%s.ports[%d]", field, i)
+		p.requirePort(portField+".in", port.In)
+		p.requirePort(portField+".ext", port.Ext)
+		if requireSrc {
+			p.requirePort(portField+".src", port.Src)
+		}
+		switch port.Protocol {
+		case "", ProtocolTCP, ProtocolUDP:
+		default:
+			p.add(portField+".protocol", fmt.Sprintf("unsupported protocol %q; must be one of %s, %s",
+				port.Protocol, ProtocolTCP, ProtocolUDP))
+		}
+		key := fmt.Sprintf("%d/%s", port.Ext, port.GetProtocol())
+		if exts[key] {
+			p.add(portField+".ext", "must not be duplicated")
+		}
+		exts[key] = true
+	}
+}
+
+func (p *ValidationError) optionalNamespace(field string, namespace string) {
+	if namespace == "" {
+		return
+	}
+	for _, msg := range validation.IsDNS1123Label(namespace) {
+		p.add(field, msg)
+	}
+}
+
+func (p *ValidationError) optionalPodName(field string, podName string) {
+	if podName == "" {
+		return
+	}
+	for _, msg := range validation.IsDNS1123Subdomain(podName) {
+		p.add(field, msg)
+	}
+}
+
+func (p *ValidationError) optionalPodOptions(field string, opts *PodOptions) {
+	for k, v := range opts.Labels {
+		if k == "app" || k == ManagedByLabel {
+			p.add(fmt.Sprintf("%s.labels[%s]", field, k), "is reserved")
+			continue
+		}
+		for _, msg := range validation.IsQualifiedName(k) {
+			p.add(fmt.Sprintf("%s.labels[%s]", field, k), msg)
+		}
+		for _, msg := range validation.IsValidLabelValue(v) {
+			p.add(fmt.Sprintf("%s.labels[%s]", field, k), msg)
+		}
+	}
+	for k := range opts.Annotations {
+		for _, msg := range validation.IsQualifiedName(k) {
+			p.add(fmt.Sprintf("%s.annotations[%s]", field, k), msg)
+		}
+	}
+	for k, v := range opts.NodeSelector {
+		for _, msg := range validation.IsQualifiedName(k) {
+			p.add(fmt.Sprintf("%s.nodeSelector[%s]", field, k), msg)
+		}
+		for _, msg := range validation.IsValidLabelValue(v) {
+			p.add(fmt.Sprintf("%s.nodeSelector[%s]", field, k), msg)
+		}
+	}
+	if probe := opts.ReadinessProbe; probe != nil {
+		probeField := field + ".readinessProbe"
+		switch {
+		case probe.Exec != nil:
+			p.add(probeField+".exec", "is not supported; use httpGet or tcpSocket")
+		case probe.HTTPGet != nil:
+			p.optionalProbePort(probeField+".httpGet.port", probe.HTTPGet.Port)
+		case probe.TCPSocket != nil:
+			p.optionalProbePort(probeField+".tcpSocket.port", probe.TCPSocket.Port)
+		default:
+			p.add(probeField, "must have httpGet or tcpSocket")
+		}
+	}
+	volumes := map[string]bool{}
+	for _, v := range opts.Volumes {
+		volumes[v.Name] = true
+	}
+	for i, m := range opts.VolumeMounts {
+		if !volumes[m.Name] {
+			p.add(fmt.Sprintf("%s.volumeMounts[%d].name", field, i), "must refer to one of the volumes")
+		}
+	}
+}
+
+func (p *ValidationError) optionalProbePort(field string, port intstr.IntOrString) {
+	if port.Type == intstr.String {
+		for _, msg := range validation.IsValidPortName(port.StrVal) {
+			p.add(field, msg)
+		}
+		return
+	}
+	p.requirePort(field, port.IntValue())
+}
+
+func (p *ValidationError) optionalCheckpoint(field string, checkpoint string) {
+	switch checkpoint {
+	case "", CheckpointCRIU, CheckpointKubelet:
+	default:
+		p.add(field, fmt.Sprintf("unsupported checkpoint backend %q; must be %s or %s",
+			checkpoint, CheckpointCRIU, CheckpointKubelet))
+	}
+}
+
+func (p *ValidationError) optionalMigrationMode(field string, mode string) {
+	switch mode {
+	case "", MigrationModePreCopy, MigrationModePostCopy:
+	default:
+		p.add(field, fmt.Sprintf("unsupported migration mode %q; must be %s or %s",
+			mode, MigrationModePreCopy, MigrationModePostCopy))
+	}
+}
+
+func (p *ValidationError) optionalTransfer(field string, transfer string) {
+	switch transfer {
+	case "", TransferRsync, TransferTar:
+	default:
+		p.add(field, fmt.Sprintf("unsupported transfer backend %q; must be %s or %s",
+			transfer, TransferRsync, TransferTar))
+	}
+}
+
+func (p *ValidationError) optionalCompression(
+	field string,
+	transfer string,
+	compression string,
+	level int,
+	dedup bool,
+) {
+	switch compression {
+	case "", CompressionNone:
+		if level != 0 {
+			p.add(field+".compressionLevel", "must be 0 without compression")
+		}
+	case CompressionZstd, CompressionLZ4:
+		if maxLevel := compressionMaxLevel(compression); level < 0 || level > maxLevel {
+			p.add(field+".compressionLevel", fmt.Sprintf("must be between 0 and %d for %s", maxLevel, compression))
+		}
+	default:
+		p.add(field+".compression", fmt.Sprintf("unsupported compression %q; must be one of %s, %s, %s",
+			compression, CompressionNone, CompressionZstd, CompressionLZ4))
+	}
+	if dedup && transfer != TransferTar {
+		p.add(field+".dedup", "requires the "+TransferTar+" transfer")
+	}
+}
+
+func (p *ValidationError) optionalAdaptivePreDump(field string, adaptive *AdaptivePreDump) {
+	if adaptive == nil {
+		return
+	}
+	if adaptive.ThresholdBytes < 0 {
+		p.add(field+".thresholdBytes", "must not be negative")
+	}
+	if adaptive.MinReduction < 0 || adaptive.MinReduction >= 1 {
+		p.add(field+".minReduction", "must be at least 0 and less than 1")
+	}
+	p.requireNonNegative(field+".maxIterations", adaptive.MaxIterations)
+	p.requireNonNegative(field+".maxTimeSec", adaptive.MaxTimeSec)
+}
+
+func (p *ValidationError) requireEnv(field string, env map[string]string) {
+	for k := range env {
+		for _, msg := range validation.IsEnvVarName(k) {
+			p.add(fmt.Sprintf("%s[%s]", field, k), msg)
+		}
+	}
+}
+
+// ValidateRequest checks the fields required by the method and deploy type of req.
+// Unknown methods are not rejected here and are reported by the dispatcher.
+func ValidateRequest(req *Request) error {
+	verr := &ValidationError{}
+	switch req.Method {
+	case "deploy":
+		validateDeploy(verr, &req.Deploy)
+	case "remove":
+		verr.requireName("remove.name", req.Remove.Name)
+		verr.optionalNamespace("remove.namespace", req.Remove.Namespace)
+	case "status":
+		verr.requireString("status.name", req.Status.Name)
+		verr.optionalNamespace("status.namespace", req.Status.Namespace)
+	case "migration-status":
+		verr.requireString("migrationStatus.id", req.MigrationStatus.ID)
+	case "migration-cancel":
+		verr.requireString("migrationCancel.id", req.MigrationCancel.ID)
+	case "_dumpStart":
+		verr.requireName("_startDump.name", req.DumpStart.Name)
+		verr.optionalNamespace("_startDump.namespace", req.DumpStart.Namespace)
+		verr.optionalPodName("_startDump.pod", req.DumpStart.Pod)
+		verr.requireString("_startDump.dstAddr", req.DumpStart.DstAddr)
+		verr.requireNonNegative("_startDump.bwLimit", req.DumpStart.BwLimit)
+		if req.DumpStart.DstDataPort != 0 {
+			verr.requirePort("_startDump.dstDataPort", req.DumpStart.DstDataPort)
+		}
+		verr.optionalTransfer("_startDump.transfer", req.DumpStart.Transfer)
+		verr.optionalMigrationMode("_startDump.mode", req.DumpStart.Mode)
+		verr.optionalCompression("_startDump", req.DumpStart.Transfer, req.DumpStart.Compression,
+			req.DumpStart.CompressionLevel, req.DumpStart.Dedup)
+		if req.DumpStart.Transfer == TransferTar {
+			verr.requireString("_startDump.transferToken", req.DumpStart.TransferToken)
+		}
+	}
+	if len(verr.Errors) > 0 {
+		return NewAPIError(ErrCodeBadRequest, verr)
+	}
+	return nil
+}
+
+func validateDeploy(verr *ValidationError, deploy *RequestDeploy) {
+	verr.requireName("deploy.name", deploy.Name)
+	verr.optionalNamespace("deploy.namespace", deploy.Namespace)
+	switch deploy.Type {
+	case DeployTypeNew:
+		v := &deploy.NewApp
+		verr.requireString("deploy.newApp.image", v.Image)
+		verr.requirePorts("deploy.newApp", v.Ports, v.Port.In, v.Port.Ext, false)
+		verr.requireEnv("deploy.newApp.env", v.Env)
+		verr.optionalPodOptions("deploy.newApp.podOptions", &v.PodOptions)
+		verr.requireNonNegative("deploy.newApp.replicas", v.Replicas)
+		switch v.Controller {
+		case "", ControllerPod:
+			if v.Replicas > 1 {
+				verr.add("deploy.newApp.replicas", "must be 1 unless the controller is "+
+					ControllerDeployment+" or "+ControllerStatefulSet)
+			}
+		case ControllerDeployment, ControllerStatefulSet:
+		default:
+			verr.add("deploy.newApp.controller", fmt.Sprintf("unsupported controller %q; must be one of %s, %s, %s",
+				v.Controller, ControllerPod, ControllerDeployment, ControllerStatefulSet))
+		}
+		verr.optionalCheckpoint("deploy.newApp.checkpoint", v.Checkpoint)
+	case DeployTypeFwd:
+		v := &deploy.Fwd
+		verr.requireString("deploy.fwd.srcAddr", v.SrcAddr)
+		verr.requirePorts("deploy.fwd", v.Ports, v.Port.In, v.Port.Ext, false)
+	case DeployTypeLM:
+		v := &deploy.LM
+		verr.requireString("deploy.lm.image", v.Image)
+		verr.requireString("deploy.lm.srcAddr", v.SrcAddr)
+		verr.requireName("deploy.lm.srcName", v.SrcName)
+		verr.optionalNamespace("deploy.lm.srcNamespace", v.SrcNamespace)
+		verr.optionalPodName("deploy.lm.srcPod", v.SrcPod)
+		verr.requirePorts("deploy.lm", v.Ports, v.Port.In, v.Port.Ext, false)
+		verr.requireEnv("deploy.lm.env", v.Env)
+		verr.optionalPodOptions("deploy.lm.podOptions", &v.PodOptions)
+		verr.optionalCheckpoint("deploy.lm.checkpoint", v.Checkpoint)
+		verr.optionalTransfer("deploy.lm.transfer", v.Transfer)
+		verr.optionalCompression("deploy.lm", v.Transfer, v.Compression, v.CompressionLevel, v.Dedup)
+		verr.optionalAdaptivePreDump("deploy.lm.adaptivePreDump", v.AdaptivePreDump)
+		verr.optionalMigrationMode("deploy.lm.mode", v.Mode)
+		verr.requireNonNegative("deploy.lm.resumeTimeoutSec", v.ResumeTimeoutSec)
+		verr.requireNonNegative("deploy.lm.bwLimit", v.BwLimit)
+	case DeployTypeFwdLM:
+		v := &deploy.FwdLM
+		verr.requireString("deploy.fwdlm.image", v.Image)
+		verr.requireString("deploy.fwdlm.srcAddr", v.SrcAddr)
+		verr.requireName("deploy.fwdlm.srcName", v.SrcName)
+		verr.optionalNamespace("deploy.fwdlm.srcNamespace", v.SrcNamespace)
+		verr.optionalPodName("deploy.fwdlm.srcPod", v.SrcPod)
+		if len(v.Ports) == 0 {
+			verr.requirePort("deploy.fwdlm.srcPort", v.SrcPort)
+		}
+		verr.requirePorts("deploy.fwdlm", v.Ports, v.Port.In, v.Port.Ext, true)
+		verr.requireEnv("deploy.fwdlm.env", v.Env)
+		verr.optionalPodOptions("deploy.fwdlm.podOptions", &v.PodOptions)
+		verr.optionalCheckpoint("deploy.fwdlm.checkpoint", v.Checkpoint)
+		verr.optionalTransfer("deploy.fwdlm.transfer", v.Transfer)
+		verr.optionalCompression("deploy.fwdlm", v.Transfer, v.Compression, v.CompressionLevel, v.Dedup)
+		verr.optionalAdaptivePreDump("deploy.fwdlm.adaptivePreDump", v.AdaptivePreDump)
+		verr.optionalMigrationMode("deploy.fwdlm.mode", v.Mode)
+		verr.requireNonNegative("deploy.fwdlm.resumeTimeoutSec", v.ResumeTimeoutSec)
+		verr.requireNonNegative("deploy.fwdlm.bwLimit", v.BwLimit)
+		verr.requireNonNegative("deploy.fwdlm.dataRate", v.DataRate)
+	case "":
+		verr.add("deploy.type", "must not be empty")
+	default:
+		verr.add("deploy.type", fmt.Sprintf("unsupported deploy type %q; must be one of %s, %s, %s, %s",
+			deploy.Type, DeployTypeNew, DeployTypeFwd, DeployTypeLM, DeployTypeFwdLM))
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestValidateRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		req    string
+		fields []string
+	}{
+		{
+			name: "valid new",
+			req: `{"method":"deploy","deploy":{"name":"app-sample","type":"new",
+				"newApp":{"image":"app-sample:latest","port":{"in":8888,"ext":30088},"env":{"FOO":"bar"}}}}`,
+		},
+		{
+			name:   "new without name",
+			req:    `{"method":"deploy","deploy":{"type":"new","newApp":{"image":"a","port":{"in":1,"ext":2}}}}`,
+			fields: []string{"deploy.name"},
+		},
+		{
+			name:   "new with invalid name",
+			req:    `{"method":"deploy","deploy":{"name":"App_1","type":"new","newApp":{"image":"a","port":{"in":1,"ext":2}}}}`,
+			fields: []string{"deploy.name"},
+		},
+		{
+			name:   "new without image and ports",
+			req:    `{"method":"deploy","deploy":{"name":"app","type":"new"}}`,
+			fields: []string{"deploy.newApp.image", "deploy.newApp.port.ext", "deploy.newApp.port.in"},
+		},
+		{
+			name: "new with invalid env",
+			req: `{"method":"deploy","deploy":{"name":"app","type":"new",
+				"newApp":{"image":"a","port":{"in":1,"ext":2},"env":{"1FOO":"bar"}}}}`,
+			fields: []string{"deploy.newApp.env[1FOO]"},
+		},
+		{
+			name:   "new with out of range port",
+			req:    `{"method":"deploy","deploy":{"name":"app","type":"new","newApp":{"image":"a","port":{"in":70000,"ext":2}}}}`,
+			fields: []string{"deploy.newApp.port.in"},
+		},
+		{
+			name:   "new with invalid namespace",
+			req:    `{"method":"deploy","deploy":{"name":"app","namespace":"Team_A","type":"new","newApp":{"image":"a","port":{"in":1,"ext":2}}}}`,
+			fields: []string{"deploy.namespace"},
+		},
+		{
+			name: "new with pod options",
+			req: `{"method":"deploy","deploy":{"name":"app","type":"new","newApp":{"image":"a","port":{"in":1,"ext":2},
+				"podOptions":{"resources":{"limits":{"cpu":"500m","memory":"256Mi"}},"nodeSelector":{"zone":"edge-1"},
+				"volumes":[{"name":"data","emptyDir":{}}],"volumeMounts":[{"name":"data","mountPath":"/data"}],
+				"labels":{"tier":"edge"},"annotations":{"example.com/owner":"team-a"}}}}}`,
+		},
+		{
+			name: "new with invalid pod options",
+			req: `{"method":"deploy","deploy":{"name":"app","type":"new","newApp":{"image":"a","port":{"in":1,"ext":2},
+				"podOptions":{"volumeMounts":[{"name":"data","mountPath":"/data"}],"labels":{"app":"other"}}}}}`,
+			fields: []string{"deploy.newApp.podOptions.labels[app]", "deploy.newApp.podOptions.volumeMounts[0].name"},
+		},
+		{
+			name: "new with multiple ports",
+			req: `{"method":"deploy","deploy":{"name":"app","type":"new","newApp":{"image":"a",
+				"ports":[{"in":8888,"ext":30088},{"in":5000,"ext":30050,"protocol":"UDP"},{"in":5000,"ext":30050}]}}}`,
+		},
+		{
+			name: "new with invalid ports",
+			req: `{"method":"deploy","deploy":{"name":"app","type":"new","newApp":{"image":"a",
+				"ports":[{"in":8888,"ext":30088},{"in":0,"ext":30088,"protocol":"SCTP"},{"in":1,"ext":30088,"protocol":"TCP"}]}}}`,
+			fields: []string{"deploy.newApp.ports[1].in", "deploy.newApp.ports[1].protocol", "deploy.newApp.ports[2].ext"},
+		},
+		{
+			name: "new with readiness probe",
+			req: `{"method":"deploy","deploy":{"name":"app","type":"new","newApp":{"image":"a","port":{"in":8888,"ext":30088},
+				"podOptions":{"readinessProbe":{"httpGet":{"path":"/healthz","port":8888},"periodSeconds":2}}}}}`,
+		},
+		{
+			name: "new with invalid readiness probe port",
+			req: `{"method":"deploy","deploy":{"name":"app","type":"new","newApp":{"image":"a","port":{"in":8888,"ext":30088},
+				"podOptions":{"readinessProbe":{"tcpSocket":{"port":70000}}}}}}`,
+			fields: []string{"deploy.newApp.podOptions.readinessProbe.tcpSocket.port"},
+		},
+		{
+			name: "new with exec readiness probe",
+			req: `{"method":"deploy","deploy":{"name":"app","type":"new","newApp":{"image":"a","port":{"in":8888,"ext":30088},
+				"podOptions":{"readinessProbe":{"exec":{"command":["true"]}}}}}}`,
+			fields: []string{"deploy.newApp.podOptions.readinessProbe.exec"},
+		},
+		{
+			name: "new with deployment",
+			req: `{"method":"deploy","deploy":{"name":"app","type":"new","newApp":{"image":"a","port":{"in":1,"ext":2},
+				"controller":"deployment","replicas":3}}}`,
+		},
+		{
+			name: "new with replicas but without controller",
+			req: `{"method":"deploy","deploy":{"name":"app","type":"new","newApp":{"image":"a","port":{"in":1,"ext":2},
+				"replicas":3}}}`,
+			fields: []string{"deploy.newApp.replicas"},
+		},
+		{
+			name: "new with unknown controller",
+			req: `{"method":"deploy","deploy":{"name":"app","type":"new","newApp":{"image":"a","port":{"in":1,"ext":2},
+				"controller":"daemonset"}}}`,
+			fields: []string{"deploy.newApp.controller"},
+		},
+		{
+			name: "new with kubelet checkpoint",
+			req: `{"method":"deploy","deploy":{"name":"app","type":"new","newApp":{"image":"a","port":{"in":1,"ext":2},
+				"checkpoint":"kubelet"}}}`,
+		},
+		{
+			name: "new with unknown checkpoint",
+			req: `{"method":"deploy","deploy":{"name":"app","type":"new","newApp":{"image":"a","port":{"in":1,"ext":2},
+				"checkpoint":"podman"}}}`,
+			fields: []string{"deploy.newApp.checkpoint"},
+		},
+		{
+			name:   "missing type",
+			req:    `{"method":"deploy","deploy":{"name":"app"}}`,
+			fields: []string{"deploy.type"},
+		},
+		{
+			name:   "unknown type",
+			req:    `{"method":"deploy","deploy":{"name":"app","type":"foo"}}`,
+			fields: []string{"deploy.type"},
+		},
+		{
+			name: "valid fwd",
+			req:  `{"method":"deploy","deploy":{"name":"app","type":"fwd","fwd":{"srcAddr":"192.168.0.12","port":{"in":30088,"ext":30088}}}}`,
+		},
+		{
+			name:   "fwd without srcAddr",
+			req:    `{"method":"deploy","deploy":{"name":"app","type":"fwd","fwd":{"port":{"in":30088,"ext":30088}}}}`,
+			fields: []string{"deploy.fwd.srcAddr"},
+		},
+		{
+			name: "valid lm",
+			req: `{"method":"deploy","deploy":{"name":"app","type":"lm","lm":{"image":"a","srcAddr":"192.168.0.12",
+				"srcName":"app","port":{"in":8888,"ext":30088},"bwLimit":10,"iteration":2}}}`,
+		},
+		{
+			name: "lm with invalid srcPod",
+			req: `{"method":"deploy","deploy":{"name":"app","type":"lm","lm":{"image":"a","srcAddr":"192.168.0.12",
+				"srcName":"app","srcPod":"App_0","port":{"in":8888,"ext":30088}}}}`,
+			fields: []string{"deploy.lm.srcPod"},
+		},
+		{
+			name: "lm with tar transfer, zstd and dedup",
+			req: `{"method":"deploy","deploy":{"name":"app","type":"lm","lm":{"image":"a","srcAddr":"192.168.0.12",
+				"srcName":"app","port":{"in":8888,"ext":30088},"transfer":"tar","compression":"zstd",
+				"compressionLevel":3,"dedup":true}}}`,
+		},
+		{
+			name: "lm with dedup over rsync and too high lz4 level",
+			req: `{"method":"deploy","deploy":{"name":"app","type":"lm","lm":{"image":"a","srcAddr":"192.168.0.12",
+				"srcName":"app","port":{"in":8888,"ext":30088},"compression":"lz4","compressionLevel":13,
+				"dedup":true}}}`,
+			fields: []string{"deploy.lm.compressionLevel", "deploy.lm.dedup"},
+		},
+		{
+			name: "lm with unknown compression",
+			req: `{"method":"deploy","deploy":{"name":"app","type":"lm","lm":{"image":"a","srcAddr":"192.168.0.12",
+				"srcName":"app","port":{"in":8888,"ext":30088},"compression":"gzip"}}}`,
+			fields: []string{"deploy.lm.compression"},
+		},
+		{
+			name: "lm with adaptive pre-dump",
+			req: `{"method":"deploy","deploy":{"name":"app","type":"lm","lm":{"image":"a","srcAddr":"192.168.0.12",
+				"srcName":"app","port":{"in":8888,"ext":30088},"adaptivePreDump":{"thresholdBytes":1048576,
+				"minReduction":0.2,"maxIterations":5,"maxTimeSec":30}}}}`,
+		},
+		{
+			name: "lm with invalid adaptive pre-dump",
+			req: `{"method":"deploy","deploy":{"name":"app","type":"lm","lm":{"image":"a","srcAddr":"192.168.0.12",
+				"srcName":"app","port":{"in":8888,"ext":30088},"adaptivePreDump":{"thresholdBytes":-1,
+				"minReduction":1,"maxIterations":-1,"maxTimeSec":-1}}}}`,
+			fields: []string{"deploy.lm.adaptivePreDump.maxIterations", "deploy.lm.adaptivePreDump.maxTimeSec",
+				"deploy.lm.adaptivePreDump.minReduction", "deploy.lm.adaptivePreDump.thresholdBytes"},
+		},
+		{
+			name: "fwdlm with unknown mode",
+			req: `{"method":"deploy","deploy":{"name":"app","type":"fwdlm","fwdlm":{"image":"a","srcAddr":"192.168.0.12",
+				"srcName":"app","srcPort":30088,"port":{"in":8888,"ext":30088},"mode":"hybrid"}}}`,
+			fields: []string{"deploy.fwdlm.mode"},
+		},
+		{
+			name: "lm with postcopy",
+			req: `{"method":"deploy","deploy":{"name":"app","type":"lm","lm":{"image":"a","srcAddr":"192.168.0.12",
+				"srcName":"app","port":{"in":8888,"ext":30088},"mode":"postcopy"}}}`,
+		},
+		{
+			name: "lm without src and negative bwLimit",
+			req: `{"method":"deploy","deploy":{"name":"app","type":"lm","lm":{"image":"a",
+				"port":{"in":8888,"ext":30088},"bwLimit":-1}}}`,
+			fields: []string{"deploy.lm.bwLimit", "deploy.lm.srcAddr", "deploy.lm.srcName"},
+		},
+		{
+			name: "valid fwdlm",
+			req: `{"method":"deploy","deploy":{"name":"app","type":"fwdlm","fwdlm":{"image":"a","srcAddr":"192.168.0.12",
+				"srcName":"app","srcPort":30088,"port":{"in":8888,"ext":30088},"dataRate":100}}}`,
+		},
+		{
+			name: "fwdlm without srcPort and negative dataRate",
+			req: `{"method":"deploy","deploy":{"name":"app","type":"fwdlm","fwdlm":{"image":"a","srcAddr":"192.168.0.12",
+				"srcName":"app","port":{"in":8888,"ext":30088},"dataRate":-5}}}`,
+			fields: []string{"deploy.fwdlm.dataRate", "deploy.fwdlm.srcPort"},
+		},
+		{
+			name: "valid fwdlm with ports",
+			req: `{"method":"deploy","deploy":{"name":"app","type":"fwdlm","fwdlm":{"image":"a","srcAddr":"192.168.0.12",
+				"srcName":"app","ports":[{"in":8888,"ext":30088,"src":30088},{"in":5000,"ext":30050,"src":30050,"protocol":"UDP"}]}}}`,
+		},
+		{
+			name: "fwdlm with ports without src",
+			req: `{"method":"deploy","deploy":{"name":"app","type":"fwdlm","fwdlm":{"image":"a","srcAddr":"192.168.0.12",
+				"srcName":"app","ports":[{"in":8888,"ext":30088}]}}}`,
+			fields: []string{"deploy.fwdlm.ports[0].src"},
+		},
+		{
+			name: "valid remove",
+			req:  `{"method":"remove","remove":{"name":"app"}}`,
+		},
+		{
+			name:   "remove without name",
+			req:    `{"method":"remove"}`,
+			fields: []string{"remove.name"},
+		},
+		{
+			name: "valid dumpStart",
+			req:  `{"method":"_dumpStart","_startDump":{"name":"app","dstAddr":"192.168.0.13"}}`,
+		},
+		{
+			name:   "dumpStart without dstAddr",
+			req:    `{"method":"_dumpStart","_startDump":{"name":"app","bwLimit":-1}}`,
+			fields: []string{"_startDump.bwLimit", "_startDump.dstAddr"},
+		},
+		{
+			name:   "migration-status without id",
+			req:    `{"method":"migration-status"}`,
+			fields: []string{"migrationStatus.id"},
+		},
+		{
+			name: "unknown method is left to the dispatcher",
+			req:  `{"method":"foo"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req Request
+			if err := json.Unmarshal([]byte(tt.req), &req); err != nil {
+				t.Fatal(err)
+			}
+			err := ValidateRequest(&req)
+			if len(tt.fields) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected errors on %v", tt.fields)
+			}
+			if code := ErrorCodeOf(err); code != ErrCodeBadRequest {
+				t.Errorf("code = %s, want %s", code, ErrCodeBadRequest)
+			}
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("not a ValidationError: %v", err)
+			}
+			fieldSet := map[string]bool{}
+			for _, e := range verr.Errors {
+				fieldSet[e.Field] = true
+			}
+			var fields []string
+			for f := range fieldSet {
+				fields = append(fields, f)
+			}
+			sort.Strings(fields)
+			if !reflect.DeepEqual(fields, tt.fields) {
+				t.Errorf("fields = %v, want %v", fields, tt.fields)
+			}
+		})
+	}
+}
+
+func TestNewErrorResponseWithValidationError(t *testing.T) {
+	var req Request
+	req.Method = "remove"
+	resp := NewErrorResponse(ValidateRequest(&req))
+	if resp.Ok {
+		t.Fatal("resp.Ok must be false")
+	}
+	if resp.Code != ErrCodeBadRequest {
+		t.Errorf("resp.Code = %s, want %s", resp.Code, ErrCodeBadRequest)
+	}
+	if len(resp.Errors) != 1 || resp.Errors[0].Field != "remove.name" {
+		t.Errorf("resp.Errors = %v", resp.Errors)
+	}
+}